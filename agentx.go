@@ -0,0 +1,670 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// AgentX pdu types of RFC 2741.
+const (
+	agentxOpen       = 1
+	agentxClose      = 2
+	agentxRegister   = 3
+	agentxGet        = 5
+	agentxGetNext    = 6
+	agentxGetBulk    = 7
+	agentxTestSet    = 8
+	agentxCommitSet  = 9
+	agentxUndoSet    = 10
+	agentxCleanupSet = 11
+	agentxResponse   = 18
+)
+
+// AgentX header flags.
+const (
+	agentxNonDefaultContext = 0x08
+	agentxNetworkByteOrder  = 0x10
+)
+
+// AgentX varbind types.
+const (
+	agentxInteger      = 2
+	agentxGauge32      = 66
+	agentxCounter64    = 70
+	agentxNoSuchObject = 128
+	agentxEndOfMibView = 130
+)
+
+// AgentX response errors.
+const (
+	agentxNotWritable    = 17
+	agentxUnsupportedCtx = 262
+)
+
+const (
+	agentxHeaderSize = 20
+	// agentxTimeout is the timeout in seconds the master agent gets for our
+	// answers.
+	agentxTimeout = 5
+	// agentxRetry is the pause before connecting again to the master agent.
+	agentxRetry = 10 * time.Second
+	// agentxCacheTTL limits how often walking the subtree collects the stats.
+	agentxCacheTTL = 5 * time.Second
+)
+
+// oid is an object identifier like 1.3.6.1.4.1.
+type oid []uint32
+
+func parseOID(s string) (oid, error) {
+	parts := strings.Split(strings.Trim(s, "."), ".")
+	o := make(oid, 0, len(parts))
+
+	for _, p := range parts {
+		n, err := strconv.ParseUint(p, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid oid: %s", s)
+		}
+
+		o = append(o, uint32(n))
+	}
+
+	return o, nil
+}
+
+func (o oid) String() string {
+	parts := make([]string, len(o))
+	for i, n := range o {
+		parts[i] = strconv.FormatUint(uint64(n), 10)
+	}
+
+	return strings.Join(parts, ".")
+}
+
+// compare orders oids lexicographically.
+func (o oid) compare(other oid) int {
+	for i := 0; i < len(o) && i < len(other); i++ {
+		switch {
+		case o[i] < other[i]:
+			return -1
+		case o[i] > other[i]:
+			return 1
+		}
+	}
+
+	return len(o) - len(other)
+}
+
+// agentxObject is a scalar of SMTPD-EXPORTER-MIB below the root.
+type agentxObject struct {
+	Sub  oid
+	Type uint16
+	// Stat is the key of the value in `smtpctl show stats`, or the component
+	// of `smtpctl show status` for its state.
+	Stat      string
+	Component bool
+}
+
+// nolint:gochecknoglobals
+var agentxObjects = []agentxObject{
+	{Sub: oid{1, 1}, Type: agentxCounter64, Stat: "scheduler.delivery.ok"},
+	{Sub: oid{1, 2}, Type: agentxCounter64, Stat: "scheduler.delivery.permfail"},
+	{Sub: oid{1, 3}, Type: agentxCounter64, Stat: "scheduler.delivery.tempfail"},
+	{Sub: oid{1, 4}, Type: agentxCounter64, Stat: "scheduler.delivery.loop"},
+	{Sub: oid{1, 5}, Type: agentxGauge32, Stat: "smtp.session"},
+	{Sub: oid{1, 6}, Type: agentxGauge32, Stat: "mta.session"},
+	{Sub: oid{1, 7}, Type: agentxGauge32, Stat: "uptime"},
+	{Sub: oid{2, 1}, Type: agentxGauge32, Stat: "scheduler.envelope"},
+	{Sub: oid{2, 2}, Type: agentxGauge32, Stat: "scheduler.envelope.incoming"},
+	{Sub: oid{2, 3}, Type: agentxGauge32, Stat: "scheduler.envelope.inflight"},
+	{Sub: oid{2, 4}, Type: agentxCounter64, Stat: "scheduler.envelope.expired"},
+	{Sub: oid{3, 1}, Type: agentxInteger, Stat: "MDA", Component: true},
+	{Sub: oid{3, 2}, Type: agentxInteger, Stat: "MTA", Component: true},
+	{Sub: oid{3, 3}, Type: agentxInteger, Stat: "SMTP", Component: true},
+}
+
+// Component states of SmtpdComponentState.
+const (
+	componentRunning = 1
+	componentPaused  = 2
+	componentUnknown = 3
+)
+
+// agentxValue is the value of an object instance.
+type agentxValue struct {
+	OID   oid
+	Type  uint16
+	Value uint64
+}
+
+// AgentX is an AgentX subagent serving the stats below Root.
+type AgentX struct {
+	// Socket is the unix socket of the master agent.
+	Socket string
+	Root   oid
+	Stats  Stat
+	// Status prints `smtpctl show status` output.
+	Status Stat
+
+	start  time.Time
+	mux    sync.Mutex
+	values []agentxValue
+	time   time.Time
+}
+
+// Run serves the master agent and connects again when the connection gets
+// lost.
+func (a *AgentX) Run() {
+	a.start = time.Now()
+
+	for {
+		err := a.session()
+		log.WithFields(log.Fields{"error": err, "socket": a.Socket}).Error("agentx session ended")
+		time.Sleep(agentxRetry)
+	}
+}
+
+// session opens a session, registers the subtree and answers requests until
+// the connection breaks.
+func (a *AgentX) session() error {
+	conn, err := net.Dial("unix", a.Socket)
+	if err != nil {
+		return fmt.Errorf("could not connect to agentx master: %w", err)
+	}
+	defer conn.Close()
+
+	w := newAgentxWriter()
+	w.byte(agentxTimeout)
+	w.pad(3)
+	w.oid(a.Root, false)
+	w.octets([]byte("smtpd_exporter"))
+
+	res, err := a.request(conn, agentxPacket{Type: agentxOpen, PacketID: 1}, w)
+	if err != nil {
+		return fmt.Errorf("could not open agentx session: %w", err)
+	}
+
+	session := res.SessionID
+
+	w = newAgentxWriter()
+	w.byte(0) // default timeout
+	w.byte(127)
+	w.pad(2)
+	w.oid(a.Root, false)
+
+	if _, err := a.request(conn, agentxPacket{Type: agentxRegister, SessionID: session, PacketID: 2}, w); err != nil {
+		return fmt.Errorf("could not register agentx subtree: %w", err)
+	}
+
+	log.WithFields(log.Fields{"socket": a.Socket, "oid": a.Root.String()}).Info("registered agentx subtree")
+
+	for {
+		p, err := readAgentxPacket(conn)
+		if err != nil {
+			return err
+		}
+
+		switch p.Type {
+		case agentxGet, agentxGetNext, agentxGetBulk, agentxTestSet, agentxCommitSet, agentxUndoSet:
+			if err := a.answer(conn, p); err != nil {
+				return err
+			}
+		case agentxClose:
+			return errors.New("agentx master closed the session")
+		}
+	}
+}
+
+// request sends a pdu and waits for the response.
+func (a *AgentX) request(conn io.ReadWriter, p agentxPacket, w *agentxWriter) (*agentxPacket, error) {
+	p.Flags = agentxNetworkByteOrder
+	p.Payload = w.Bytes()
+
+	if _, err := conn.Write(p.bytes()); err != nil {
+		return nil, err
+	}
+
+	res, err := readAgentxPacket(conn)
+	if err != nil {
+		return nil, err
+	}
+
+	r := res.reader()
+	r.uint32()
+
+	if code := r.uint16(); r.err == nil && code != 0 {
+		return nil, fmt.Errorf("agentx error %d", code)
+	}
+
+	return res, r.err
+}
+
+// answer writes the response to a request of the master agent.
+func (a *AgentX) answer(conn io.Writer, p *agentxPacket) error {
+	var (
+		code, index uint16
+		varbinds    []agentxValue
+	)
+
+	r := p.reader()
+
+	if p.Flags&agentxNonDefaultContext != 0 {
+		code = agentxUnsupportedCtx
+	}
+
+	switch {
+	case code != 0:
+	case p.Type == agentxTestSet:
+		code, index = agentxNotWritable, 1
+	case p.Type == agentxGet || p.Type == agentxGetNext:
+		values := a.snapshot()
+
+		for len(r.data) > 0 && r.err == nil {
+			start, include := r.oid()
+			end, _ := r.oid()
+
+			if p.Type == agentxGet {
+				varbinds = append(varbinds, get(values, start))
+			} else {
+				varbinds = append(varbinds, getNext(values, start, end, include))
+			}
+		}
+	case p.Type == agentxGetBulk:
+		varbinds = getBulk(a.snapshot(), r)
+	}
+
+	if r.err != nil {
+		return fmt.Errorf("could not parse agentx request: %w", r.err)
+	}
+
+	w := newAgentxWriter()
+	w.uint32(uint32(time.Since(a.start) / (10 * time.Millisecond)))
+	w.uint16(code)
+	w.uint16(index)
+
+	for _, v := range varbinds {
+		w.varbind(v)
+	}
+
+	res := agentxPacket{
+		Type:          agentxResponse,
+		Flags:         agentxNetworkByteOrder,
+		SessionID:     p.SessionID,
+		TransactionID: p.TransactionID,
+		PacketID:      p.PacketID,
+		Payload:       w.Bytes(),
+	}
+
+	_, err := conn.Write(res.bytes())
+
+	return err
+}
+
+func get(values []agentxValue, name oid) agentxValue {
+	for _, v := range values {
+		if v.OID.compare(name) == 0 {
+			return v
+		}
+	}
+
+	return agentxValue{OID: name, Type: agentxNoSuchObject}
+}
+
+// getNext returns the first value after start, or at start with include,
+// that is before end.
+func getNext(values []agentxValue, start, end oid, include bool) agentxValue {
+	for _, v := range values {
+		c := v.OID.compare(start)
+		if c < 0 || (c == 0 && !include) {
+			continue
+		}
+
+		if len(end) > 0 && v.OID.compare(end) >= 0 {
+			break
+		}
+
+		return v
+	}
+
+	return agentxValue{OID: start, Type: agentxEndOfMibView}
+}
+
+func getBulk(values []agentxValue, r *agentxReader) []agentxValue {
+	nonRepeaters := int(r.uint16())
+	maxRepetitions := int(r.uint16())
+
+	type searchRange struct {
+		start, end oid
+		include    bool
+	}
+
+	var ranges []searchRange
+
+	for len(r.data) > 0 && r.err == nil {
+		start, include := r.oid()
+		end, _ := r.oid()
+		ranges = append(ranges, searchRange{start, end, include})
+	}
+
+	var varbinds []agentxValue
+
+	for i := 0; i < nonRepeaters && i < len(ranges); i++ {
+		varbinds = append(varbinds, getNext(values, ranges[i].start, ranges[i].end, ranges[i].include))
+	}
+
+	if nonRepeaters > len(ranges) {
+		nonRepeaters = len(ranges)
+	}
+
+	repeaters := ranges[nonRepeaters:]
+
+	for n := 0; n < maxRepetitions && len(repeaters) > 0; n++ {
+		done := true
+
+		for i, s := range repeaters {
+			v := getNext(values, s.start, s.end, s.include)
+			varbinds = append(varbinds, v)
+			repeaters[i] = searchRange{v.OID, s.end, false}
+
+			if v.Type != agentxEndOfMibView {
+				done = false
+			}
+		}
+
+		if done {
+			break
+		}
+	}
+
+	return varbinds
+}
+
+// snapshot returns the values ordered by oid, collecting them again when
+// they are older than agentxCacheTTL. Missing stats are left out.
+func (a *AgentX) snapshot() []agentxValue {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+
+	if a.values != nil && time.Since(a.time) < agentxCacheTTL {
+		return a.values
+	}
+
+	stats := map[string]interface{}{}
+
+	out, err := a.Stats.Now()
+	if err != nil {
+		log.WithFields(log.Fields{"error": err}).Error("could not get stats for agentx")
+	} else {
+		stats = parseStats(out)
+	}
+
+	status, err := a.Status.Now()
+	if err != nil {
+		log.WithFields(log.Fields{"error": err}).Debug("could not get status for agentx")
+	}
+
+	values := []agentxValue{}
+
+	for _, o := range agentxObjects {
+		name := append(append(oid{}, a.Root...), append(o.Sub, 0)...)
+
+		if o.Component {
+			values = append(values, agentxValue{OID: name, Type: o.Type, Value: componentState(status, o.Stat)})
+			continue
+		}
+
+		n, ok := stats[o.Stat].(int64)
+		if !ok || n < 0 {
+			continue
+		}
+
+		values = append(values, agentxValue{OID: name, Type: o.Type, Value: uint64(n)})
+	}
+
+	sort.Slice(values, func(i, j int) bool { return values[i].OID.compare(values[j].OID) < 0 })
+
+	a.values, a.time = values, time.Now()
+
+	return values
+}
+
+// componentState finds the state of a component in `smtpctl show status`
+// output.
+func componentState(status, component string) uint64 {
+	for _, line := range strings.Split(status, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 || fields[0] != component {
+			continue
+		}
+
+		switch fields[1] {
+		case "running":
+			return componentRunning
+		case "paused":
+			return componentPaused
+		}
+	}
+
+	return componentUnknown
+}
+
+// agentxPacket is an AgentX pdu with its header.
+type agentxPacket struct {
+	Type          byte
+	Flags         byte
+	SessionID     uint32
+	TransactionID uint32
+	PacketID      uint32
+	Payload       []byte
+}
+
+func (p *agentxPacket) order() binary.ByteOrder {
+	if p.Flags&agentxNetworkByteOrder != 0 {
+		return binary.BigEndian
+	}
+
+	return binary.LittleEndian
+}
+
+func (p *agentxPacket) bytes() []byte {
+	b := make([]byte, agentxHeaderSize+len(p.Payload))
+	b[0], b[1], b[2] = 1, p.Type, p.Flags
+
+	o := p.order()
+	o.PutUint32(b[4:], p.SessionID)
+	o.PutUint32(b[8:], p.TransactionID)
+	o.PutUint32(b[12:], p.PacketID)
+	o.PutUint32(b[16:], uint32(len(p.Payload)))
+	copy(b[agentxHeaderSize:], p.Payload)
+
+	return b
+}
+
+func (p *agentxPacket) reader() *agentxReader {
+	r := &agentxReader{data: p.Payload, order: p.order()}
+
+	// the context of the request comes first
+	if p.Flags&agentxNonDefaultContext != 0 && p.Type != agentxResponse {
+		r.octets()
+	}
+
+	return r
+}
+
+func readAgentxPacket(r io.Reader) (*agentxPacket, error) {
+	h := make([]byte, agentxHeaderSize)
+	if _, err := io.ReadFull(r, h); err != nil {
+		return nil, err
+	}
+
+	if h[0] != 1 {
+		return nil, fmt.Errorf("unsupported agentx version %d", h[0])
+	}
+
+	p := &agentxPacket{Type: h[1], Flags: h[2]}
+	o := p.order()
+	p.SessionID = o.Uint32(h[4:])
+	p.TransactionID = o.Uint32(h[8:])
+	p.PacketID = o.Uint32(h[12:])
+	p.Payload = make([]byte, o.Uint32(h[16:]))
+
+	if _, err := io.ReadFull(r, p.Payload); err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+// agentxWriter encodes pdu payloads in network byte order.
+type agentxWriter struct {
+	bytes.Buffer
+}
+
+func newAgentxWriter() *agentxWriter {
+	return &agentxWriter{}
+}
+
+func (w *agentxWriter) byte(b byte) {
+	w.WriteByte(b)
+}
+
+func (w *agentxWriter) pad(n int) {
+	w.Write(make([]byte, n))
+}
+
+func (w *agentxWriter) uint16(n uint16) {
+	var b [2]byte
+
+	binary.BigEndian.PutUint16(b[:], n)
+	w.Write(b[:])
+}
+
+func (w *agentxWriter) uint32(n uint32) {
+	var b [4]byte
+
+	binary.BigEndian.PutUint32(b[:], n)
+	w.Write(b[:])
+}
+
+func (w *agentxWriter) uint64(n uint64) {
+	var b [8]byte
+
+	binary.BigEndian.PutUint64(b[:], n)
+	w.Write(b[:])
+}
+
+// oid writes an oid, shortening 1.3.6.1.x to the prefix x.
+func (w *agentxWriter) oid(o oid, include bool) {
+	prefix := byte(0)
+
+	if len(o) > 4 && o[:4].compare(oid{1, 3, 6, 1}) == 0 && o[4] > 0 && o[4] < 256 {
+		prefix = byte(o[4])
+		o = o[5:]
+	}
+
+	w.byte(byte(len(o)))
+	w.byte(prefix)
+
+	if include {
+		w.byte(1)
+	} else {
+		w.byte(0)
+	}
+
+	w.byte(0)
+
+	for _, n := range o {
+		w.uint32(n)
+	}
+}
+
+func (w *agentxWriter) octets(b []byte) {
+	w.uint32(uint32(len(b)))
+	w.Write(b)
+	w.pad((4 - len(b)%4) % 4)
+}
+
+func (w *agentxWriter) varbind(v agentxValue) {
+	w.uint16(v.Type)
+	w.pad(2)
+	w.oid(v.OID, false)
+
+	switch v.Type {
+	case agentxInteger, agentxGauge32:
+		w.uint32(uint32(v.Value))
+	case agentxCounter64:
+		w.uint64(v.Value)
+	}
+}
+
+// agentxReader decodes pdu payloads, keeping the first error.
+type agentxReader struct {
+	data  []byte
+	order binary.ByteOrder
+	err   error
+}
+
+func (r *agentxReader) next(n int) []byte {
+	if r.err != nil {
+		return make([]byte, n)
+	}
+
+	if len(r.data) < n {
+		r.err = io.ErrUnexpectedEOF
+		r.data = nil
+
+		return make([]byte, n)
+	}
+
+	b := r.data[:n]
+	r.data = r.data[n:]
+
+	return b
+}
+
+func (r *agentxReader) uint16() uint16 {
+	return r.order.Uint16(r.next(2))
+}
+
+func (r *agentxReader) uint32() uint32 {
+	return r.order.Uint32(r.next(4))
+}
+
+func (r *agentxReader) uint64() uint64 {
+	return r.order.Uint64(r.next(8))
+}
+
+func (r *agentxReader) oid() (oid, bool) {
+	h := r.next(4)
+
+	var o oid
+	if h[1] != 0 {
+		o = oid{1, 3, 6, 1, uint32(h[1])}
+	}
+
+	for i := 0; i < int(h[0]); i++ {
+		o = append(o, r.uint32())
+	}
+
+	return o, h[2] != 0
+}
+
+func (r *agentxReader) octets() []byte {
+	n := int(r.uint32())
+	if n > len(r.data) {
+		r.err = io.ErrUnexpectedEOF
+		return nil
+	}
+
+	return r.next(n + (4-n%4)%4)[:n]
+}
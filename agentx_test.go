@@ -0,0 +1,222 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// agentxMaster is a stand-in for the master agent accepting one subagent.
+type agentxMaster struct {
+	t       *testing.T
+	conn    net.Conn
+	packets uint32
+	session uint32
+	subtree oid
+}
+
+func (m *agentxMaster) accept(l net.Listener) {
+	conn, err := l.Accept()
+	if err != nil {
+		m.t.Fatal(err)
+	}
+
+	m.conn = conn
+	m.session = 42
+
+	open := m.read(agentxOpen)
+	r := open.reader()
+	r.next(4)
+	r.oid()
+	assert.Equal(m.t, "smtpd_exporter", string(r.octets()))
+	m.respond(open, 0)
+
+	register := m.read(agentxRegister)
+	assert.Equal(m.t, m.session, register.SessionID)
+
+	r = register.reader()
+	r.next(4)
+	m.subtree, _ = r.oid()
+	m.respond(register, 0)
+}
+
+func (m *agentxMaster) read(typ byte) *agentxPacket {
+	p, err := readAgentxPacket(m.conn)
+	if err != nil {
+		m.t.Fatal(err)
+	}
+
+	assert.Equal(m.t, typ, p.Type)
+
+	return p
+}
+
+func (m *agentxMaster) respond(p *agentxPacket, code uint16) {
+	w := newAgentxWriter()
+	w.uint32(0)
+	w.uint16(code)
+	w.uint16(0)
+
+	res := agentxPacket{
+		Type: agentxResponse, Flags: agentxNetworkByteOrder,
+		SessionID: m.session, PacketID: p.PacketID, Payload: w.Bytes(),
+	}
+
+	if _, err := m.conn.Write(res.bytes()); err != nil {
+		m.t.Fatal(err)
+	}
+}
+
+// request sends a pdu and returns the error and varbinds of the response.
+func (m *agentxMaster) request(typ byte, payload func(w *agentxWriter)) (uint16, []agentxValue) {
+	m.packets++
+
+	w := newAgentxWriter()
+	payload(w)
+
+	p := agentxPacket{
+		Type: typ, Flags: agentxNetworkByteOrder,
+		SessionID: m.session, TransactionID: m.packets, PacketID: m.packets, Payload: w.Bytes(),
+	}
+
+	if _, err := m.conn.Write(p.bytes()); err != nil {
+		m.t.Fatal(err)
+	}
+
+	res := m.read(agentxResponse)
+	assert.Equal(m.t, m.packets, res.PacketID)
+
+	r := res.reader()
+	r.uint32()
+	code := r.uint16()
+	r.uint16()
+
+	var varbinds []agentxValue
+
+	for len(r.data) > 0 && r.err == nil {
+		v := agentxValue{Type: r.uint16()}
+		r.uint16()
+		v.OID, _ = r.oid()
+
+		switch v.Type {
+		case agentxInteger, agentxGauge32:
+			v.Value = uint64(r.uint32())
+		case agentxCounter64:
+			v.Value = r.uint64()
+		}
+
+		varbinds = append(varbinds, v)
+	}
+
+	assert.Nil(m.t, r.err)
+
+	return code, varbinds
+}
+
+func TestAgentX(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "smtpd_exporter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	l, err := net.Listen("unix", dir+"/master")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	root, err := parseOID("1.3.6.1.4.1.8072.9999.9999.25")
+	assert.Nil(err)
+
+	a := &AgentX{
+		Socket: dir + "/master",
+		Root:   root,
+		Stats:  fixedStat("scheduler.delivery.ok=42\nscheduler.envelope=5\nuptime=120\n"),
+		Status: fixedStat("MDA running\nMTA paused\n"),
+	}
+
+	done := make(chan error)
+
+	go func() {
+		done <- a.session()
+	}()
+
+	m := &agentxMaster{t: t}
+	m.accept(l)
+	assert.Equal(root, m.subtree)
+
+	name := func(sub ...uint32) oid {
+		return append(append(oid{}, root...), sub...)
+	}
+
+	// get
+	code, vb := m.request(agentxGet, func(w *agentxWriter) {
+		w.oid(name(1, 1, 0), false)
+		w.oid(nil, false)
+		w.oid(name(1, 2, 0), false)
+		w.oid(nil, false)
+		w.oid(name(3, 2, 0), false)
+		w.oid(nil, false)
+	})
+	assert.Equal(uint16(0), code)
+	assert.Equal([]agentxValue{
+		{OID: name(1, 1, 0), Type: agentxCounter64, Value: 42},
+		{OID: name(1, 2, 0), Type: agentxNoSuchObject},
+		{OID: name(3, 2, 0), Type: agentxInteger, Value: componentPaused},
+	}, vb)
+
+	// getnext skips missing stats
+	_, vb = m.request(agentxGetNext, func(w *agentxWriter) {
+		w.oid(name(1, 1, 0), false)
+		w.oid(nil, false)
+		w.oid(root, false)
+		w.oid(nil, false)
+	})
+	assert.Equal([]agentxValue{
+		{OID: name(1, 7, 0), Type: agentxGauge32, Value: 120},
+		{OID: name(1, 1, 0), Type: agentxCounter64, Value: 42},
+	}, vb)
+
+	// getbulk walks to the end of the subtree
+	_, vb = m.request(agentxGetBulk, func(w *agentxWriter) {
+		w.uint16(0)
+		w.uint16(10)
+		w.oid(name(2), false)
+		w.oid(name(3), false)
+	})
+	assert.Equal([]agentxValue{
+		{OID: name(2, 1, 0), Type: agentxGauge32, Value: 5},
+		{OID: name(2, 1, 0), Type: agentxEndOfMibView},
+	}, vb)
+
+	// nothing is writable
+	code, _ = m.request(agentxTestSet, func(w *agentxWriter) {})
+	assert.Equal(uint16(agentxNotWritable), code)
+
+	m.conn.Close()
+	assert.NotNil(<-done)
+}
+
+// TestAgentxLittleEndian decodes a pdu without network byte order, as masters
+// on x86 send them.
+func TestAgentxLittleEndian(t *testing.T) {
+	p := agentxPacket{Type: agentxGet, SessionID: 1, PacketID: 2, Payload: []byte{
+		// 1.3.6.1.4.1.1.0 with prefix 4
+		3, 4, 0, 0, 1, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0,
+	}}
+
+	data := p.bytes()
+	assert.Equal(t, []byte{1, agentxGet, 0, 0, 1, 0, 0, 0}, data[:8])
+
+	r := p.reader()
+	o, include := r.oid()
+	assert.Equal(t, oid{1, 3, 6, 1, 4, 1, 1, 0}, o)
+	assert.False(t, include)
+	assert.Nil(t, r.err)
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	log "github.com/sirupsen/logrus"
+)
+
+// backfill replays archived maillogs and writes the log derived metrics as
+// OpenMetrics with timestamps, ready for
+// `promtool tsdb create-blocks-from openmetrics`.
+func backfill(args []string) error {
+	fs := flag.NewFlagSet("backfill", flag.ExitOnError)
+	output := fs.String("output", "-", "OpenMetrics file to write or \"-\" for stdout.")
+	step := fs.Duration("step", 5*time.Minute, "interval between the written samples.")
+
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if fs.NArg() == 0 {
+		return errors.New("no log files given")
+	}
+
+	files, err := sortLogFiles(fs.Args())
+	if err != nil {
+		return err
+	}
+
+	reg := prometheus.NewRegistry()
+	b := newBackfiller(reg, NewCorrelator(reg, *logMaxMessages, *logMessageTTL), *step)
+
+	for _, f := range files {
+		log.WithFields(log.Fields{"file": f.name}).Info("replay log file")
+
+		if err := readLogFile(f, b); err != nil {
+			return err
+		}
+	}
+
+	if err := b.finish(); err != nil {
+		return err
+	}
+
+	w := os.Stdout
+
+	if *output != "-" {
+		w, err = os.Create(*output)
+		if err != nil {
+			return fmt.Errorf("could not create output file: %w", err)
+		}
+		defer w.Close()
+	}
+
+	return b.write(w)
+}
+
+// archive is an archived maillog. Its modification time is the reference for
+// the year of timestamps without one, as the last line got written then.
+type archive struct {
+	name    string
+	modTime time.Time
+	// rotation is N of maillog.N[.gz], 0 for the current log
+	rotation int
+}
+
+// sortLogFiles orders the files from oldest to newest, like maillog.2.gz,
+// maillog.1.gz, maillog. The rotation suffix decides, as copied or restored
+// files lose their modification times, the modification time only orders
+// files of the same rotation.
+func sortLogFiles(names []string) ([]archive, error) {
+	files := make([]archive, 0, len(names))
+
+	for _, name := range names {
+		fi, err := os.Stat(name)
+		if err != nil {
+			return nil, fmt.Errorf("could not stat log file: %w", err)
+		}
+
+		files = append(files, archive{name: name, modTime: fi.ModTime(), rotation: logRotation(name)})
+	}
+
+	sort.SliceStable(files, func(i, j int) bool {
+		if files[i].rotation != files[j].rotation {
+			return files[i].rotation > files[j].rotation
+		}
+
+		return files[i].modTime.Before(files[j].modTime)
+	})
+
+	return files, nil
+}
+
+// logRotation returns N of a rotated log like maillog.N or maillog.N.gz.
+func logRotation(name string) int {
+	name = strings.TrimSuffix(filepath.Base(name), ".gz")
+
+	i := strings.LastIndex(name, ".")
+	if i < 0 {
+		return 0
+	}
+
+	n, err := strconv.Atoi(name[i+1:])
+	if err != nil || n < 0 {
+		return 0
+	}
+
+	return n
+}
+
+// readLogFile parses every line of a plain or gzipped log file.
+func readLogFile(f archive, h EventHandler) error {
+	file, err := os.Open(f.name)
+	if err != nil {
+		return fmt.Errorf("could not open log file: %w", err)
+	}
+	defer file.Close()
+
+	br := bufio.NewReader(file)
+
+	var r io.Reader = br
+
+	// gzip files start with 0x1f 0x8b
+	if magic, err := br.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b { //nolint:gomnd
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return fmt.Errorf("could not read gzipped log file: %w", err)
+		}
+		defer gz.Close()
+
+		r = gz
+	}
+
+	s := bufio.NewScanner(r)
+	s.Buffer(make([]byte, 0, maxSyslogSize), maxSyslogSize)
+
+	for s.Scan() {
+		ev, err := parseLogLine(s.Text(), f.modTime)
+		if err != nil {
+			continue
+		}
+
+		h.Handle(ev)
+	}
+
+	if err := s.Err(); err != nil {
+		return fmt.Errorf("could not read log file %s: %w", f.name, err)
+	}
+
+	return nil
+}
+
+// backfiller passes log events on and snapshots the registry every step of
+// log time.
+type backfiller struct {
+	gatherer prometheus.Gatherer
+	handler  EventHandler
+	step     time.Duration
+	next     time.Time
+	err      error
+	families map[string]*dto.MetricFamily
+}
+
+func newBackfiller(g prometheus.Gatherer, h EventHandler, step time.Duration) *backfiller {
+	return &backfiller{
+		gatherer: g,
+		handler:  h,
+		step:     step,
+		families: map[string]*dto.MetricFamily{},
+	}
+}
+
+// Handle snapshots all steps before the event and passes it on.
+func (b *backfiller) Handle(ev *LogEvent) {
+	if b.err != nil {
+		return
+	}
+
+	if b.next.IsZero() {
+		b.next = ev.Time.Truncate(b.step)
+	}
+
+	for b.next.Before(ev.Time) {
+		if err := b.snapshot(b.next); err != nil {
+			b.err = err
+			return
+		}
+
+		b.next = b.next.Add(b.step)
+	}
+
+	b.handler.Handle(ev)
+}
+
+// finish takes the last snapshot after all events.
+func (b *backfiller) finish() error {
+	if b.err != nil || b.next.IsZero() {
+		return b.err
+	}
+
+	return b.snapshot(b.next)
+}
+
+// snapshot stores the current metric values with the timestamp.
+func (b *backfiller) snapshot(t time.Time) error {
+	mfs, err := b.gatherer.Gather()
+	if err != nil {
+		return fmt.Errorf("could not gather metrics: %w", err)
+	}
+
+	ts := t.UnixNano() / int64(time.Millisecond)
+
+	for _, mf := range mfs {
+		fam, ok := b.families[mf.GetName()]
+		if !ok {
+			fam = &dto.MetricFamily{Name: mf.Name, Help: mf.Help, Type: mf.Type}
+			b.families[mf.GetName()] = fam
+		}
+
+		for _, m := range mf.Metric {
+			m.TimestampMs = &ts
+			fam.Metric = append(fam.Metric, m)
+		}
+	}
+
+	return nil
+}
+
+// write encodes the families with the samples of every series kept together
+// and ordered by time, as OpenMetrics requires.
+func (b *backfiller) write(w io.Writer) error {
+	names := make([]string, 0, len(b.families))
+	for name := range b.families {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	for _, name := range names {
+		fam := b.families[name]
+
+		sort.SliceStable(fam.Metric, func(i, j int) bool {
+			return labelKey(fam.Metric[i]) < labelKey(fam.Metric[j])
+		})
+
+		if _, err := expfmt.MetricFamilyToOpenMetrics(w, fam); err != nil {
+			return fmt.Errorf("could not write metrics: %w", err)
+		}
+	}
+
+	_, err := expfmt.FinalizeOpenMetrics(w)
+
+	return err
+}
+
+// labelKey identifies the series of a metric.
+func labelKey(m *dto.Metric) string {
+	pairs := make([]string, 0, len(m.Label))
+	for _, l := range m.Label {
+		pairs = append(pairs, l.GetName()+"="+l.GetValue())
+	}
+
+	return strings.Join(pairs, ",")
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+)
+
+// writeLog writes a log file, gzipped if the name ends with .gz, with the
+// given modification time.
+func writeLog(t *testing.T, path, content string, modTime time.Time) {
+	var buf bytes.Buffer
+
+	if strings.HasSuffix(path, ".gz") {
+		gz := gzip.NewWriter(&buf)
+		if _, err := gz.Write([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+
+		gz.Close()
+	} else {
+		buf.WriteString(content)
+	}
+
+	if err := ioutil.WriteFile(path, buf.Bytes(), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBackfill(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "smtpd_exporter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// the message got accepted in the old year, in the rotated file, and
+	// delivered in the new one
+	writeLog(t, filepath.Join(dir, "maillog"),
+		"Jan  1 00:05:00 mx smtpd[1]: 0000000000000002 mta delivery evpid=a1b2c3d400000001 result=\"Ok\"\n",
+		time.Date(2020, time.January, 1, 1, 0, 0, 0, time.Local))
+	writeLog(t, filepath.Join(dir, "maillog.1.gz"),
+		"Dec 31 23:50:00 mx smtpd[1]: 0000000000000001 smtp message msgid=a1b2c3d4 nrcpt=1\n",
+		time.Date(2020, time.January, 1, 0, 0, 0, 0, time.Local))
+
+	files, err := sortLogFiles([]string{filepath.Join(dir, "maillog"), filepath.Join(dir, "maillog.1.gz")})
+	assert.Nil(err)
+	assert.Equal(filepath.Join(dir, "maillog.1.gz"), files[0].name)
+
+	reg := prometheus.NewRegistry()
+	b := newBackfiller(reg, NewCorrelator(reg, 100, time.Hour), 5*time.Minute) //nolint:gomnd
+
+	for _, f := range files {
+		assert.Nil(readLogFile(f, b))
+	}
+
+	assert.Nil(b.finish())
+
+	var out bytes.Buffer
+	assert.Nil(b.write(&out))
+
+	accepted := time.Date(2019, time.December, 31, 23, 50, 0, 0, time.Local).Unix()
+	delivered := time.Date(2020, time.January, 1, 0, 5, 0, 0, time.Local).Unix()
+
+	var counts []string
+
+	for _, line := range strings.Split(out.String(), "\n") {
+		if strings.HasPrefix(line, "smtpd_message_end_to_end_seconds_count{action=\"\",listener=\"\"} ") {
+			counts = append(counts, line)
+		}
+	}
+
+	// a sample every five minutes from accepting till delivering
+	assert.Len(counts, 4) //nolint:gomnd
+	assert.True(strings.HasPrefix(counts[0], "smtpd_message_end_to_end_seconds_count{action=\"\",listener=\"\"} 0 "+formatUnix(accepted)))
+	assert.True(strings.HasPrefix(counts[3], "smtpd_message_end_to_end_seconds_count{action=\"\",listener=\"\"} 1 "+formatUnix(delivered)))
+	assert.Contains(out.String(), "# TYPE smtpd_message_end_to_end_seconds histogram\n")
+	assert.Contains(out.String(), "smtpd_message_end_to_end_seconds_sum{action=\"\",listener=\"\"} 900.0 "+formatUnix(delivered))
+	assert.True(strings.HasSuffix(out.String(), "# EOF\n"))
+}
+
+func TestSortLogFiles(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "smtpd_exporter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// restored from a backup, the newest files got written first
+	restored := time.Date(2020, time.March, 1, 0, 0, 0, 0, time.Local)
+	names := []string{"maillog", "maillog.1.gz", "maillog.2.gz", "maillog.10"}
+
+	for i, name := range names {
+		writeLog(t, filepath.Join(dir, name), "", restored.Add(time.Duration(i)*time.Minute))
+	}
+
+	files, err := sortLogFiles([]string{
+		filepath.Join(dir, "maillog.1.gz"), filepath.Join(dir, "maillog"),
+		filepath.Join(dir, "maillog.10"), filepath.Join(dir, "maillog.2.gz"),
+	})
+	assert.Nil(err)
+
+	var sorted []string
+	for _, f := range files {
+		sorted = append(sorted, filepath.Base(f.name))
+	}
+
+	assert.Equal([]string{"maillog.10", "maillog.2.gz", "maillog.1.gz", "maillog"}, sorted)
+}
+
+// formatUnix formats a timestamp like the OpenMetrics encoder.
+func formatUnix(ts int64) string {
+	return strconv.FormatFloat(float64(ts), 'g', -1, 64)
+}
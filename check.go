@@ -0,0 +1,320 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// checkStatus is the state of a check with its plugin exit code.
+type checkStatus int
+
+const (
+	checkOK checkStatus = iota
+	checkWarning
+	checkCritical
+	checkUnknown
+)
+
+func (s checkStatus) String() string {
+	return [...]string{"OK", "WARNING", "CRITICAL", "UNKNOWN"}[s]
+}
+
+// threshold holds warning and critical limits, a zero limit is not checked.
+type threshold struct {
+	Warning  float64
+	Critical float64
+}
+
+func (t threshold) status(v float64) checkStatus {
+	switch {
+	case t.Critical > 0 && v >= t.Critical:
+		return checkCritical
+	case t.Warning > 0 && v >= t.Warning:
+		return checkWarning
+	}
+
+	return checkOK
+}
+
+// perfdata formats a Nagios performance value with the limits.
+func (t threshold) perfdata(label string, v float64, unit string) string {
+	limit := func(f float64) string {
+		if f == 0 {
+			return ""
+		}
+
+		return strconv.FormatFloat(f, 'f', -1, 64)
+	}
+
+	return fmt.Sprintf("%s=%s%s;%s;%s;0", label, strconv.FormatFloat(v, 'f', -1, 64), unit,
+		limit(t.Warning), limit(t.Critical))
+}
+
+// checkState is kept between runs for the tempfail rate.
+type checkState struct {
+	Time     time.Time `json:"time"`
+	Tempfail int       `json:"tempfail"`
+}
+
+// CheckResult is the outcome of a check.
+type CheckResult struct {
+	Status   checkStatus
+	Messages []string
+	Perfdata []string
+}
+
+func (r *CheckResult) add(s checkStatus, msg string) {
+	if s > r.Status {
+		r.Status = s
+	}
+
+	if s != checkOK {
+		msg = fmt.Sprintf("%s (%s)", msg, s)
+	}
+
+	r.Messages = append(r.Messages, msg)
+}
+
+// String formats the result as plugin output.
+func (r *CheckResult) String() string {
+	out := "SMTPD " + r.Status.String() + " - " + strings.Join(r.Messages, ", ")
+	if len(r.Perfdata) > 0 {
+		out += " | " + strings.Join(r.Perfdata, " ")
+	}
+
+	return out
+}
+
+// Checker evaluates the stats, queue and status of smtpd against thresholds.
+type Checker struct {
+	Stats Stat
+	// Queue prints `smtpctl show queue` output.
+	Queue Stat
+	// Status prints `smtpctl show status` output.
+	Status Stat
+	// StateFile keeps the tempfails of the last run, without it the
+	// tempfail rate is not checked.
+	StateFile string
+
+	QueueSize threshold
+	// QueueAge is the age of the oldest envelope in seconds.
+	QueueAge threshold
+	// TempfailRate is in tempfails per minute.
+	TempfailRate threshold
+	// Paused is the status of a paused component.
+	Paused checkStatus
+}
+
+// Check collects once and evaluates the thresholds. Failed collections are
+// unknown.
+func (c *Checker) Check(now time.Time) *CheckResult {
+	r := &CheckResult{}
+
+	unknown := func(err error) *CheckResult {
+		return &CheckResult{Status: checkUnknown, Messages: []string{err.Error()}}
+	}
+
+	stats, err := c.Stats.Now()
+	if err != nil {
+		return unknown(fmt.Errorf("could not get stats: %w", err))
+	}
+
+	queue, err := c.Queue.Now()
+	if err != nil {
+		return unknown(fmt.Errorf("could not get queue: %w", err))
+	}
+
+	status, err := c.Status.Now()
+	if err != nil {
+		return unknown(fmt.Errorf("could not get status: %w", err))
+	}
+
+	size, oldest := parseQueue(queue)
+
+	var age float64
+	if !oldest.IsZero() && now.After(oldest) {
+		age = now.Sub(oldest).Truncate(time.Second).Seconds()
+	}
+
+	r.add(c.QueueSize.status(float64(size)), fmt.Sprintf("%d envelopes in queue", size))
+	r.Perfdata = append(r.Perfdata, c.QueueSize.perfdata("queue", float64(size), ""))
+
+	if size > 0 {
+		r.add(c.QueueAge.status(age), fmt.Sprintf("oldest %s", time.Duration(age)*time.Second))
+	}
+
+	r.Perfdata = append(r.Perfdata, c.QueueAge.perfdata("oldest_age", age, "s"))
+
+	paused := pausedComponents(status)
+	if len(paused) > 0 {
+		r.add(c.Paused, strings.Join(paused, ", ")+" paused")
+	}
+
+	r.Perfdata = append(r.Perfdata, fmt.Sprintf("paused=%d;;;0", len(paused)))
+
+	// missing tempfails count as none
+	tempfail, _ := (&Metric{Regex: `scheduler.delivery.tempfail=(\d+)`}).value(stats)
+
+	if c.StateFile != "" {
+		if err := c.checkTempfail(r, now, tempfail); err != nil {
+			return unknown(err)
+		}
+	}
+
+	for _, m := range metrics {
+		if v, err := m.value(stats); err == nil {
+			r.Perfdata = append(r.Perfdata, fmt.Sprintf("%s=%dc", strings.TrimPrefix(m.Name, "smtpd_"), v))
+		}
+	}
+
+	return r
+}
+
+// checkTempfail compares the tempfails with the ones of the last run and
+// keeps them for the next.
+func (c *Checker) checkTempfail(r *CheckResult, now time.Time, tempfail int) error {
+	var last checkState
+
+	data, err := ioutil.ReadFile(c.StateFile)
+
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+	case err != nil:
+		return fmt.Errorf("could not read state file: %w", err)
+	default:
+		if err := json.Unmarshal(data, &last); err != nil {
+			return fmt.Errorf("could not parse state file: %w", err)
+		}
+	}
+
+	data, err = json.Marshal(checkState{Time: now, Tempfail: tempfail})
+	if err != nil {
+		return err
+	}
+
+	if err := writeFileAtomic(c.StateFile, data, 0o600); err != nil {
+		return fmt.Errorf("could not write state file: %w", err)
+	}
+
+	if last.Time.IsZero() || !now.After(last.Time) {
+		r.Messages = append(r.Messages, "no tempfail rate before the next run")
+		return nil
+	}
+
+	// fewer tempfails than last time means smtpd restarted
+	increase := tempfail - last.Tempfail
+	if increase < 0 {
+		increase = tempfail
+	}
+
+	rate := float64(increase) / now.Sub(last.Time).Minutes()
+	rate = math.Round(rate*100) / 100 // nolint:gomnd
+
+	r.add(c.TempfailRate.status(rate), fmt.Sprintf("%s tempfails/min", strconv.FormatFloat(rate, 'f', -1, 64)))
+	r.Perfdata = append(r.Perfdata, c.TempfailRate.perfdata("tempfail_rate", rate, ""))
+
+	return nil
+}
+
+// parseQueue counts the envelopes of `smtpctl show queue` output and finds
+// the oldest creation time. Its lines are `|` separated with the creation
+// time as unix timestamp in the eighth field.
+func parseQueue(out string) (int, time.Time) {
+	var (
+		size   int
+		oldest time.Time
+	)
+
+	scanner := bufio.NewScanner(strings.NewReader(out))
+	for scanner.Scan() {
+		fields := strings.Split(strings.TrimSpace(scanner.Text()), "|")
+		if len(fields) < 8 { // nolint:gomnd
+			continue
+		}
+
+		size++
+
+		created, err := strconv.ParseInt(fields[7], 10, 64)
+		if err != nil {
+			continue
+		}
+
+		if t := time.Unix(created, 0); oldest.IsZero() || t.Before(oldest) {
+			oldest = t
+		}
+	}
+
+	return size, oldest
+}
+
+// pausedComponents returns the components `smtpctl show status` reports as
+// paused, like MTA out of "MTA paused".
+func pausedComponents(out string) []string {
+	var paused []string
+
+	scanner := bufio.NewScanner(strings.NewReader(out))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && fields[1] == "paused" {
+			paused = append(paused, fields[0])
+		}
+	}
+
+	return paused
+}
+
+// check runs the check subcommand, prints the plugin output and returns the
+// exit code.
+func check(args []string, w io.Writer) int {
+	fs := flag.NewFlagSet("check", flag.ContinueOnError)
+	smtpctlPath := fs.String("smtpctl", "smtpctl", "smtpctl command to get stats, queue and status with.")
+	stateFile := fs.String("state", "", "file keeping the tempfails between runs, needed for the tempfail rate.")
+	queueWarning := fs.Int("queue.warning", 0, "envelopes in queue to warn at, 0 disables.")
+	queueCritical := fs.Int("queue.critical", 0, "envelopes in queue to be critical at, 0 disables.")
+	ageWarning := fs.Duration("age.warning", 0, "age of the oldest envelope to warn at, 0 disables.")
+	ageCritical := fs.Duration("age.critical", 0, "age of the oldest envelope to be critical at, 0 disables.")
+	tempfailWarning := fs.Float64("tempfail.warning", 0, "tempfails per minute to warn at, 0 disables.")
+	tempfailCritical := fs.Float64("tempfail.critical", 0, "tempfails per minute to be critical at, 0 disables.")
+	paused := fs.String("paused", "critical", "status of a paused component: ok, warning or critical.")
+
+	if err := fs.Parse(args); err != nil {
+		return int(checkUnknown)
+	}
+
+	c := &Checker{
+		Stats:        commandStat{args: []string{*smtpctlPath, "show", "stats"}},
+		Queue:        commandStat{args: []string{*smtpctlPath, "show", "queue"}},
+		Status:       commandStat{args: []string{*smtpctlPath, "show", "status"}},
+		StateFile:    *stateFile,
+		QueueSize:    threshold{float64(*queueWarning), float64(*queueCritical)},
+		QueueAge:     threshold{ageWarning.Seconds(), ageCritical.Seconds()},
+		TempfailRate: threshold{*tempfailWarning, *tempfailCritical},
+	}
+
+	switch *paused {
+	case "ok":
+		c.Paused = checkOK
+	case "warning":
+		c.Paused = checkWarning
+	case "critical":
+		c.Paused = checkCritical
+	default:
+		fmt.Fprintf(w, "SMTPD UNKNOWN - invalid paused status: %s\n", *paused)
+		return int(checkUnknown)
+	}
+
+	r := c.Check(time.Now())
+	fmt.Fprintln(w, r.String())
+
+	return int(r.Status)
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fixedStat returns the same output every time.
+type fixedStat string
+
+func (s fixedStat) Now() (string, error) {
+	return string(s), nil
+}
+
+const testQueue = `1a2b3c4d5e6f7a8b|inet4|mta|auth|alice@example.org|bob@example.com|bob@example.com|1577829600|1578434400|1577836500|12|pending|0|
+2a2b3c4d5e6f7a8b|local|mda||root@mx1|carol@mx1|carol@mx1|1577836740|1578441540|0|0|pending|0|
+`
+
+func TestChecker(t *testing.T) {
+	failing := new(MockStat)
+	failing.On("Now").Return("", errors.New("smtpctl failed"))
+
+	now := time.Unix(1577836800, 0)
+
+	tests := []struct {
+		name    string
+		checker Checker
+		status  checkStatus
+		output  string
+	}{
+		{
+			"ok",
+			Checker{
+				Stats:     fixedStat("scheduler.delivery.ok=42\n"),
+				Queue:     fixedStat(""),
+				Status:    fixedStat("MDA running\nMTA running\nSMTP running\n"),
+				QueueSize: threshold{10, 20},
+			},
+			checkOK,
+			"SMTPD OK - 0 envelopes in queue | queue=0;10;20;0 oldest_age=0s;;;0 paused=0;;;0 delivery_ok=42c",
+		},
+		{
+			"old envelope",
+			Checker{
+				Stats:    fixedStat(""),
+				Queue:    fixedStat(testQueue),
+				Status:   fixedStat(""),
+				QueueAge: threshold{3600, 86400},
+			},
+			checkWarning,
+			"SMTPD WARNING - 2 envelopes in queue, oldest 2h0m0s (WARNING) | queue=2;;;0 oldest_age=7200s;3600;86400;0 paused=0;;;0",
+		},
+		{
+			"paused",
+			Checker{
+				Stats:  fixedStat(""),
+				Queue:  fixedStat(""),
+				Status: fixedStat("MDA running\nMTA paused\nSMTP paused\n"),
+				Paused: checkCritical,
+			},
+			checkCritical,
+			"SMTPD CRITICAL - 0 envelopes in queue, MTA, SMTP paused (CRITICAL) | queue=0;;;0 oldest_age=0s;;;0 paused=2;;;0",
+		},
+		{
+			"unknown",
+			Checker{
+				Stats: failing,
+			},
+			checkUnknown,
+			"SMTPD UNKNOWN - could not get stats: smtpctl failed",
+		},
+	}
+
+	for _, test := range tests {
+		r := test.checker.Check(now)
+		assert.Equal(t, test.status, r.Status, test.name)
+		assert.Equal(t, test.output, r.String(), test.name)
+	}
+}
+
+func TestCheckerTempfailRate(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "smtpd_exporter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c := Checker{
+		Queue:        fixedStat(""),
+		Status:       fixedStat(""),
+		StateFile:    dir + "/state",
+		TempfailRate: threshold{5, 10},
+	}
+
+	now := time.Unix(1577836800, 0)
+
+	// the first run only keeps the state
+	c.Stats = fixedStat("scheduler.delivery.tempfail=10\n")
+	r := c.Check(now)
+	assert.Equal(checkOK, r.Status)
+	assert.Contains(r.String(), "no tempfail rate before the next run")
+
+	c.Stats = fixedStat("scheduler.delivery.tempfail=40\n")
+	r = c.Check(now.Add(5 * time.Minute))
+	assert.Equal(checkWarning, r.Status)
+	assert.Contains(r.String(), "6 tempfails/min (WARNING)")
+	assert.Contains(r.String(), "tempfail_rate=6;5;10;0")
+
+	// smtpd restarted
+	c.Stats = fixedStat("scheduler.delivery.tempfail=3\n")
+	r = c.Check(now.Add(6 * time.Minute))
+	assert.Equal(checkOK, r.Status)
+	assert.Contains(r.String(), "3 tempfails/min")
+}
+
+func TestCheckFlags(t *testing.T) {
+	var buf bytes.Buffer
+
+	assert.Equal(t, int(checkUnknown), check([]string{"-paused", "maybe"}, &buf))
+	assert.Equal(t, "SMTPD UNKNOWN - invalid paused status: maybe\n", buf.String())
+}
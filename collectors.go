@@ -0,0 +1,283 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+// collectJob collects the stats of an instance, or of the source given by
+// flag for the empty instance name.
+type collectJob struct {
+	instance string
+	source   string
+	stats    Stat
+	interval time.Duration
+	metrics  []*Metric
+}
+
+// Collectors runs the collect loops of the instances of the config, or of the
+// source given by flag without instances, and collects their metrics. Applying
+// a changed config swaps the loops and all metrics at once, the metrics of
+// unchanged instances keep counting.
+type Collectors struct {
+	API      *StatsAPI
+	Emitters []Emitter
+
+	mux     sync.Mutex
+	stats   Stat
+	metrics map[string]*Metric
+	cancel  context.CancelFunc
+	done    sync.WaitGroup
+
+	current struct {
+		sync.RWMutex
+		metrics []*Metric
+	}
+}
+
+// NewCollectors creates collectors recording to api and sending every
+// collection to the emitters.
+func NewCollectors(api *StatsAPI, emitters []Emitter) *Collectors {
+	return &Collectors{API: api, Emitters: emitters, metrics: map[string]*Metric{}}
+}
+
+// Describe sends no descriptions, the metrics change with the config.
+func (c *Collectors) Describe(ch chan<- *prometheus.Desc) {}
+
+// Collect implements prometheus.Collector.
+func (c *Collectors) Collect(ch chan<- prometheus.Metric) {
+	c.current.RLock()
+	defer c.current.RUnlock()
+
+	for _, m := range c.current.metrics {
+		m.mux.Lock()
+		m.Counter.Collect(ch)
+		m.mux.Unlock()
+	}
+}
+
+// Apply stops the running loops and starts the ones of config.
+func (c *Collectors) Apply(config *Config) error {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	jobs, err := c.jobs(config)
+	if err != nil {
+		return err
+	}
+
+	c.stop()
+	c.swap(jobs)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	c.cancel = cancel
+
+	for _, j := range jobs {
+		c.done.Add(1)
+
+		go func(j collectJob) {
+			defer c.done.Done()
+			collect(ctx, j.metrics, c.API.Stat(j.instance, j.source, j.stats), j.interval, c.Emitters)
+		}(j)
+	}
+
+	return nil
+}
+
+// Check returns the error Apply would fail with for config, the running
+// loops stay as they are.
+func (c *Collectors) Check(config *Config) error {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	_, err := c.jobs(config)
+
+	return err
+}
+
+// Once collects the instances of config a single time and returns the first
+// error.
+func (c *Collectors) Once(config *Config) error {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	jobs, err := c.jobs(config)
+	if err != nil {
+		return err
+	}
+
+	c.stop()
+	c.swap(jobs)
+
+	var errs []error
+
+	for _, j := range jobs {
+		// a single snapshot piped in by cron is complete at the end
+		if r, ok := j.stats.(*readerStat); ok {
+			r.Wait()
+		}
+
+		if err := collectAndEmit(j.metrics, c.API.Stat(j.instance, j.source, j.stats), c.Emitters); err != nil {
+			log.Error(err)
+			errs = append(errs, err)
+		}
+	}
+
+	if len(errs) > 0 {
+		return errs[0]
+	}
+
+	return nil
+}
+
+// Stop stops the loops after their running collections.
+func (c *Collectors) Stop() {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	c.stop()
+}
+
+func (c *Collectors) stop() {
+	if c.cancel == nil {
+		return
+	}
+
+	c.cancel()
+	c.done.Wait()
+	c.cancel = nil
+}
+
+// jobs returns the collect jobs of config, reusing the metrics of the running
+// jobs that stay the same.
+func (c *Collectors) jobs(config *Config) ([]collectJob, error) {
+	defs := metricConfigs(config)
+
+	if config == nil || len(config.Instances) == 0 {
+		stats, err := c.flagStat()
+		if err != nil {
+			return nil, err
+		}
+
+		m := make([]*Metric, 0, len(defs))
+		for _, d := range defs {
+			m = append(m, c.reuse(d.metric(nil)))
+		}
+
+		return []collectJob{{source: *source, stats: stats, interval: *interval, metrics: m}}, nil
+	}
+
+	jobs := make([]collectJob, 0, len(config.Instances))
+
+	for _, i := range config.Instances {
+		d := i.Interval
+		if d == 0 {
+			d = *interval
+		}
+
+		m := i.Metrics(defs)
+		for j := range m {
+			m[j] = c.reuse(m[j])
+		}
+
+		jobs = append(jobs, collectJob{instance: i.Name, source: i.Source(), stats: i.Stat(), interval: d, metrics: m})
+	}
+
+	return jobs, nil
+}
+
+// flagStat returns the source given by flag. It gets created once as stdin
+// can only be read once.
+func (c *Collectors) flagStat() (Stat, error) {
+	if c.stats != nil {
+		return c.stats, nil
+	}
+
+	if *source == "stdin" && *logJournald == "-" {
+		return nil, errors.New("stats and journal can not both be read from stdin")
+	}
+
+	stats, err := newStat(*source, *sourcePath)
+	if err != nil {
+		return nil, err
+	}
+
+	c.stats = stats
+
+	return stats, nil
+}
+
+// reuse returns the running metric of the same definition if there is one.
+func (c *Collectors) reuse(m *Metric) *Metric {
+	if running, ok := c.metrics[metricKey(m)]; ok {
+		return running
+	}
+
+	return m
+}
+
+// swap registers the metrics of the jobs and replaces the collected ones.
+// The stats of instances without a job get dropped from the api.
+func (c *Collectors) swap(jobs []collectJob) {
+	// the counters only get registered to find conflicts and for calcAddVal,
+	// they are collected through c
+	reg := prometheus.NewRegistry()
+	i := initer{}
+	keep := map[string]*Metric{}
+	instances := map[string]bool{}
+
+	var all []*Metric
+
+	for _, j := range jobs {
+		instances[j.instance] = true
+
+		for _, m := range j.metrics {
+			m.mux.Lock()
+			m.Registerer = reg
+
+			if m.Counter == nil {
+				i.Metric(m)
+			} else {
+				reg.MustRegister(m.Counter)
+			}
+			m.mux.Unlock()
+
+			keep[metricKey(m)] = m
+			all = append(all, m)
+		}
+	}
+
+	log.WithFields(log.Fields{"metrics": len(all), "jobs": len(jobs)}).Debug("swapping collectors")
+
+	c.current.Lock()
+	c.current.metrics = all
+	c.current.Unlock()
+
+	c.metrics = keep
+
+	c.API.Retain(instances)
+}
+
+// metricKey identifies the definition of a metric of an instance, a change
+// of its help or labels makes it a new one.
+func metricKey(m *Metric) string {
+	names := make([]string, 0, len(m.Labels))
+	for name := range m.Labels {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	key := m.Name + "\x00" + m.Help + "\x00" + m.Regex
+	for _, name := range names {
+		key += "\x00" + name + "=" + m.Labels[name]
+	}
+
+	return key
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+)
+
+// deliveries returns the smtpd_delivery_ok counters of the instances.
+func deliveries(t *testing.T, g prometheus.Gatherer) map[string]float64 {
+	mfs, err := g.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := map[string]float64{}
+
+	for _, mf := range mfs {
+		if mf.GetName() != "smtpd_delivery_ok" {
+			continue
+		}
+
+		for _, m := range mf.GetMetric() {
+			for _, l := range m.GetLabel() {
+				if l.GetName() == "instance_name" {
+					d[l.GetValue()] = m.GetCounter().GetValue()
+				}
+			}
+		}
+	}
+
+	return d
+}
+
+func TestCollectorsSwap(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "collectors")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	write := func(name, stats string) string {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte(stats), 0o600); err != nil {
+			t.Fatal(err)
+		}
+
+		return path
+	}
+
+	mx := write("mx", "scheduler.delivery.ok=10\n")
+	submission := write("submission", "scheduler.delivery.ok=3\n")
+
+	api := NewStatsAPI()
+	c := NewCollectors(api, nil)
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(c)
+
+	assert.Nil(c.Once(&Config{Instances: []*Instance{{Name: "mx", File: mx}}}))
+	assert.Equal(map[string]float64{"mx": 10}, deliveries(t, reg))
+
+	write("mx", "scheduler.delivery.ok=15\n")
+
+	// mx keeps counting, submission starts
+	assert.Nil(c.Once(&Config{Instances: []*Instance{{Name: "mx", File: mx}, {Name: "submission", File: submission}}}))
+	assert.Equal(map[string]float64{"mx": 15, "submission": 3}, deliveries(t, reg))
+
+	assert.Nil(c.Once(&Config{Instances: []*Instance{{Name: "submission", File: submission}}}))
+	assert.Equal(map[string]float64{"submission": 3}, deliveries(t, reg))
+
+	// the api forgets the removed instance too
+	_, ok := api.Last("mx")
+	assert.False(ok)
+	assert.Len(api.Stats(), 1)
+
+	// a removed instance that comes back starts over
+	assert.Nil(c.Once(&Config{Instances: []*Instance{{Name: "mx", File: mx}}}))
+	assert.Equal(map[string]float64{"mx": 15}, deliveries(t, reg))
+}
+
+func TestCollectorsApply(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "collectors")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "mx")
+	if err := ioutil.WriteFile(path, []byte("scheduler.delivery.ok=7\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	api := NewStatsAPI()
+	c := NewCollectors(api, nil)
+
+	assert.Nil(c.Apply(&Config{Instances: []*Instance{{Name: "mx", File: path, Interval: time.Hour}}}))
+
+	for i := 0; i < 100; i++ {
+		if _, ok := api.Last("mx"); ok {
+			break
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	stats, ok := api.Last("mx")
+	assert.True(ok)
+	assert.Equal(int64(7), stats["scheduler.delivery.ok"])
+
+	done := make(chan struct{})
+
+	go func() {
+		c.Stop()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Error("collect loop did not stop")
+	}
+}
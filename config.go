@@ -0,0 +1,198 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+	yaml "gopkg.in/yaml.v2"
+)
+
+const (
+	// defaultModuleTimeout is used for modules without a timeout.
+	defaultModuleTimeout = 10 * time.Second
+	// defaultModuleHelo is sent by smtp modules without a helo, like the
+	// -probe.helo default.
+	defaultModuleHelo = "localhost"
+)
+
+// Config is the exporter config file.
+type Config struct {
+	Instances []*Instance        `yaml:"instances"`
+	Modules   map[string]*Module `yaml:"modules"`
+	// Metrics are the counters read from the stats, the built-in ones if
+	// empty.
+	Metrics []*MetricConfig `yaml:"metrics"`
+}
+
+// MetricConfig defines a counter read from `smtpctl show stats` output. The
+// regex captures the value in its only group.
+type MetricConfig struct {
+	Name   string            `yaml:"name"`
+	Help   string            `yaml:"help"`
+	Regex  string            `yaml:"regex"`
+	Labels map[string]string `yaml:"labels"`
+}
+
+// Module configures a probe of the /probe endpoint.
+type Module struct {
+	Prober  string        `yaml:"prober"`
+	Timeout time.Duration `yaml:"timeout"`
+	SMTP    SMTPModule    `yaml:"smtp"`
+	Command CommandModule `yaml:"command"`
+	File    FileModule    `yaml:"file"`
+}
+
+// SMTPModule configures the SMTP handshake prober.
+type SMTPModule struct {
+	TLS         string `yaml:"tls"`
+	Helo        string `yaml:"helo"`
+	InsecureTLS bool   `yaml:"insecure_tls"`
+}
+
+// CommandModule configures a command printing `smtpctl show stats` output of
+// the target, like `ssh {target} smtpctl show stats`.
+type CommandModule struct {
+	Args []string `yaml:"args"`
+}
+
+// FileModule configures fetching a file with `smtpctl show stats` output of
+// the target from an URL or path, like `http://{target}/smtpd-stats.txt`.
+type FileModule struct {
+	URL string `yaml:"url"`
+}
+
+// LoadConfig reads and validates the config file.
+func LoadConfig(path string) (*Config, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read config: %w", err)
+	}
+
+	c := &Config{}
+	if err := yaml.UnmarshalStrict(b, c); err != nil {
+		return nil, fmt.Errorf("could not parse config: %w", err)
+	}
+
+	if err := checkInstances(c.Instances); err != nil {
+		return nil, err
+	}
+
+	if len(c.Metrics) == 0 {
+		c.Metrics = defaultMetrics()
+	}
+
+	if err := checkMetrics(c.Metrics); err != nil {
+		return nil, err
+	}
+
+	for name, m := range c.Modules {
+		if m.Timeout == 0 {
+			m.Timeout = defaultModuleTimeout
+		}
+
+		switch m.Prober {
+		case "smtp":
+			if m.SMTP.Helo == "" {
+				m.SMTP.Helo = defaultModuleHelo
+			}
+
+			if m.SMTP.TLS != tlsNone && m.SMTP.TLS != tlsStartTLS && m.SMTP.TLS != tlsSMTPS {
+				return nil, fmt.Errorf("module %s: invalid tls mode: %s", name, m.SMTP.TLS)
+			}
+		case "command":
+			if len(m.Command.Args) == 0 {
+				return nil, fmt.Errorf("module %s: missing command args", name)
+			}
+		case "file":
+			if m.File.URL == "" {
+				return nil, fmt.Errorf("module %s: missing file url", name)
+			}
+		default:
+			return nil, fmt.Errorf("module %s: unknown prober: %s", name, m.Prober)
+		}
+	}
+
+	return c, nil
+}
+
+// defaultMetrics returns the built-in metric definitions.
+func defaultMetrics() []*MetricConfig {
+	defs := make([]*MetricConfig, 0, len(metrics))
+	for _, m := range metrics {
+		defs = append(defs, &MetricConfig{Name: m.Name, Help: m.Help, Regex: m.Regex})
+	}
+
+	return defs
+}
+
+// metricConfigs returns the metric definitions of config, the built-in ones
+// without a config.
+func metricConfigs(config *Config) []*MetricConfig {
+	if config == nil || len(config.Metrics) == 0 {
+		return defaultMetrics()
+	}
+
+	return config.Metrics
+}
+
+// checkMetrics validates the metric definitions of the config.
+func checkMetrics(defs []*MetricConfig) error {
+	names := map[string]bool{}
+
+	for _, d := range defs {
+		if !model.IsValidMetricName(model.LabelValue(d.Name)) {
+			return fmt.Errorf("invalid metric name: %q", d.Name)
+		}
+
+		if names[d.Name] {
+			return fmt.Errorf("metric %s: duplicate name", d.Name)
+		}
+
+		names[d.Name] = true
+
+		if d.Help == "" {
+			return fmt.Errorf("metric %s: missing help", d.Name)
+		}
+
+		re, err := regexp.Compile(d.Regex)
+		if err != nil {
+			return fmt.Errorf("metric %s: invalid regex: %w", d.Name, err)
+		}
+
+		if re.NumSubexp() != 1 {
+			return fmt.Errorf("metric %s: regex needs exactly one group", d.Name)
+		}
+
+		for name := range d.Labels {
+			if !model.LabelName(name).IsValid() || name == "instance_name" {
+				return fmt.Errorf("metric %s: invalid label name: %q", d.Name, name)
+			}
+		}
+	}
+
+	return nil
+}
+
+// metric creates the metric of the definition with the labels added to its
+// own.
+func (d *MetricConfig) metric(labels prometheus.Labels) *Metric {
+	m := &Metric{Name: d.Name, Help: d.Help, Regex: d.Regex}
+
+	if len(d.Labels) > 0 || len(labels) > 0 {
+		m.Labels = prometheus.Labels{}
+	}
+
+	for name, value := range d.Labels {
+		m.Labels[name] = value
+	}
+
+	for name, value := range labels {
+		m.Labels[name] = value
+	}
+
+	return m
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+// tempFail is the delivery result that leads to another delivery attempt.
+const tempFail = "TempFail"
+
+// Labeler resolves the listener and action labels of an envelope.
+type Labeler interface {
+	Labels(s *Session, from, to string) (listener, action string)
+}
+
+// envelope is a single recipient of a message.
+type envelope struct {
+	from     string
+	to       string
+	attempts int
+	done     bool
+}
+
+// message tracks a message from being accepted till all its envelopes got a
+// final delivery result.
+type message struct {
+	id        string
+	accepted  time.Time
+	nrcpt     int
+	session   *Session
+	envelopes map[string]*envelope
+	done      int
+	elem      *list.Element
+}
+
+// complete returns true if every envelope of the message got a final result.
+func (m *message) complete() bool {
+	if m.nrcpt > 0 {
+		return m.done >= m.nrcpt
+	}
+
+	return m.done == len(m.envelopes)
+}
+
+// envelope returns the envelope with the id and creates it if needed.
+func (m *message) envelope(evpid string) *envelope {
+	e, ok := m.envelopes[evpid]
+	if !ok {
+		e = &envelope{}
+		m.envelopes[evpid] = e
+	}
+
+	return e
+}
+
+// session is an open smtp session.
+type session struct {
+	id      string
+	started time.Time
+	info    Session
+	elem    *list.Element
+}
+
+// Correlator joins smtp, mta and mda log events by their message id and
+// observes how long messages take from being accepted to their final delivery.
+// It keeps at most maxMessages messages and sessions and drops the ones not
+// completed within ttl. If Labeler is set, the metrics get labeled with the
+// listener and action of the messages.
+type Correlator struct {
+	Labeler Labeler
+
+	mux          sync.Mutex
+	maxMessages  int
+	ttl          time.Duration
+	messages     map[string]*message
+	order        *list.List
+	sessions     map[string]*session
+	sessionOrder *list.List
+
+	endToEnd *prometheus.HistogramVec
+	attempts *prometheus.HistogramVec
+	dropped  *prometheus.CounterVec
+}
+
+// NewCorrelator creates a Correlator and registers its metrics.
+func NewCorrelator(reg prometheus.Registerer, maxMessages int, ttl time.Duration) *Correlator {
+	c := &Correlator{
+		maxMessages:  maxMessages,
+		ttl:          ttl,
+		messages:     map[string]*message{},
+		order:        list.New(),
+		sessions:     map[string]*session{},
+		sessionOrder: list.New(),
+		endToEnd: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "smtpd_message_end_to_end_seconds",
+			Help:    "Time from accepting a message till the final delivery of all its envelopes.",
+			Buckets: prometheus.ExponentialBuckets(1, 4, 10), //nolint:gomnd
+		}, []string{"listener", "action"}),
+		attempts: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "smtpd_message_delivery_attempts",
+			Help:    "Delivery attempts an envelope needed till its final result.",
+			Buckets: prometheus.LinearBuckets(1, 1, 10), //nolint:gomnd
+		}, []string{"listener", "action"}),
+		dropped: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "smtpd_message_correlator_dropped_total",
+			Help: "Messages dropped from correlation before they got delivered.",
+		}, []string{"reason"}),
+	}
+
+	// messages that can not be labeled go here, make it exist from the start
+	c.endToEnd.WithLabelValues("", "")
+	c.attempts.WithLabelValues("", "")
+
+	reg.MustRegister(c.endToEnd, c.attempts, c.dropped)
+
+	return c
+}
+
+// Handle takes a log event and updates the tracked session or message.
+func (c *Correlator) Handle(ev *LogEvent) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	c.expire(ev.Time)
+
+	switch {
+	case ev.Subsystem == "smtp" && ev.Event == "connected":
+		c.session(ev.Session, ev.Time).info = Session{Address: ev.Fields["address"], Host: ev.Fields["host"]}
+	case ev.Subsystem == "smtp" && ev.Event == "authentication":
+		if ev.Fields["result"] == "ok" {
+			s := c.session(ev.Session, ev.Time)
+			s.info.User = ev.Fields["user"]
+			s.info.Authenticated = true
+		}
+	case ev.Subsystem == "smtp" && ev.Event == "disconnected":
+		if s, ok := c.sessions[ev.Session]; ok {
+			c.removeSession(s)
+		}
+	case ev.Subsystem == "smtp" && ev.Event == "message":
+		m := c.message(ev.Fields["msgid"], ev)
+		if m == nil {
+			break
+		}
+
+		m.accepted = ev.Time
+		m.nrcpt = atoi(ev.Fields["nrcpt"])
+	case ev.Subsystem == "smtp" && ev.Event == "envelope":
+		m := c.message(msgID(ev.Fields["evpid"]), ev)
+		if m == nil {
+			break
+		}
+
+		e := m.envelope(ev.Fields["evpid"])
+		e.from = ev.Fields["from"]
+		e.to = ev.Fields["to"]
+	case (ev.Subsystem == "mta" || ev.Subsystem == "mda") && ev.Event == "delivery":
+		c.delivery(ev)
+	}
+}
+
+// Len returns the number of messages in correlation.
+func (c *Correlator) Len() int {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	return len(c.messages)
+}
+
+// delivery counts a delivery attempt and observes the message once it is done.
+func (c *Correlator) delivery(ev *LogEvent) {
+	evpid := ev.Fields["evpid"]
+
+	m, ok := c.messages[msgID(evpid)]
+	if !ok {
+		log.WithFields(log.Fields{"evpid": evpid}).Debug("delivery of unknown message")
+		return
+	}
+
+	e := m.envelope(evpid)
+	e.attempts++
+
+	if e.to == "" {
+		e.from = ev.Fields["from"]
+		e.to = ev.Fields["to"]
+	}
+
+	if ev.Fields["result"] == tempFail || e.done {
+		return
+	}
+
+	e.done = true
+	m.done++
+
+	listener, action := c.labels(m, e)
+	c.attempts.WithLabelValues(listener, action).Observe(float64(e.attempts))
+
+	if m.complete() {
+		c.endToEnd.WithLabelValues(listener, action).Observe(ev.Time.Sub(m.accepted).Seconds())
+		c.remove(m)
+	}
+}
+
+// labels resolves the labels of an envelope if there is a Labeler.
+func (c *Correlator) labels(m *message, e *envelope) (string, string) {
+	if c.Labeler == nil {
+		return "", ""
+	}
+
+	return c.Labeler.Labels(m.session, e.from, e.to)
+}
+
+// message returns the tracked message with the id or starts tracking it.
+func (c *Correlator) message(id string, ev *LogEvent) *message {
+	if id == "" {
+		return nil
+	}
+
+	if m, ok := c.messages[id]; ok {
+		return m
+	}
+
+	// keep memory bounded by dropping the oldest message
+	if len(c.messages) >= c.maxMessages {
+		if oldest := c.order.Front(); oldest != nil {
+			c.remove(oldest.Value.(*message))
+			c.dropped.WithLabelValues("capacity").Inc()
+		}
+	}
+
+	m := &message{
+		id:        id,
+		accepted:  ev.Time,
+		envelopes: map[string]*envelope{},
+	}
+
+	if s, ok := c.sessions[ev.Session]; ok {
+		info := s.info
+		m.session = &info
+	}
+
+	m.elem = c.order.PushBack(m)
+	c.messages[id] = m
+
+	return m
+}
+
+// session returns the open session with the id or starts tracking it.
+func (c *Correlator) session(id string, t time.Time) *session {
+	if s, ok := c.sessions[id]; ok {
+		return s
+	}
+
+	if len(c.sessions) >= c.maxMessages {
+		if oldest := c.sessionOrder.Front(); oldest != nil {
+			c.removeSession(oldest.Value.(*session))
+		}
+	}
+
+	s := &session{id: id, started: t}
+	s.elem = c.sessionOrder.PushBack(s)
+	c.sessions[id] = s
+
+	return s
+}
+
+// expire drops all messages accepted and sessions started longer than ttl
+// before now.
+func (c *Correlator) expire(now time.Time) {
+	for e := c.order.Front(); e != nil; e = c.order.Front() {
+		m := e.Value.(*message)
+		if now.Sub(m.accepted) < c.ttl {
+			break
+		}
+
+		log.WithFields(log.Fields{"msgid": m.id}).Debug("expire message")
+		c.remove(m)
+		c.dropped.WithLabelValues("expired").Inc()
+	}
+
+	for e := c.sessionOrder.Front(); e != nil; e = c.sessionOrder.Front() {
+		s := e.Value.(*session)
+		if now.Sub(s.started) < c.ttl {
+			break
+		}
+
+		c.removeSession(s)
+	}
+}
+
+func (c *Correlator) remove(m *message) {
+	c.order.Remove(m.elem)
+	delete(c.messages, m.id)
+}
+
+func (c *Correlator) removeSession(s *session) {
+	c.sessionOrder.Remove(s.elem)
+	delete(c.sessions, s.id)
+}
+
+// msgID returns the message id part of an envelope id.
+func msgID(evpid string) string {
+	msgIDLen := 8
+	if len(evpid) < msgIDLen {
+		return ""
+	}
+
+	return evpid[:msgIDLen]
+}
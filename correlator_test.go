@@ -0,0 +1,142 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+// feedLog parses the log lines and hands them to the correlator.
+func feedLog(t *testing.T, c *Correlator, lines string) {
+	ref := time.Date(2020, time.March, 1, 0, 0, 0, 0, time.UTC)
+
+	for _, line := range strings.Split(strings.TrimSpace(lines), "\n") {
+		ev, err := parseLogLine(strings.TrimSpace(line), ref)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		c.Handle(ev)
+	}
+}
+
+func TestCorrelator(t *testing.T) {
+	assert := assert.New(t)
+	reg := prometheus.NewRegistry()
+	c := NewCorrelator(reg, 100, time.Hour) //nolint:gomnd
+
+	feedLog(t, c, `
+        Feb 28 10:00:00 mx smtpd[1]: 0000000000000001 smtp connected address=192.0.2.1 host=mail.example.org
+        Feb 28 10:00:01 mx smtpd[1]: 0000000000000001 smtp envelope evpid=a1b2c3d400000001 from=<a@example.org> to=<b@example.com>
+        Feb 28 10:00:01 mx smtpd[1]: 0000000000000001 smtp envelope evpid=a1b2c3d400000002 from=<a@example.org> to=<c@example.net>
+        Feb 28 10:00:01 mx smtpd[1]: 0000000000000001 smtp message msgid=a1b2c3d4 size=1234 nrcpt=2 proto=ESMTP
+        Feb 28 10:00:03 mx smtpd[1]: 0000000000000002 mta delivery evpid=a1b2c3d400000001 result="Ok" stat="250 Ok"
+        Feb 28 10:00:04 mx smtpd[1]: 0000000000000003 mta delivery evpid=a1b2c3d400000002 result="TempFail" stat="451 later"
+    `)
+
+	assert.Equal(1, c.Len())
+
+	feedLog(t, c, `
+        Feb 28 10:05:01 mx smtpd[1]: 0000000000000004 mta delivery evpid=a1b2c3d400000002 result="Ok" stat="250 Ok"
+    `)
+
+	assert.Equal(0, c.Len())
+
+	expected := `
+# HELP smtpd_message_end_to_end_seconds Time from accepting a message till the final delivery of all its envelopes.
+# TYPE smtpd_message_end_to_end_seconds histogram
+smtpd_message_end_to_end_seconds_bucket{action="",listener="",le="1"} 0
+smtpd_message_end_to_end_seconds_bucket{action="",listener="",le="4"} 0
+smtpd_message_end_to_end_seconds_bucket{action="",listener="",le="16"} 0
+smtpd_message_end_to_end_seconds_bucket{action="",listener="",le="64"} 0
+smtpd_message_end_to_end_seconds_bucket{action="",listener="",le="256"} 0
+smtpd_message_end_to_end_seconds_bucket{action="",listener="",le="1024"} 1
+smtpd_message_end_to_end_seconds_bucket{action="",listener="",le="4096"} 1
+smtpd_message_end_to_end_seconds_bucket{action="",listener="",le="16384"} 1
+smtpd_message_end_to_end_seconds_bucket{action="",listener="",le="65536"} 1
+smtpd_message_end_to_end_seconds_bucket{action="",listener="",le="262144"} 1
+smtpd_message_end_to_end_seconds_bucket{action="",listener="",le="+Inf"} 1
+smtpd_message_end_to_end_seconds_sum{action="",listener=""} 300
+smtpd_message_end_to_end_seconds_count{action="",listener=""} 1
+`
+	assert.Nil(testutil.GatherAndCompare(reg, strings.NewReader(expected), "smtpd_message_end_to_end_seconds"))
+
+	// one envelope needed one attempt, the other two
+	attempts := `
+# HELP smtpd_message_delivery_attempts Delivery attempts an envelope needed till its final result.
+# TYPE smtpd_message_delivery_attempts histogram
+smtpd_message_delivery_attempts_bucket{action="",listener="",le="1"} 1
+smtpd_message_delivery_attempts_bucket{action="",listener="",le="2"} 2
+smtpd_message_delivery_attempts_bucket{action="",listener="",le="3"} 2
+smtpd_message_delivery_attempts_bucket{action="",listener="",le="4"} 2
+smtpd_message_delivery_attempts_bucket{action="",listener="",le="5"} 2
+smtpd_message_delivery_attempts_bucket{action="",listener="",le="6"} 2
+smtpd_message_delivery_attempts_bucket{action="",listener="",le="7"} 2
+smtpd_message_delivery_attempts_bucket{action="",listener="",le="8"} 2
+smtpd_message_delivery_attempts_bucket{action="",listener="",le="9"} 2
+smtpd_message_delivery_attempts_bucket{action="",listener="",le="10"} 2
+smtpd_message_delivery_attempts_bucket{action="",listener="",le="+Inf"} 2
+smtpd_message_delivery_attempts_sum{action="",listener=""} 3
+smtpd_message_delivery_attempts_count{action="",listener=""} 2
+`
+	assert.Nil(testutil.GatherAndCompare(reg, strings.NewReader(attempts), "smtpd_message_delivery_attempts"))
+}
+
+func TestCorrelatorBounded(t *testing.T) {
+	assert := assert.New(t)
+	reg := prometheus.NewRegistry()
+	c := NewCorrelator(reg, 2, time.Hour) //nolint:gomnd
+
+	feedLog(t, c, `
+        Feb 28 10:00:00 mx smtpd[1]: 0000000000000001 smtp message msgid=00000001 nrcpt=1
+        Feb 28 10:00:01 mx smtpd[1]: 0000000000000002 smtp message msgid=00000002 nrcpt=1
+        Feb 28 10:00:02 mx smtpd[1]: 0000000000000003 smtp message msgid=00000003 nrcpt=1
+    `)
+
+	assert.Equal(2, c.Len())
+	assert.Equal(float64(1), testutil.ToFloat64(c.dropped.WithLabelValues("capacity")))
+
+	// everything is older than the ttl now
+	feedLog(t, c, `
+        Feb 28 11:00:02 mx smtpd[1]: 0000000000000004 smtp message msgid=00000004 nrcpt=1
+    `)
+
+	assert.Equal(1, c.Len())
+	assert.Equal(float64(2), testutil.ToFloat64(c.dropped.WithLabelValues("expired")))
+}
+
+func TestCorrelatorLabels(t *testing.T) {
+	assert := assert.New(t)
+	reg := prometheus.NewRegistry()
+	c := NewCorrelator(reg, 100, time.Hour) //nolint:gomnd
+	c.Labeler = loadTestConfig(t)
+
+	feedLog(t, c, `
+        Feb 28 10:00:00 mx smtpd[1]: 0000000000000001 smtp connected address=203.0.113.1 host=mail.example.com
+        Feb 28 10:00:01 mx smtpd[1]: 0000000000000001 smtp authentication user=b result=ok
+        Feb 28 10:00:02 mx smtpd[1]: 0000000000000001 smtp envelope evpid=a1b2c3d400000001 from=<b@example.org> to=<a@example.com>
+        Feb 28 10:00:02 mx smtpd[1]: 0000000000000001 smtp message msgid=a1b2c3d4 size=1234 nrcpt=1 proto=ESMTP
+        Feb 28 10:00:03 mx smtpd[1]: 0000000000000001 smtp disconnected reason=quit
+        Feb 28 10:00:04 mx smtpd[1]: 0000000000000002 mta delivery evpid=a1b2c3d400000001 result="Ok" stat="250 Ok"
+    `)
+
+	assert.Equal(float64(0), testutil.ToFloat64(c.dropped.WithLabelValues("expired")))
+
+	mfs, err := reg.Gather()
+	assert.Nil(err)
+
+	for _, mf := range mfs {
+		if mf.GetName() != "smtpd_message_end_to_end_seconds" {
+			continue
+		}
+
+		assert.Len(mf.Metric, 2) //nolint:gomnd
+		assert.Equal("outbound", mf.Metric[1].Label[0].GetValue())
+		assert.Equal("SUBMISSION", mf.Metric[1].Label[1].GetValue())
+		assert.Equal(uint64(1), mf.Metric[1].Histogram.GetSampleCount())
+	}
+}
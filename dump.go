@@ -0,0 +1,170 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+// dumpFamily is a metric family in the json dump.
+type dumpFamily struct {
+	Name    string       `json:"name"`
+	Help    string       `json:"help"`
+	Type    string       `json:"type"`
+	Metrics []dumpMetric `json:"metrics"`
+}
+
+type dumpMetric struct {
+	Labels map[string]string `json:"labels"`
+	Value  *float64          `json:"value,omitempty"`
+	// Count and Sum are set for histograms and summaries.
+	Count     *uint64            `json:"count,omitempty"`
+	Sum       *float64           `json:"sum,omitempty"`
+	Buckets   map[string]float64 `json:"buckets,omitempty"`
+	Quantiles map[string]float64 `json:"quantiles,omitempty"`
+}
+
+// dump writes the metrics of g as text, openmetrics or json. The go and
+// process metrics are left out like in the textfile.
+func dump(w io.Writer, g prometheus.Gatherer, format string) error {
+	mfs, err := g.Gather()
+	if err != nil {
+		return fmt.Errorf("could not gather metrics: %w", err)
+	}
+
+	var families []*dto.MetricFamily
+
+	for _, mf := range mfs {
+		if strings.HasPrefix(mf.GetName(), "go_") || strings.HasPrefix(mf.GetName(), "process_") {
+			continue
+		}
+
+		families = append(families, mf)
+	}
+
+	switch format {
+	case "text":
+		for _, mf := range families {
+			if _, err := expfmt.MetricFamilyToText(w, mf); err != nil {
+				return fmt.Errorf("could not encode metrics: %w", err)
+			}
+		}
+
+		return nil
+	case "openmetrics":
+		for _, mf := range families {
+			if _, err := expfmt.MetricFamilyToOpenMetrics(w, mf); err != nil {
+				return fmt.Errorf("could not encode metrics: %w", err)
+			}
+		}
+
+		_, err := expfmt.FinalizeOpenMetrics(w)
+
+		return err
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+
+		return enc.Encode(dumpFamilies(families))
+	}
+
+	return fmt.Errorf("unknown dump format: %s", format)
+}
+
+// dumpArgs parses the arguments of the dump command and returns the format,
+// `dump -format json` overrides -dump.format given before the command.
+func dumpArgs(args []string, format string) (string, error) {
+	fs := flag.NewFlagSet("dump", flag.ContinueOnError)
+	f := fs.String("format", format, "format of the printed metrics: text, openmetrics or json.")
+
+	if err := fs.Parse(args); err != nil {
+		return "", err
+	}
+
+	if fs.NArg() > 0 {
+		return "", fmt.Errorf("unexpected arguments for dump: %s", strings.Join(fs.Args(), " "))
+	}
+
+	switch *f {
+	case "text", "openmetrics", "json":
+		return *f, nil
+	}
+
+	return "", fmt.Errorf("unknown dump format: %s", *f)
+}
+
+func dumpFamilies(mfs []*dto.MetricFamily) []dumpFamily {
+	families := make([]dumpFamily, 0, len(mfs))
+
+	for _, mf := range mfs {
+		f := dumpFamily{
+			Name:    mf.GetName(),
+			Help:    mf.GetHelp(),
+			Type:    strings.ToLower(mf.GetType().String()),
+			Metrics: make([]dumpMetric, 0, len(mf.GetMetric())),
+		}
+
+		for _, m := range mf.GetMetric() {
+			f.Metrics = append(f.Metrics, dumpValue(m))
+		}
+
+		families = append(families, f)
+	}
+
+	return families
+}
+
+func dumpValue(m *dto.Metric) dumpMetric {
+	d := dumpMetric{Labels: map[string]string{}}
+
+	for _, l := range m.GetLabel() {
+		d.Labels[l.GetName()] = l.GetValue()
+	}
+
+	value := func(v float64) *float64 {
+		// json has no NaN
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return nil
+		}
+
+		return &v
+	}
+
+	switch {
+	case m.Counter != nil:
+		d.Value = value(m.GetCounter().GetValue())
+	case m.Gauge != nil:
+		d.Value = value(m.GetGauge().GetValue())
+	case m.Untyped != nil:
+		d.Value = value(m.GetUntyped().GetValue())
+	case m.Histogram != nil:
+		h := m.GetHistogram()
+		count := h.GetSampleCount()
+		d.Count, d.Sum = &count, value(h.GetSampleSum())
+		d.Buckets = map[string]float64{}
+
+		for _, b := range h.GetBucket() {
+			d.Buckets[formatFloat(b.GetUpperBound())] = float64(b.GetCumulativeCount())
+		}
+	case m.Summary != nil:
+		s := m.GetSummary()
+		count := s.GetSampleCount()
+		d.Count, d.Sum = &count, value(s.GetSampleSum())
+		d.Quantiles = map[string]float64{}
+
+		for _, q := range s.GetQuantile() {
+			if v := value(q.GetValue()); v != nil {
+				d.Quantiles[formatFloat(q.GetQuantile())] = *v
+			}
+		}
+	}
+
+	return d
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDump(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	c := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "smtpd_delivery_ok", Help: "Shows how often a delivery was ok."},
+		[]string{"instance_name"})
+	c.WithLabelValues("mx").Add(42)
+	h := prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name: "smtpd_message_attempts", Help: "Delivery attempts.", Buckets: []float64{1},
+	})
+	h.Observe(1)
+	reg.MustRegister(c, h, prometheus.NewGoCollector())
+
+	tests := []struct {
+		format   string
+		contains string
+	}{
+		{"text", "smtpd_delivery_ok{instance_name=\"mx\"} 42\n"},
+		{"openmetrics", "# EOF\n"},
+		{"json", "\"name\": \"smtpd_delivery_ok\""},
+	}
+
+	for _, test := range tests {
+		var buf bytes.Buffer
+
+		assert.Nil(t, dump(&buf, reg, test.format), test.format)
+		assert.Contains(t, buf.String(), test.contains, test.format)
+		assert.NotContains(t, buf.String(), "go_goroutines", test.format)
+	}
+
+	var buf bytes.Buffer
+
+	assert.Nil(t, dump(&buf, reg, "json"))
+
+	var families []dumpFamily
+
+	assert.Nil(t, json.Unmarshal(buf.Bytes(), &families))
+	assert.Equal(t, "counter", families[0].Type)
+	assert.Equal(t, map[string]string{"instance_name": "mx"}, families[0].Metrics[0].Labels)
+	assert.Equal(t, float64(42), *families[0].Metrics[0].Value)
+	assert.Equal(t, map[string]float64{"1": 1}, families[1].Metrics[0].Buckets)
+
+	assert.NotNil(t, dump(&buf, reg, "xml"))
+}
+
+func TestDumpArgs(t *testing.T) {
+	tests := []struct {
+		args   []string
+		format string
+		err    bool
+	}{
+		{nil, "text", false},
+		{[]string{"-format", "json"}, "json", false},
+		{[]string{"-format=openmetrics"}, "openmetrics", false},
+		{[]string{"-format", "xml"}, "", true},
+		{[]string{"json"}, "", true},
+		{[]string{"-format", "json", "extra"}, "", true},
+		{[]string{"-unknown"}, "", true},
+	}
+
+	for _, test := range tests {
+		format, err := dumpArgs(test.args, "text")
+		assert.Equal(t, test.format, format, test.args)
+		assert.Equal(t, test.err, err != nil, test.args)
+	}
+}
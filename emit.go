@@ -0,0 +1,446 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// maxStatsdPacket keeps StatsD packets below the usual MTU.
+const maxStatsdPacket = 1432
+
+const (
+	// emitTimeout limits connecting to and writing to Graphite, and sending
+	// the buffered lines on shutdown.
+	emitTimeout = 10 * time.Second
+
+	graphiteBufferSize = 10000
+	graphiteBatchSize  = 1000
+)
+
+// Sample is the value of a metric after a collection.
+type Sample struct {
+	Name     string
+	Instance string
+	Value    float64
+}
+
+// Collection is the result of collecting the stats of an instance.
+type Collection struct {
+	Instance string
+	// Stats is the `smtpctl show stats` output the samples come from.
+	Stats   string
+	Samples []Sample
+	Time    time.Time
+}
+
+// Emitter sends the result of a collection to another monitoring system.
+type Emitter interface {
+	Emit(c *Collection) error
+}
+
+// recordStat keeps the output of the last collection.
+type recordStat struct {
+	Stat
+	out string
+}
+
+func (s *recordStat) Now() (string, error) {
+	out, err := s.Stat.Now()
+	s.out = out
+
+	return out, err
+}
+
+// collectAndEmit collects the metrics and sends them to all emitters.
+func collectAndEmit(m []*Metric, stats Stat, emitters []Emitter) error {
+	rec := &recordStat{Stat: stats}
+
+	if err := collectValues(m, rec); err != nil {
+		return err
+	}
+
+	if len(emitters) == 0 {
+		return nil
+	}
+
+	c := &Collection{Stats: rec.out, Time: time.Now()}
+
+	for _, m := range m {
+		m.mux.Lock()
+		c.Instance = m.Labels["instance_name"]
+		c.Samples = append(c.Samples, Sample{Name: m.Name, Instance: c.Instance, Value: float64(m.LastVal)})
+		m.mux.Unlock()
+	}
+
+	for _, e := range emitters {
+		if err := e.Emit(c); err != nil {
+			log.Error(err)
+		}
+	}
+
+	return nil
+}
+
+// PathTemplate builds dotted metric paths like smtpd.mx1.delivery_ok.
+type PathTemplate struct {
+	Prefix string
+	// Hostname may use {host} for the short and {fqdn} for the full
+	// hostname, its dots replaced by underscores.
+	Hostname string
+}
+
+// Path returns the path of a sample.
+func (t PathTemplate) Path(s Sample) string {
+	parts := []string{}
+
+	if t.Prefix != "" {
+		parts = append(parts, t.Prefix)
+	}
+
+	if host := t.host(); host != "" {
+		parts = append(parts, host)
+	}
+
+	if s.Instance != "" {
+		parts = append(parts, pathElement(s.Instance))
+	}
+
+	return strings.Join(append(parts, strings.TrimPrefix(s.Name, "smtpd_")), ".")
+}
+
+func (t PathTemplate) host() string {
+	if t.Hostname == "" {
+		return ""
+	}
+
+	fqdn, err := os.Hostname()
+	if err != nil {
+		log.WithFields(log.Fields{"error": err}).Debug("could not get hostname")
+	}
+
+	short := fqdn
+	if i := strings.Index(fqdn, "."); i >= 0 {
+		short = fqdn[:i]
+	}
+
+	r := strings.NewReplacer("{host}", pathElement(short), "{fqdn}", pathElement(fqdn))
+
+	return r.Replace(t.Hostname)
+}
+
+// pathElement makes s usable between the dots of a path.
+func pathElement(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '.' || r == ' ' || r == ':' || r == '|' || r == '/' {
+			return '_'
+		}
+
+		return r
+	}, s)
+}
+
+// GraphiteEmitter sends samples in the Graphite plaintext protocol over TCP.
+// The lines get sent in the background, unsent lines are buffered and the
+// oldest get dropped when the buffer is full.
+type GraphiteEmitter struct {
+	Address string
+	Path    PathTemplate
+
+	mux   sync.Mutex
+	queue *sendQueue
+	// conn is only used by the sender of the queue
+	conn net.Conn
+}
+
+// Emit implements Emitter.
+func (g *GraphiteEmitter) Emit(c *Collection) error {
+	lines := make([]string, 0, len(c.Samples))
+
+	for _, s := range c.Samples {
+		lines = append(lines,
+			fmt.Sprintf("%s %s %d", g.Path.Path(s), strconv.FormatFloat(s.Value, 'f', -1, 64), c.Time.Unix()))
+	}
+
+	g.mux.Lock()
+	if g.queue == nil {
+		g.queue = newSendQueue("graphite", graphiteBufferSize, graphiteBatchSize, g.send)
+	}
+	g.mux.Unlock()
+
+	g.queue.Add(lines)
+
+	return nil
+}
+
+// Close stops sending in the background and sends the buffered lines.
+func (g *GraphiteEmitter) Close() error {
+	g.mux.Lock()
+	q := g.queue
+	g.mux.Unlock()
+
+	if q == nil {
+		return nil
+	}
+
+	err := q.Close()
+
+	if g.conn != nil {
+		g.conn.Close()
+		g.conn = nil
+	}
+
+	return err
+}
+
+// send writes the lines. A broken connection gets opened again with the next
+// batch.
+func (g *GraphiteEmitter) send(ctx context.Context, lines []string) error {
+	if g.conn == nil {
+		d := net.Dialer{Timeout: emitTimeout}
+
+		conn, err := d.DialContext(ctx, "tcp", g.Address)
+		if err != nil {
+			return recoverableError{fmt.Errorf("could not connect to graphite: %w", err)}
+		}
+
+		g.conn = conn
+	}
+
+	var buf bytes.Buffer
+
+	for _, line := range lines {
+		buf.WriteString(line + "\n")
+	}
+
+	if err := g.conn.SetWriteDeadline(time.Now().Add(emitTimeout)); err != nil {
+		return recoverableError{err}
+	}
+
+	if _, err := g.conn.Write(buf.Bytes()); err != nil {
+		g.conn.Close()
+		g.conn = nil
+
+		return recoverableError{fmt.Errorf("could not send to graphite: %w", err)}
+	}
+
+	return nil
+}
+
+// sendQueue buffers lines and sends them in batches in the background, so a
+// slow or unreachable receiver does not hold up the collect loops. Batches
+// that could not be sent for now stay buffered until the next lines come in,
+// the oldest lines get dropped when the buffer is full.
+type sendQueue struct {
+	name      string
+	size      int
+	batchSize int
+	send      func(ctx context.Context, lines []string) error
+
+	mux     sync.Mutex
+	pending []string
+	// dropped counts the lines dropped from the front of pending
+	dropped int
+
+	wake   chan struct{}
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// newSendQueue starts sending with send.
+func newSendQueue(name string, size, batchSize int, send func(context.Context, []string) error) *sendQueue {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	q := &sendQueue{
+		name:      name,
+		size:      size,
+		batchSize: batchSize,
+		send:      send,
+		wake:      make(chan struct{}, 1),
+		cancel:    cancel,
+		done:      make(chan struct{}),
+	}
+
+	go q.run(ctx)
+
+	return q
+}
+
+// Add buffers the lines without waiting for them to be sent.
+func (q *sendQueue) Add(lines []string) {
+	q.mux.Lock()
+	q.pending = append(q.pending, lines...)
+
+	if over := len(q.pending) - q.size; over > 0 {
+		log.WithFields(log.Fields{"lines": over}).Warn(q.name + " buffer full, dropping the oldest lines")
+		q.pending = q.pending[over:]
+		q.dropped += over
+	}
+	q.mux.Unlock()
+
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Close stops the sender and tries once more to send the buffered lines.
+func (q *sendQueue) Close() error {
+	q.cancel()
+	<-q.done
+
+	ctx, cancel := context.WithTimeout(context.Background(), emitTimeout)
+	defer cancel()
+
+	return q.flush(ctx)
+}
+
+func (q *sendQueue) run(ctx context.Context) {
+	defer close(q.done)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-q.wake:
+		}
+
+		if err := q.flush(ctx); err != nil {
+			log.Error(err)
+		}
+	}
+}
+
+// flush sends the buffered lines in batches until a batch could not be sent
+// for now. Batches the receiver rejects get dropped.
+func (q *sendQueue) flush(ctx context.Context) error {
+	for {
+		q.mux.Lock()
+		n := len(q.pending)
+		if n > q.batchSize {
+			n = q.batchSize
+		}
+
+		batch := q.pending[:n:n]
+		dropped := q.dropped
+		q.mux.Unlock()
+
+		if n == 0 {
+			return nil
+		}
+
+		err := q.send(ctx, batch)
+		if _, ok := err.(recoverableError); ok {
+			return err
+		}
+
+		if err != nil {
+			log.WithFields(log.Fields{"error": err, "lines": n}).Error(q.name + " rejected lines")
+		}
+
+		q.mux.Lock()
+		// Add might have dropped from the front meanwhile
+		if sent := n - (q.dropped - dropped); sent > 0 {
+			q.pending = q.pending[sent:]
+		}
+		q.mux.Unlock()
+	}
+}
+
+// StatsdEmitter sends samples as StatsD gauges or, with Counters, as the
+// increase since the last collection over UDP.
+type StatsdEmitter struct {
+	Address  string
+	Path     PathTemplate
+	Counters bool
+
+	mux  sync.Mutex
+	conn net.Conn
+	last map[string]float64
+}
+
+// Emit implements Emitter.
+func (s *StatsdEmitter) Emit(c *Collection) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	if s.conn == nil {
+		conn, err := net.Dial("udp", s.Address)
+		if err != nil {
+			return fmt.Errorf("could not connect to statsd: %w", err)
+		}
+
+		s.conn = conn
+		s.last = map[string]float64{}
+	}
+
+	var lines []string
+
+	for _, sample := range c.Samples {
+		path := s.Path.Path(sample)
+
+		if !s.Counters {
+			lines = append(lines, fmt.Sprintf("%s:%s|g", path, strconv.FormatFloat(sample.Value, 'f', -1, 64)))
+			continue
+		}
+
+		last, ok := s.last[path]
+		s.last[path] = sample.Value
+
+		// the first value is only the base
+		if !ok {
+			continue
+		}
+
+		// a smaller value means smtpd restarted
+		delta := sample.Value - last
+		if delta < 0 {
+			delta = sample.Value
+		}
+
+		lines = append(lines, fmt.Sprintf("%s:%s|c", path, strconv.FormatFloat(delta, 'f', -1, 64)))
+	}
+
+	for _, packet := range packets(lines, maxStatsdPacket) {
+		if _, err := s.conn.Write([]byte(packet)); err != nil {
+			return fmt.Errorf("could not send to statsd: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// packets joins lines to packets of at most size bytes.
+func packets(lines []string, size int) []string {
+	var (
+		p   []string
+		cur string
+	)
+
+	for _, line := range lines {
+		if cur != "" && len(cur)+1+len(line) > size {
+			p = append(p, cur)
+			cur = ""
+		}
+
+		if cur != "" {
+			cur += "\n"
+		}
+
+		cur += line
+	}
+
+	if cur != "" {
+		p = append(p, cur)
+	}
+
+	return p
+}
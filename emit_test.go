@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPathTemplate(t *testing.T) {
+	assert := assert.New(t)
+
+	fqdn, err := os.Hostname()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	short := strings.Split(fqdn, ".")[0]
+
+	tables := []struct {
+		tmpl     PathTemplate
+		sample   Sample
+		expected string
+	}{
+		{PathTemplate{Prefix: "smtpd", Hostname: "{host}"}, Sample{Name: "smtpd_delivery_ok"}, "smtpd." + short + ".delivery_ok"},
+		{PathTemplate{Prefix: "mail.smtpd", Hostname: "hosts.{fqdn}"}, Sample{Name: "smtpd_delivery_ok"},
+			"mail.smtpd.hosts." + strings.Replace(fqdn, ".", "_", -1) + ".delivery_ok"},
+		{PathTemplate{Prefix: "smtpd"}, Sample{Name: "smtpd_delivery_tempfail", Instance: "mx.in"}, "smtpd.mx_in.delivery_tempfail"},
+	}
+
+	for _, table := range tables {
+		assert.Equal(table.expected, table.tmpl.Path(table.sample))
+	}
+}
+
+func TestGraphiteEmitter(t *testing.T) {
+	assert := assert.New(t)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	lines := make(chan string)
+
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		scanner := bufio.NewScanner(conn)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+	}()
+
+	g := &GraphiteEmitter{Address: l.Addr().String(), Path: PathTemplate{Prefix: "smtpd"}}
+	defer g.Close()
+
+	now := time.Unix(1577836800, 0)
+
+	assert.Nil(g.Emit(&Collection{Samples: []Sample{{Name: "smtpd_delivery_ok", Value: 42}, {Name: "smtpd_delivery_permfail", Value: 3}}, Time: now}))
+	assert.Equal("smtpd.delivery_ok 42 1577836800", <-lines)
+	assert.Equal("smtpd.delivery_permfail 3 1577836800", <-lines)
+
+	// the connection is kept
+	assert.Nil(g.Emit(&Collection{Samples: []Sample{{Name: "smtpd_delivery_ok", Value: 43}}, Time: now.Add(time.Minute)}))
+	assert.Equal("smtpd.delivery_ok 43 1577836860", <-lines)
+}
+
+func TestSendQueue(t *testing.T) {
+	assert := assert.New(t)
+
+	var sent []string
+
+	calls := 0
+	started := make(chan struct{})
+
+	q := newSendQueue("test", 3, 2, func(ctx context.Context, lines []string) error {
+		calls++
+		if calls == 1 {
+			// a receiver that does not answer
+			close(started)
+			<-ctx.Done()
+
+			return recoverableError{ctx.Err()}
+		}
+
+		sent = append(sent, lines...)
+
+		return nil
+	})
+
+	q.Add([]string{"a", "b"})
+	<-started
+
+	// adding does not wait for the sender, the oldest line gets dropped
+	q.Add([]string{"c", "d"})
+
+	// closing stops the hanging send and sends the buffer
+	assert.Nil(q.Close())
+	assert.Equal([]string{"b", "c", "d"}, sent)
+}
+
+func TestStatsdEmitter(t *testing.T) {
+	assert := assert.New(t)
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	read := func() string {
+		buf := make([]byte, maxStatsdPacket)
+
+		if err := conn.SetReadDeadline(time.Now().Add(time.Second)); err != nil {
+			t.Fatal(err)
+		}
+
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			return ""
+		}
+
+		return string(buf[:n])
+	}
+
+	collection := func(ok, permfail float64) *Collection {
+		return &Collection{
+			Samples: []Sample{{Name: "smtpd_delivery_ok", Value: ok}, {Name: "smtpd_delivery_permfail", Value: permfail}},
+			Time:    time.Now(),
+		}
+	}
+
+	path := PathTemplate{Prefix: "smtpd"}
+
+	g := &StatsdEmitter{Address: conn.LocalAddr().String(), Path: path}
+	assert.Nil(g.Emit(collection(42, 3)))
+	assert.Equal("smtpd.delivery_ok:42|g\nsmtpd.delivery_permfail:3|g", read())
+
+	c := &StatsdEmitter{Address: conn.LocalAddr().String(), Path: path, Counters: true}
+	assert.Nil(c.Emit(collection(42, 3)))
+	assert.Nil(c.Emit(collection(50, 3)))
+	assert.Equal("smtpd.delivery_ok:8|c\nsmtpd.delivery_permfail:0|c", read())
+
+	// smtpd restarted
+	assert.Nil(c.Emit(collection(5, 0)))
+	assert.Equal("smtpd.delivery_ok:5|c\nsmtpd.delivery_permfail:0|c", read())
+}
+
+func TestPackets(t *testing.T) {
+	assert.Equal(t, []string{"a:1|g\nb:2|g", "c:3|g"}, packets([]string{"a:1|g", "b:2|g", "c:3|g"}, 12))
+}
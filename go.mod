@@ -3,13 +3,18 @@ module github.com/xsteadfastx/smtpd_exporter
 go 1.13
 
 require (
-	github.com/golang/protobuf v1.3.3 // indirect
+	github.com/golang/protobuf v1.3.3
+	github.com/golang/snappy v0.0.4
 	github.com/konsorten/go-windows-terminal-sequences v1.0.2 // indirect
 	github.com/prometheus/client_golang v1.4.0
 	github.com/prometheus/client_model v0.2.0
+	github.com/prometheus/common v0.9.1
 	github.com/sirupsen/logrus v1.4.2
 	github.com/stretchr/objx v0.2.0 // indirect
 	github.com/stretchr/testify v1.4.0
-	golang.org/x/sys v0.0.0-20200202164722-d101bd2416d5 // indirect
-	gopkg.in/yaml.v2 v2.2.8 // indirect
+	golang.org/x/crypto v0.0.0-20220214200702-86341886e292
+	gopkg.in/yaml.v2 v2.2.8
 )
+
+// bcrypt needs nothing newer, keep the x/sys logrus builds with on go 1.13
+replace golang.org/x/sys => golang.org/x/sys v0.0.0-20200202164722-d101bd2416d5
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// maxInfluxPacket keeps InfluxDB UDP packets below the usual MTU.
+const maxInfluxPacket = 1432
+
+// InfluxConfig holds the settings of the InfluxDB output.
+type InfluxConfig struct {
+	// URL is http(s)://host:8086 for the v2 write API or udp://host:8089.
+	URL        string
+	Org        string
+	Bucket     string
+	TokenFile  string
+	Timeout    time.Duration
+	BufferSize int
+	BatchSize  int
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	MaxRetries int
+}
+
+// InfluxEmitter writes the stats in the InfluxDB line protocol with a
+// measurement per smtpd subsystem. Over HTTP the lines get sent in the
+// background, unsent lines are buffered and sent with the next collection,
+// the oldest get dropped when the buffer is full.
+type InfluxEmitter struct {
+	cfg    InfluxConfig
+	host   string
+	token  string
+	client *http.Client
+	queue  *sendQueue
+
+	mux  sync.Mutex
+	conn net.Conn
+}
+
+// NewInfluxEmitter creates an emitter with the settings.
+func NewInfluxEmitter(cfg InfluxConfig) (*InfluxEmitter, error) {
+	u, err := url.Parse(cfg.URL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid influxdb url: %w", err)
+	}
+
+	if u.Scheme != "http" && u.Scheme != "https" && u.Scheme != "udp" {
+		return nil, fmt.Errorf("unsupported influxdb url: %s", cfg.URL)
+	}
+
+	host, err := os.Hostname()
+	if err != nil {
+		return nil, fmt.Errorf("could not get hostname: %w", err)
+	}
+
+	e := &InfluxEmitter{cfg: cfg, host: host, client: &http.Client{Timeout: cfg.Timeout}}
+
+	if cfg.TokenFile != "" {
+		token, err := ioutil.ReadFile(cfg.TokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not read influxdb token: %w", err)
+		}
+
+		e.token = strings.TrimSpace(string(token))
+	}
+
+	if u.Scheme != "udp" {
+		e.queue = newSendQueue("influxdb", cfg.BufferSize, cfg.BatchSize, e.sendWithRetries)
+	}
+
+	return e, nil
+}
+
+// Emit implements Emitter.
+func (e *InfluxEmitter) Emit(c *Collection) error {
+	lines := influxLines(c.Stats, e.host, c.Instance, c.Time)
+
+	if e.queue != nil {
+		e.queue.Add(lines)
+		return nil
+	}
+
+	e.mux.Lock()
+	defer e.mux.Unlock()
+
+	return e.sendUDP(lines)
+}
+
+// Close stops sending in the background and sends the buffered lines.
+func (e *InfluxEmitter) Close() error {
+	if e.queue != nil {
+		return e.queue.Close()
+	}
+
+	e.mux.Lock()
+	defer e.mux.Unlock()
+
+	if e.conn == nil {
+		return nil
+	}
+
+	err := e.conn.Close()
+	e.conn = nil
+
+	return err
+}
+
+func (e *InfluxEmitter) sendUDP(lines []string) error {
+	if e.conn == nil {
+		conn, err := net.Dial("udp", strings.TrimPrefix(e.cfg.URL, "udp://"))
+		if err != nil {
+			return fmt.Errorf("could not connect to influxdb: %w", err)
+		}
+
+		e.conn = conn
+	}
+
+	for _, packet := range packets(lines, maxInfluxPacket) {
+		if _, err := e.conn.Write([]byte(packet + "\n")); err != nil {
+			return fmt.Errorf("could not send to influxdb: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// sendWithRetries retries recoverable errors with doubling backoff.
+func (e *InfluxEmitter) sendWithRetries(ctx context.Context, lines []string) error {
+	backoff := e.cfg.MinBackoff
+
+	for try := 0; ; try++ {
+		err := e.send(ctx, lines)
+		if _, ok := err.(recoverableError); !ok || try >= e.cfg.MaxRetries {
+			return err
+		}
+
+		log.WithFields(log.Fields{"error": err, "backoff": backoff}).Debug("retrying influxdb write")
+
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(backoff):
+		}
+
+		backoff *= 2
+		if backoff > e.cfg.MaxBackoff {
+			backoff = e.cfg.MaxBackoff
+		}
+	}
+}
+
+func (e *InfluxEmitter) send(ctx context.Context, lines []string) error {
+	q := url.Values{"org": {e.cfg.Org}, "bucket": {e.cfg.Bucket}, "precision": {"s"}}
+	body := strings.Join(lines, "\n") + "\n"
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost,
+		strings.TrimSuffix(e.cfg.URL, "/")+"/api/v2/write?"+q.Encode(), strings.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+
+	if e.token != "" {
+		req.Header.Set("Authorization", "Token "+e.token)
+	}
+
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return recoverableError{fmt.Errorf("could not send to influxdb: %w", err)}
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 == 2 {
+		io.Copy(ioutil.Discard, resp.Body) // nolint:errcheck
+		return nil
+	}
+
+	msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, maxErrorBody))
+	err = fmt.Errorf("could not send to influxdb: %s: %s", resp.Status, bytes.TrimSpace(msg))
+
+	if resp.StatusCode/100 == 5 || resp.StatusCode == http.StatusTooManyRequests {
+		return recoverableError{err}
+	}
+
+	return err
+}
+
+// influxLines turns `smtpctl show stats` output into a line per subsystem,
+// like `smtpd_scheduler,host=mx1 delivery.ok=5i 1577836800`. Stats without a
+// subsystem go to the smtpd measurement, values that are no numbers are
+// left out.
+func influxLines(stats, host, instance string, now time.Time) []string {
+	fields := map[string][]string{}
+
+	scanner := bufio.NewScanner(strings.NewReader(stats))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+
+		i := strings.Index(line, "=")
+		if i < 1 {
+			continue
+		}
+
+		key, value := line[:i], line[i+1:]
+		if _, err := strconv.ParseInt(value, 10, 64); err != nil {
+			continue
+		}
+
+		measurement := "smtpd"
+		if j := strings.Index(key, "."); j > 0 {
+			measurement, key = "smtpd_"+key[:j], key[j+1:]
+		}
+
+		fields[measurement] = append(fields[measurement], influxEscape(key, ",= ")+"="+value+"i")
+	}
+
+	tags := ",host=" + influxEscape(host, ",= ")
+	if instance != "" {
+		tags += ",instance=" + influxEscape(instance, ",= ")
+	}
+
+	measurements := make([]string, 0, len(fields))
+	for m := range fields {
+		measurements = append(measurements, m)
+	}
+
+	sort.Strings(measurements)
+
+	lines := make([]string, 0, len(measurements))
+
+	for _, m := range measurements {
+		sort.Strings(fields[m])
+		lines = append(lines, fmt.Sprintf("%s%s %s %d",
+			influxEscape(m, ", "), tags, strings.Join(fields[m], ","), now.Unix()))
+	}
+
+	return lines
+}
+
+// influxEscape escapes the characters with a backslash.
+func influxEscape(s, chars string) string {
+	var b strings.Builder
+
+	for _, r := range s {
+		if strings.ContainsRune(chars, r) {
+			b.WriteByte('\\')
+		}
+
+		b.WriteRune(r)
+	}
+
+	return b.String()
+}
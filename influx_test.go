@@ -0,0 +1,264 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+)
+
+const influxStats = `control.session=1
+mda.envelope=0
+mta.connector=2
+scheduler.delivery.ok=42
+scheduler.delivery.tempfail=7
+smtp.session.inet4=3
+queue.evpcache.size=5
+uptime=120
+uptime.human=2m
+`
+
+func TestInfluxLines(t *testing.T) {
+	assert.Equal(t, []string{
+		`smtpd,host=mx1,instance=mx\ in uptime=120i 1577836800`,
+		`smtpd_control,host=mx1,instance=mx\ in session=1i 1577836800`,
+		`smtpd_mda,host=mx1,instance=mx\ in envelope=0i 1577836800`,
+		`smtpd_mta,host=mx1,instance=mx\ in connector=2i 1577836800`,
+		`smtpd_queue,host=mx1,instance=mx\ in evpcache.size=5i 1577836800`,
+		`smtpd_scheduler,host=mx1,instance=mx\ in delivery.ok=42i,delivery.tempfail=7i 1577836800`,
+		`smtpd_smtp,host=mx1,instance=mx\ in session.inet4=3i 1577836800`,
+	}, influxLines(influxStats, "mx1", "mx in", time.Unix(1577836800, 0)))
+}
+
+// influxdb is a stand-in for the v2 write api answering with the queued
+// status codes first.
+type influxdb struct {
+	mux      sync.Mutex
+	statuses []int
+	bodies   []string
+	queries  []string
+	auth     string
+}
+
+func (db *influxdb) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	if r.URL.Path != "/api/v2/write" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	if len(db.statuses) > 0 {
+		w.WriteHeader(db.statuses[0])
+		db.statuses = db.statuses[1:]
+
+		return
+	}
+
+	body, _ := ioutil.ReadAll(r.Body)
+	db.bodies = append(db.bodies, string(body))
+	db.queries = append(db.queries, r.URL.RawQuery)
+	db.auth = r.Header.Get("Authorization")
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// sent returns the bodies written so far.
+func (db *influxdb) sent() []string {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	return append([]string{}, db.bodies...)
+}
+
+// failing returns the number of queued status codes left.
+func (db *influxdb) failing() int {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	return len(db.statuses)
+}
+
+// waitFor polls cond for up to a second.
+func waitFor(cond func() bool) bool {
+	for i := 0; i < 100; i++ {
+		if cond() {
+			return true
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	return cond()
+}
+
+func testInfluxEmitter(t *testing.T, url string, bufferSize int) *InfluxEmitter {
+	e, err := NewInfluxEmitter(InfluxConfig{
+		URL:        url,
+		Org:        "mail",
+		Bucket:     "smtpd",
+		Timeout:    time.Second,
+		BufferSize: bufferSize,
+		BatchSize:  4,
+		MinBackoff: time.Millisecond,
+		MaxBackoff: 2 * time.Millisecond,
+		MaxRetries: 1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return e
+}
+
+func TestInfluxEmitterHTTP(t *testing.T) {
+	assert := assert.New(t)
+	db := &influxdb{statuses: []int{http.StatusServiceUnavailable}}
+	s := httptest.NewServer(db)
+	defer s.Close()
+
+	dir, err := ioutil.TempDir("", "smtpd_exporter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := ioutil.WriteFile(dir+"/token", []byte("secret\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	e, err := NewInfluxEmitter(InfluxConfig{
+		URL:        s.URL,
+		Org:        "mail",
+		Bucket:     "smtpd",
+		TokenFile:  dir + "/token",
+		Timeout:    time.Second,
+		BufferSize: 100,
+		BatchSize:  4,
+		MinBackoff: time.Millisecond,
+		MaxBackoff: 2 * time.Millisecond,
+		MaxRetries: 1,
+	})
+	assert.Nil(err)
+
+	defer e.Close()
+
+	// the first request fails and gets retried, seven lines go in two batches
+	assert.Nil(e.Emit(&Collection{Stats: influxStats, Time: time.Unix(1577836800, 0)}))
+
+	if !assert.True(waitFor(func() bool { return len(db.sent()) == 2 })) {
+		return
+	}
+
+	bodies := db.sent()
+	assert.Equal(4, strings.Count(bodies[0], "\n"))
+	assert.Equal(3, strings.Count(bodies[1], "\n"))
+	assert.Contains(bodies[1], "smtpd_scheduler,host=")
+
+	db.mux.Lock()
+	assert.Equal("bucket=smtpd&org=mail&precision=s", db.queries[0])
+	assert.Equal("Token secret", db.auth)
+	db.mux.Unlock()
+}
+
+func TestInfluxEmitterOutage(t *testing.T) {
+	assert := assert.New(t)
+	db := &influxdb{statuses: []int{
+		http.StatusBadGateway, http.StatusBadGateway, http.StatusBadRequest,
+	}}
+	s := httptest.NewServer(db)
+	defer s.Close()
+
+	e := testInfluxEmitter(t, s.URL, 10)
+	defer e.Close()
+
+	pending := func() int {
+		e.queue.mux.Lock()
+		defer e.queue.mux.Unlock()
+
+		return len(e.queue.pending)
+	}
+
+	// the lines stay buffered while influxdb is down
+	assert.Nil(e.Emit(&Collection{Stats: influxStats, Time: time.Unix(1577836800, 0)}))
+	assert.True(waitFor(func() bool { return db.failing() == 1 }))
+	assert.Equal(7, pending())
+
+	// the buffer keeps the newest lines, the first batch gets rejected
+	assert.Nil(e.Emit(&Collection{Stats: influxStats, Time: time.Unix(1577836860, 0)}))
+
+	if !assert.True(waitFor(func() bool { return len(db.sent()) == 2 && pending() == 0 })) {
+		return
+	}
+
+	bodies := db.sent()
+	assert.NotContains(bodies[0]+bodies[1], "1577836800")
+}
+
+func TestInfluxEmitterUDP(t *testing.T) {
+	assert := assert.New(t)
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	e := testInfluxEmitter(t, "udp://"+conn.LocalAddr().String(), 10)
+	defer e.Close()
+
+	assert.Nil(e.Emit(&Collection{Stats: influxStats, Instance: "mx", Time: time.Unix(1577836800, 0)}))
+
+	buf := make([]byte, maxInfluxPacket)
+
+	if err := conn.SetReadDeadline(time.Now().Add(time.Second)); err != nil {
+		t.Fatal(err)
+	}
+
+	n, _, err := conn.ReadFrom(buf)
+	assert.Nil(err)
+	assert.Equal(7, strings.Count(string(buf[:n]), "\n"))
+	assert.Contains(string(buf[:n]), ",instance=mx delivery.ok=42i,delivery.tempfail=7i 1577836800\n")
+
+	_, err = NewInfluxEmitter(InfluxConfig{URL: "tcp://localhost:8089"})
+	assert.NotNil(err)
+}
+
+// emitRecorder keeps the collections it gets.
+type emitRecorder []*Collection
+
+func (r *emitRecorder) Emit(c *Collection) error {
+	*r = append(*r, c)
+	return nil
+}
+
+func TestCollectAndEmit(t *testing.T) {
+	assert := assert.New(t)
+	reg := prometheus.NewRegistry()
+	i := initer{}
+
+	m := (&Instance{Name: "mx"}).Metrics(defaultMetrics())
+	for _, m := range m {
+		m.Registerer = reg
+		i.Metric(m)
+	}
+
+	stats := new(MockStat)
+	stats.On("Now").Return(influxStats, nil)
+
+	r := &emitRecorder{}
+	assert.Nil(collectAndEmit(m, stats, []Emitter{r}))
+	assert.Len(*r, 1)
+	assert.Equal(influxStats, (*r)[0].Stats)
+	assert.Equal("mx", (*r)[0].Instance)
+	assert.Equal(Sample{Name: "smtpd_delivery_ok", Instance: "mx", Value: 42}, (*r)[0].Samples[0])
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os/exec"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+// socketTimeout limits reading the stats from a socket.
+const socketTimeout = 10 * time.Second
+
+// Instance is a smtpd instance with its own stats source.
+type Instance struct {
+	Name     string        `yaml:"name"`
+	Command  []string      `yaml:"command"`
+	Socket   string        `yaml:"socket"`
+	File     string        `yaml:"file"`
+	Interval time.Duration `yaml:"interval"`
+}
+
+// Stat returns the stats source of the instance. Without command, socket and
+// file it runs `smtpctl show stats`.
+func (i *Instance) Stat() Stat {
+	switch {
+	case i.Socket != "":
+		return instanceStat{name: i.Name, stat: socketStat{path: i.Socket}}
+	case i.File != "":
+		return instanceStat{name: i.Name, stat: fileStat{path: i.File}}
+	case len(i.Command) > 0:
+		return instanceStat{name: i.Name, stat: commandStat{args: i.Command}}
+	}
+
+	return instanceStat{name: i.Name, stat: smtpctl{}}
+}
+
+// Source names the kind of stats source of the instance.
+func (i *Instance) Source() string {
+	switch {
+	case i.Socket != "":
+		return "socket"
+	case i.File != "":
+		return "file"
+	case len(i.Command) > 0:
+		return "command"
+	}
+
+	return "exec"
+}
+
+// Metrics returns the metrics of the definitions labeled with the name of the
+// instance.
+func (i *Instance) Metrics(defs []*MetricConfig) []*Metric {
+	m := make([]*Metric, 0, len(defs))
+
+	for _, d := range defs {
+		m = append(m, d.metric(prometheus.Labels{"instance_name": i.Name}))
+	}
+
+	return m
+}
+
+// instanceStat names the instance in the errors of its stats source.
+type instanceStat struct {
+	name string
+	stat Stat
+}
+
+func (s instanceStat) Now() (string, error) {
+	out, err := s.stat.Now()
+	if err != nil {
+		return "", fmt.Errorf("instance %s: %w", s.name, err)
+	}
+
+	return out, nil
+}
+
+// commandStat runs a command that prints `smtpctl show stats` output, like
+// `smtpctl` of a smtpd in another chroot or container.
+type commandStat struct {
+	args []string
+}
+
+func (s commandStat) Now() (string, error) {
+	out, err := exec.Command(s.args[0], s.args[1:]...).Output() // nolint:gosec
+	if err != nil {
+		return "", fmt.Errorf("could not run %s: %w", s.args[0], err)
+	}
+
+	log.Debug(string(out))
+
+	return string(out), nil
+}
+
+// socketStat reads `smtpctl show stats` output from an unix socket, like one
+// served by `socat UNIX-LISTEN:/run/smtpd-mx.stats,fork EXEC:'smtpctl show stats'`.
+type socketStat struct {
+	path string
+}
+
+func (s socketStat) Now() (string, error) {
+	conn, err := net.DialTimeout("unix", s.path, socketTimeout)
+	if err != nil {
+		return "", fmt.Errorf("could not connect to stats socket: %w", err)
+	}
+	defer conn.Close()
+
+	if err := conn.SetDeadline(time.Now().Add(socketTimeout)); err != nil {
+		return "", err
+	}
+
+	out, err := ioutil.ReadAll(conn)
+	if err != nil {
+		return "", fmt.Errorf("could not read stats socket: %w", err)
+	}
+
+	log.Debug(string(out))
+
+	return string(out), nil
+}
+
+// checkInstances validates the instances of the config.
+func checkInstances(instances []*Instance) error {
+	names := map[string]bool{}
+
+	for _, i := range instances {
+		if i.Name == "" {
+			return fmt.Errorf("instance without name")
+		}
+
+		if names[i.Name] {
+			return fmt.Errorf("instance %s: duplicate name", i.Name)
+		}
+
+		names[i.Name] = true
+
+		sources := 0
+
+		for _, set := range []bool{len(i.Command) > 0, i.Socket != "", i.File != ""} {
+			if set {
+				sources++
+			}
+		}
+
+		if sources > 1 {
+			return fmt.Errorf("instance %s: command, socket and file are exclusive", i.Name)
+		}
+	}
+
+	return nil
+}
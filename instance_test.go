@@ -0,0 +1,97 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInstancesCollectIndependently(t *testing.T) {
+	assert := assert.New(t)
+	reg := prometheus.NewRegistry()
+	i := initer{}
+
+	mx := (&Instance{Name: "mx"}).Metrics(defaultMetrics())
+	submission := (&Instance{Name: "submission"}).Metrics(defaultMetrics())
+
+	for _, m := range append(mx, submission...) {
+		m.Registerer = reg
+		i.Metric(m)
+	}
+
+	mxStat := new(MockStat)
+	mxStat.On("Now").Return(testStats, nil)
+
+	submissionStat := new(MockStat)
+	submissionStat.On("Now").Return("", errors.New("smtpctl: connect: No such file or directory"))
+
+	assert.Nil(collectValues(mx, mxStat))
+	assert.NotNil(collectValues(submission, submissionStat))
+
+	expected := `
+# HELP smtpd_delivery_ok Shows how often a delivery was ok.
+# TYPE smtpd_delivery_ok counter
+smtpd_delivery_ok{instance_name="mx"} 42
+smtpd_delivery_ok{instance_name="submission"} 0
+`
+	assert.Nil(testutil.GatherAndCompare(reg, strings.NewReader(expected), "smtpd_delivery_ok"))
+}
+
+func TestInstanceStat(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "smtpd_exporter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "mx.stats")
+
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			conn.Write([]byte(testStats)) // nolint:errcheck
+			conn.Close()
+		}
+	}()
+
+	out, err := (&Instance{Name: "mx", Socket: path}).Stat().Now()
+	assert.Nil(err)
+	assert.Equal(testStats, out)
+
+	out, err = (&Instance{Name: "mx", Command: []string{"echo", "scheduler.delivery.ok=1"}}).Stat().Now()
+	assert.Nil(err)
+	assert.Equal("scheduler.delivery.ok=1\n", out)
+
+	_, err = (&Instance{Name: "mx", Socket: filepath.Join(dir, "missing.stats")}).Stat().Now()
+	assert.NotNil(err)
+	assert.Contains(err.Error(), "instance mx:")
+}
+
+func TestCheckInstances(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Nil(checkInstances([]*Instance{{Name: "mx"}, {Name: "submission", Socket: "/run/submission.stats"}}))
+	assert.NotNil(checkInstances([]*Instance{{}}))
+	assert.NotNil(checkInstances([]*Instance{{Name: "mx"}, {Name: "mx"}}))
+	assert.NotNil(checkInstances([]*Instance{{Name: "mx", Socket: "/run/mx.stats", Command: []string{"smtpctl"}}}))
+}
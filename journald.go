@@ -0,0 +1,308 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// cursorSaveInterval is how often the journal cursor gets written at most.
+	cursorSaveInterval = time.Second
+	// journalctlRestartDelay is the wait before journalctl gets started again.
+	journalctlRestartDelay = 5 * time.Second
+)
+
+// errTooLong is returned for a journal entry larger than maxSyslogSize.
+// nolint:gochecknoglobals
+var errTooLong = errors.New("journal entry too long")
+
+// journalEntry holds the fields of a `journalctl -o json` entry we need.
+type journalEntry struct {
+	Cursor     string          `json:"__CURSOR"`
+	Realtime   string          `json:"__REALTIME_TIMESTAMP"`
+	PID        string          `json:"_PID"`
+	Hostname   string          `json:"_HOSTNAME"`
+	Identifier string          `json:"SYSLOG_IDENTIFIER"`
+	Message    json.RawMessage `json:"MESSAGE"`
+}
+
+// message returns MESSAGE, which is a string or, if it is no valid UTF-8, an
+// array of bytes.
+func (e *journalEntry) message() (string, error) {
+	var s string
+	if err := json.Unmarshal(e.Message, &s); err == nil {
+		return s, nil
+	}
+
+	var ints []int
+	if err := json.Unmarshal(e.Message, &ints); err != nil {
+		return "", fmt.Errorf("could not decode MESSAGE: %s", string(e.Message))
+	}
+
+	b := make([]byte, 0, len(ints))
+	for _, i := range ints {
+		b = append(b, byte(i))
+	}
+
+	return string(b), nil
+}
+
+// time converts the microseconds since epoch of __REALTIME_TIMESTAMP.
+func (e *journalEntry) time() (time.Time, error) {
+	usec, err := strconv.ParseInt(e.Realtime, 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("could not parse __REALTIME_TIMESTAMP: %s", e.Realtime)
+	}
+
+	return time.Unix(0, usec*int64(time.Microsecond)), nil
+}
+
+// JournalReader reads the JSON export of journalctl and passes the smtpd
+// messages as log events to the handler. If CursorFile is set, the cursor of
+// the last read entry is stored there so a restart resumes after it.
+type JournalReader struct {
+	Handler    EventHandler
+	CursorFile string
+
+	cursor string
+	saved  time.Time
+}
+
+// Follow runs `journalctl -o json --follow -u unit` and reads its output. When
+// journalctl exits it gets started again after the last read entry, Follow
+// only returns if journalctl can not be run at all.
+func (j *JournalReader) Follow(unit string) error {
+	for {
+		err := j.follow(unit)
+		if errors.Is(err, exec.ErrNotFound) {
+			return err
+		}
+
+		log.WithFields(log.Fields{"error": err}).Error("journalctl stopped, restarting")
+		time.Sleep(journalctlRestartDelay)
+	}
+}
+
+func (j *JournalReader) follow(unit string) error {
+	cmd := exec.Command("journalctl", j.args(unit)...) // nolint:gosec
+	cmd.Stderr = os.Stderr
+
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return fmt.Errorf("could not get journalctl output: %w", err)
+	}
+
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("could not start journalctl: %w", err)
+	}
+
+	readErr := j.Read(out)
+
+	// journalctl keeps following when reading failed
+	_ = cmd.Process.Kill()
+
+	if err := cmd.Wait(); err != nil && readErr == nil {
+		return fmt.Errorf("journalctl failed: %w", err)
+	}
+
+	if readErr != nil {
+		return readErr
+	}
+
+	return errors.New("journalctl exited")
+}
+
+// args builds the journalctl arguments and resumes after a stored cursor.
+func (j *JournalReader) args(unit string) []string {
+	args := []string{"-o", "json", "--follow", "-u", unit}
+
+	cursor := j.cursor
+	if cursor == "" {
+		var err error
+		if cursor, err = j.loadCursor(); err != nil {
+			log.WithFields(log.Fields{"file": j.CursorFile, "error": err}).Debug("could not load journal cursor")
+		}
+	}
+
+	if cursor == "" {
+		// no checkpoint, only follow new entries
+		return append(args, "--lines=0")
+	}
+
+	return append(args, "--after-cursor="+cursor)
+}
+
+// Read decodes one JSON entry per line till r is exhausted. Entries larger
+// than maxSyslogSize are skipped.
+func (j *JournalReader) Read(r io.Reader) error {
+	br := bufio.NewReader(r)
+
+	for {
+		line, err := readJournalLine(br)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+
+		if errors.Is(err, errTooLong) {
+			log.Debug("skipping oversized journal entry")
+			continue
+		}
+
+		if err != nil {
+			j.checkpoint()
+			return fmt.Errorf("could not read journal: %w", err)
+		}
+
+		var e journalEntry
+		if err := json.Unmarshal(line, &e); err != nil {
+			log.WithFields(log.Fields{"entry": string(line), "error": err}).Debug("could not decode journal entry")
+			continue
+		}
+
+		j.handle(&e)
+
+		j.cursor = e.Cursor
+		if time.Since(j.saved) >= cursorSaveInterval {
+			j.checkpoint()
+		}
+	}
+
+	j.checkpoint()
+
+	return nil
+}
+
+// readJournalLine reads a line without its newline. A line longer than
+// maxSyslogSize is read to its end and errTooLong returned.
+func readJournalLine(br *bufio.Reader) ([]byte, error) {
+	var line []byte
+
+	tooLong := false
+
+	for {
+		part, isPrefix, err := br.ReadLine()
+		if err != nil {
+			if errors.Is(err, io.EOF) && len(line) > 0 && !tooLong {
+				return line, nil
+			}
+
+			return nil, err
+		}
+
+		if !tooLong {
+			line = append(line, part...)
+			if len(line) > maxSyslogSize {
+				tooLong, line = true, nil
+			}
+		}
+
+		if !isPrefix {
+			break
+		}
+	}
+
+	if tooLong {
+		return nil, errTooLong
+	}
+
+	return line, nil
+}
+
+func (j *JournalReader) handle(e *journalEntry) {
+	if e.Identifier != "" && e.Identifier != "smtpd" {
+		return
+	}
+
+	msg, err := e.message()
+	if err != nil {
+		log.WithFields(log.Fields{"error": err}).Debug("could not get journal message")
+		return
+	}
+
+	t, err := e.time()
+	if err != nil {
+		log.WithFields(log.Fields{"error": err}).Debug("could not get journal timestamp")
+		return
+	}
+
+	ev, err := parseLogMessage(t, msg)
+	if err != nil {
+		if err != errNoEvent {
+			log.WithFields(log.Fields{"message": msg, "error": err}).Debug("could not parse message")
+		}
+
+		return
+	}
+
+	ev.Host = e.Hostname
+	ev.PID = atoi(e.PID)
+
+	j.Handler.Handle(ev)
+}
+
+// checkpoint stores the current cursor.
+func (j *JournalReader) checkpoint() {
+	if j.CursorFile == "" || j.cursor == "" {
+		return
+	}
+
+	if err := writeFileAtomic(j.CursorFile, []byte(j.cursor+"\n"), 0o600); err != nil { // nolint:gomnd
+		log.WithFields(log.Fields{"file": j.CursorFile, "error": err}).Error("could not save journal cursor")
+		return
+	}
+
+	j.saved = time.Now()
+}
+
+func (j *JournalReader) loadCursor() (string, error) {
+	if j.CursorFile == "" {
+		return "", nil
+	}
+
+	b, err := ioutil.ReadFile(j.CursorFile)
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(string(b)), nil
+}
+
+// writeFileAtomic writes to a temp file in the same directory and renames it,
+// so readers never see a partially written file.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	f, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+
+	if err := os.Chmod(f.Name(), perm); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+
+	return os.Rename(f.Name(), path)
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJournalReader(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "smtpd_exporter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cursorFile := filepath.Join(dir, "cursor")
+	r := make(eventRecorder, 10) //nolint:gomnd
+	j := &JournalReader{Handler: r, CursorFile: cursorFile}
+
+	// the oversized entry after the first one gets skipped, the next one has
+	// its MESSAGE as byte array and the last one is from another program
+	out := strings.Join([]string{
+		`{"__CURSOR":"s=1;i=1","__REALTIME_TIMESTAMP":"1582884000000000","_PID":"123","_HOSTNAME":"mx",` +
+			`"SYSLOG_IDENTIFIER":"smtpd","MESSAGE":"8e5a1b2c3d4e5f60 smtp message msgid=a1b2c3d4 nrcpt=1"}`,
+		`{"__CURSOR":"s=1;i=9","MESSAGE":"` + strings.Repeat("x", 2*maxSyslogSize) + `"}`,
+		`{"__CURSOR":"s=1;i=2","__REALTIME_TIMESTAMP":"1582884001500000","_PID":"123","_HOSTNAME":"mx",` +
+			`"SYSLOG_IDENTIFIER":"smtpd","MESSAGE":[56,101,53,97,49,98,50,99,51,100,52,101,53,102,54,49,32,` +
+			`109,116,97,32,100,101,108,105,118,101,114,121,32,114,101,115,117,108,116,61,79,107]}`,
+		`{"__CURSOR":"s=1;i=3","__REALTIME_TIMESTAMP":"1582884002000000","_PID":"1","_HOSTNAME":"mx",` +
+			`"SYSLOG_IDENTIFIER":"systemd","MESSAGE":"Started smtpd."}`,
+	}, "\n")
+
+	assert.Nil(j.Read(strings.NewReader(out)))
+	close(r)
+
+	ev := <-r
+	assert.Equal("message", ev.Event)
+	assert.Equal("mx", ev.Host)
+	assert.Equal(123, ev.PID)
+	assert.True(time.Unix(1582884000, 0).Equal(ev.Time))
+
+	ev = <-r
+	assert.Equal("delivery", ev.Event)
+	assert.Equal("Ok", ev.Fields["result"])
+	assert.True(time.Unix(1582884001, 500000000).Equal(ev.Time))
+
+	assert.Nil(<-r)
+
+	cursor, err := ioutil.ReadFile(cursorFile)
+	assert.Nil(err)
+	assert.Equal("s=1;i=3\n", string(cursor))
+
+	// a restart resumes after the checkpoint
+	assert.Equal(
+		[]string{"-o", "json", "--follow", "-u", "smtpd", "--after-cursor=s=1;i=3"},
+		(&JournalReader{CursorFile: cursorFile}).args("smtpd"),
+	)
+	assert.Equal(
+		[]string{"-o", "json", "--follow", "-u", "smtpd", "--lines=0"},
+		(&JournalReader{CursorFile: filepath.Join(dir, "missing")}).args("smtpd"),
+	)
+}
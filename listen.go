@@ -0,0 +1,234 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+)
+
+// listenFdsStart is the first file descriptor passed by systemd.
+const listenFdsStart = 3
+
+// ListenAddress is an address of --web.listen-address, like localhost:9967,
+// [::1]:9967 or unix:/run/smtpd_exporter.sock,mode=0660,owner=root:prometheus.
+type ListenAddress struct {
+	Network string
+	Address string
+	// Mode and the owner are set on unix sockets.
+	Mode  os.FileMode
+	User  string
+	Group string
+}
+
+// parseListenAddress parses a --web.listen-address value.
+func parseListenAddress(s string) (ListenAddress, error) {
+	if !strings.HasPrefix(s, "unix:") {
+		if _, _, err := net.SplitHostPort(s); err != nil {
+			return ListenAddress{}, fmt.Errorf("invalid listen address %s: %w", s, err)
+		}
+
+		return ListenAddress{Network: "tcp", Address: s}, nil
+	}
+
+	parts := strings.Split(strings.TrimPrefix(s, "unix:"), ",")
+	a := ListenAddress{Network: "unix", Address: parts[0]}
+
+	if a.Address == "" {
+		return ListenAddress{}, fmt.Errorf("invalid listen address %s: missing path", s)
+	}
+
+	for _, opt := range parts[1:] {
+		i := strings.Index(opt, "=")
+		if i < 0 {
+			return ListenAddress{}, fmt.Errorf("invalid listen address %s: option %s without value", s, opt)
+		}
+
+		switch key, value := opt[:i], opt[i+1:]; key {
+		case "mode":
+			mode, err := strconv.ParseUint(value, 8, 32)
+			if err != nil || mode > 0o777 {
+				return ListenAddress{}, fmt.Errorf("invalid listen address %s: invalid mode %s", s, value)
+			}
+
+			a.Mode = os.FileMode(mode)
+		case "owner":
+			a.User = value
+			if j := strings.Index(value, ":"); j >= 0 {
+				a.User, a.Group = value[:j], value[j+1:]
+			}
+		default:
+			return ListenAddress{}, fmt.Errorf("invalid listen address %s: unknown option %s", s, key)
+		}
+	}
+
+	return a, nil
+}
+
+func (a ListenAddress) String() string {
+	if a.Network == "unix" {
+		return "unix:" + a.Address
+	}
+
+	return a.Address
+}
+
+// removeStaleSocket removes the unix socket an earlier run left behind, other
+// files are kept.
+func removeStaleSocket(path string) error {
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		if err := os.Remove(path); err != nil {
+			return fmt.Errorf("could not remove stale socket: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// Listen listens on the address. A stale unix socket of an earlier run gets
+// removed first.
+func (a ListenAddress) Listen() (net.Listener, error) {
+	if a.Network != "unix" {
+		return net.Listen(a.Network, a.Address)
+	}
+
+	if err := removeStaleSocket(a.Address); err != nil {
+		return nil, err
+	}
+
+	l, err := net.Listen(a.Network, a.Address)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := a.setOwner(); err != nil {
+		l.Close()
+		return nil, err
+	}
+
+	return l, nil
+}
+
+// setOwner sets the mode and owner of a unix socket.
+func (a ListenAddress) setOwner() error {
+	if a.Mode != 0 {
+		if err := os.Chmod(a.Address, a.Mode); err != nil {
+			return fmt.Errorf("could not set socket mode: %w", err)
+		}
+	}
+
+	if a.User == "" && a.Group == "" {
+		return nil
+	}
+
+	uid, gid := -1, -1
+
+	if a.User != "" {
+		u, err := user.Lookup(a.User)
+		if err != nil {
+			return fmt.Errorf("could not set socket owner: %w", err)
+		}
+
+		if uid, err = strconv.Atoi(u.Uid); err != nil {
+			return fmt.Errorf("could not set socket owner: %w", err)
+		}
+	}
+
+	if a.Group != "" {
+		g, err := user.LookupGroup(a.Group)
+		if err != nil {
+			return fmt.Errorf("could not set socket owner: %w", err)
+		}
+
+		if gid, err = strconv.Atoi(g.Gid); err != nil {
+			return fmt.Errorf("could not set socket owner: %w", err)
+		}
+	}
+
+	if err := os.Chown(a.Address, uid, gid); err != nil {
+		return fmt.Errorf("could not set socket owner: %w", err)
+	}
+
+	return nil
+}
+
+// systemdListeners returns the sockets passed by systemd socket activation,
+// none without LISTEN_FDS or when they are meant for another process.
+func systemdListeners() ([]net.Listener, error) {
+	fds := os.Getenv("LISTEN_FDS")
+	if fds == "" {
+		return nil, nil
+	}
+
+	if pid := os.Getenv("LISTEN_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return nil, nil
+	}
+
+	n, err := strconv.Atoi(fds)
+	if err != nil || n < 1 {
+		return nil, fmt.Errorf("invalid LISTEN_FDS: %s", fds)
+	}
+
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+
+	// do not pass the sockets on to the commands we run
+	for _, env := range []string{"LISTEN_FDS", "LISTEN_PID", "LISTEN_FDNAMES"} {
+		os.Unsetenv(env)
+	}
+
+	listeners := make([]net.Listener, 0, n)
+
+	for i := 0; i < n; i++ {
+		name := fmt.Sprintf("LISTEN_FD_%d", listenFdsStart+i)
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+
+		f := os.NewFile(uintptr(listenFdsStart+i), name)
+
+		l, err := net.FileListener(f)
+		f.Close()
+
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+
+			return nil, fmt.Errorf("could not use systemd socket %s: %w", name, err)
+		}
+
+		listeners = append(listeners, l)
+	}
+
+	return listeners, nil
+}
+
+// webListeners returns the systemd sockets or else listens on the addresses.
+func webListeners(addrs []ListenAddress) ([]net.Listener, error) {
+	listeners, err := systemdListeners()
+	if err != nil || len(listeners) > 0 {
+		return listeners, err
+	}
+
+	if len(addrs) == 0 {
+		return nil, errors.New("no address to listen on")
+	}
+
+	for _, a := range addrs {
+		l, err := a.Listen()
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+
+			return nil, fmt.Errorf("could not listen on %s: %w", a, err)
+		}
+
+		listeners = append(listeners, l)
+	}
+
+	return listeners, nil
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseListenAddress(t *testing.T) {
+	tests := []struct {
+		value string
+		addr  ListenAddress
+		err   bool
+	}{
+		{"localhost:9967", ListenAddress{Network: "tcp", Address: "localhost:9967"}, false},
+		{":9967", ListenAddress{Network: "tcp", Address: ":9967"}, false},
+		{"[::1]:9967", ListenAddress{Network: "tcp", Address: "[::1]:9967"}, false},
+		{"::1:9967", ListenAddress{}, true},
+		{"localhost", ListenAddress{}, true},
+		{"unix:/run/smtpd_exporter.sock", ListenAddress{Network: "unix", Address: "/run/smtpd_exporter.sock"}, false},
+		{
+			"unix:/run/smtpd_exporter.sock,mode=0660,owner=root:prometheus",
+			ListenAddress{Network: "unix", Address: "/run/smtpd_exporter.sock", Mode: 0o660, User: "root", Group: "prometheus"},
+			false,
+		},
+		{
+			"unix:/run/smtpd_exporter.sock,owner=:prometheus",
+			ListenAddress{Network: "unix", Address: "/run/smtpd_exporter.sock", Group: "prometheus"},
+			false,
+		},
+		{"unix:", ListenAddress{}, true},
+		{"unix:/run/smtpd_exporter.sock,mode=0999", ListenAddress{}, true},
+		{"unix:/run/smtpd_exporter.sock,mode", ListenAddress{}, true},
+		{"unix:/run/smtpd_exporter.sock,backlog=5", ListenAddress{}, true},
+	}
+
+	for _, test := range tests {
+		a, err := parseListenAddress(test.value)
+		assert.Equal(t, test.err, err != nil, test.value)
+		assert.Equal(t, test.addr, a, test.value)
+	}
+}
+
+func TestListenUnix(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "listen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "smtpd_exporter.sock")
+	a, err := parseListenAddress("unix:" + path + ",mode=0600")
+	assert.Nil(err)
+
+	for i := 0; i < 2; i++ {
+		l, err := a.Listen()
+		if !assert.Nil(err) {
+			return
+		}
+
+		fi, err := os.Stat(path)
+		assert.Nil(err)
+		assert.Equal(os.FileMode(0o600), fi.Mode().Perm())
+
+		// leave the socket behind like a killed process does
+		l.(*net.UnixListener).SetUnlinkOnClose(false)
+		l.Close()
+	}
+
+	// a file that is no socket stays
+	assert.Nil(os.Remove(path))
+	assert.Nil(ioutil.WriteFile(path, nil, 0o600))
+	_, err = a.Listen()
+	assert.NotNil(err)
+}
+
+func TestSystemdListeners(t *testing.T) {
+	assert := assert.New(t)
+
+	defer os.Unsetenv("LISTEN_FDS")
+	defer os.Unsetenv("LISTEN_PID")
+
+	l, err := systemdListeners()
+	assert.Nil(err)
+	assert.Nil(l)
+
+	// meant for another process
+	os.Setenv("LISTEN_FDS", "1")
+	os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()+1))
+
+	l, err = systemdListeners()
+	assert.Nil(err)
+	assert.Nil(l)
+
+	os.Setenv("LISTEN_FDS", "none")
+	os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+
+	_, err = systemdListeners()
+	assert.NotNil(err)
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// errNoEvent is returned for log lines that are not OpenSMTPD session events.
+var errNoEvent = errors.New("not an opensmtpd event")
+
+// nolint:gochecknoglobals
+var (
+	sessionRe = regexp.MustCompile(`^[0-9a-f]{16}$`)
+	// matches "Jan  2 15:04:05 host smtpd[123]: message".
+	bsdLineRe = regexp.MustCompile(`^([A-Z][a-z]{2}\s+\d{1,2} \d{2}:\d{2}:\d{2}) (\S+) ([^\[\s:]+)(?:\[(\d+)\])?: (.*)$`)
+	// matches "2020-01-02T15:04:05.123+01:00 host smtpd[123]: message".
+	isoLineRe = regexp.MustCompile(`^(\d{4}-\d{2}-\d{2}T\S+) (\S+) ([^\[\s:]+)(?:\[(\d+)\])?: (.*)$`)
+)
+
+// LogEvent is a parsed OpenSMTPD log line like
+// "8e5a1b2c3d4e5f60 mta delivery evpid=... result=Ok".
+type LogEvent struct {
+	Time      time.Time
+	Host      string
+	PID       int
+	Session   string
+	Subsystem string
+	Event     string
+	Fields    map[string]string
+}
+
+// EventHandler gets every parsed log event.
+type EventHandler interface {
+	Handle(*LogEvent)
+}
+
+// SyslogLine is a log line split into its syslog header and message.
+type SyslogLine struct {
+	Time    time.Time
+	Host    string
+	Program string
+	PID     int
+	Message string
+}
+
+// parseSyslogLine splits a line from a maillog file into its parts. BSD
+// timestamps carry no year, so the year of ref is used and the previous one if
+// that would put the line more than a day after ref.
+func parseSyslogLine(line string, ref time.Time) (*SyslogLine, error) {
+	if match := isoLineRe.FindStringSubmatch(line); match != nil {
+		t, err := time.Parse(time.RFC3339Nano, match[1])
+		if err != nil {
+			return nil, fmt.Errorf("could not parse timestamp: %s", match[1])
+		}
+
+		return newSyslogLine(t, match[2:])
+	}
+
+	match := bsdLineRe.FindStringSubmatch(line)
+	if match == nil {
+		return nil, fmt.Errorf("could not parse syslog line: %s", line)
+	}
+
+	t, err := time.ParseInLocation(time.Stamp, match[1], ref.Location())
+	if err != nil {
+		return nil, fmt.Errorf("could not parse timestamp: %s", match[1])
+	}
+
+	return newSyslogLine(withYear(t, ref), match[2:])
+}
+
+// newSyslogLine builds a SyslogLine out of host, program, pid and message.
+func newSyslogLine(t time.Time, parts []string) (*SyslogLine, error) {
+	l := &SyslogLine{Time: t, Host: parts[0], Program: parts[1], Message: parts[3]}
+
+	if parts[2] != "" {
+		pid, err := strconv.Atoi(parts[2])
+		if err != nil {
+			return nil, fmt.Errorf("could not convert pid to int: %s", parts[2])
+		}
+
+		l.PID = pid
+	}
+
+	return l, nil
+}
+
+// withYear puts a yearless timestamp into the year of ref.
+func withYear(t, ref time.Time) time.Time {
+	t = time.Date(ref.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), 0, ref.Location())
+	if t.Sub(ref) > 24*time.Hour {
+		t = t.AddDate(-1, 0, 0)
+	}
+
+	return t
+}
+
+// parseLogLine parses a full maillog line. Lines of other programs than smtpd
+// return errNoEvent.
+func parseLogLine(line string, ref time.Time) (*LogEvent, error) {
+	l, err := parseSyslogLine(line, ref)
+	if err != nil {
+		return nil, err
+	}
+
+	if l.Program != "smtpd" {
+		return nil, errNoEvent
+	}
+
+	ev, err := parseLogMessage(l.Time, l.Message)
+	if err != nil {
+		return nil, err
+	}
+
+	ev.Host = l.Host
+	ev.PID = l.PID
+
+	return ev, nil
+}
+
+// parseLogMessage parses the message part of a smtpd log line.
+func parseLogMessage(t time.Time, msg string) (*LogEvent, error) {
+	tokens := splitFields(msg)
+
+	// session id, subsystem and event are the minimum
+	minTokens := 3
+	if len(tokens) < minTokens || !sessionRe.MatchString(tokens[0]) {
+		return nil, errNoEvent
+	}
+
+	ev := &LogEvent{
+		Time:      t,
+		Session:   tokens[0],
+		Subsystem: tokens[1],
+		Event:     tokens[2],
+		Fields:    map[string]string{},
+	}
+
+	for _, token := range tokens[minTokens:] {
+		i := strings.IndexByte(token, '=')
+		if i < 1 {
+			continue
+		}
+
+		ev.Fields[token[:i]] = strings.Trim(token[i+1:], `"`)
+	}
+
+	return ev, nil
+}
+
+// splitFields splits a log message on spaces but keeps double quoted values
+// like relay="192.0.2.1 (mx.example.org)" together.
+func splitFields(msg string) []string {
+	var (
+		tokens []string
+		cur    strings.Builder
+		quoted bool
+	)
+
+	for _, r := range msg {
+		switch {
+		case r == '"':
+			quoted = !quoted
+
+			cur.WriteRune(r)
+		case r == ' ' && !quoted:
+			if cur.Len() > 0 {
+				tokens = append(tokens, cur.String())
+				cur.Reset()
+			}
+		default:
+			cur.WriteRune(r)
+		}
+	}
+
+	if cur.Len() > 0 {
+		tokens = append(tokens, cur.String())
+	}
+
+	return tokens
+}
+
+// atoi converts a log field to int and returns 0 if it is no number.
+func atoi(s string) int {
+	i, err := strconv.Atoi(s)
+	if err != nil {
+		return 0
+	}
+
+	return i
+}
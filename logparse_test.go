@@ -0,0 +1,87 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseLogLine(t *testing.T) {
+	assert := assert.New(t)
+	ref := time.Date(2020, time.March, 1, 12, 0, 0, 0, time.UTC)
+	tables := []struct {
+		line      string
+		time      time.Time
+		session   string
+		subsystem string
+		event     string
+		fields    map[string]string
+		err       error
+	}{
+		{
+			`Feb 28 10:00:02 mx smtpd[123]: 8e5a1b2c3d4e5f61 mta delivery evpid=a1b2c3d4e5f60718 ` +
+				`from=<a@example.org> to=<b@example.com> relay="192.0.2.1 (mx.example.com)" delay=1s result="Ok" ` +
+				`stat="250 2.0.0 Ok: queued"`,
+			time.Date(2020, time.February, 28, 10, 0, 2, 0, time.UTC),
+			"8e5a1b2c3d4e5f61", "mta", "delivery",
+			map[string]string{
+				"evpid":  "a1b2c3d4e5f60718",
+				"from":   "<a@example.org>",
+				"to":     "<b@example.com>",
+				"relay":  "192.0.2.1 (mx.example.com)",
+				"delay":  "1s",
+				"result": "Ok",
+				"stat":   "250 2.0.0 Ok: queued",
+			},
+			nil,
+		},
+		{
+			`2020-02-28T10:00:01.5+00:00 mx smtpd[123]: 8e5a1b2c3d4e5f60 smtp message msgid=a1b2c3d4 size=1234 nrcpt=1 proto=ESMTP`,
+			time.Date(2020, time.February, 28, 10, 0, 1, 500000000, time.FixedZone("", 0)),
+			"8e5a1b2c3d4e5f60", "smtp", "message",
+			map[string]string{"msgid": "a1b2c3d4", "size": "1234", "nrcpt": "1", "proto": "ESMTP"},
+			nil,
+		},
+		{
+			// a year boundary in between
+			`Dec 31 23:59:59 mx smtpd[123]: 8e5a1b2c3d4e5f60 smtp disconnected reason=quit`,
+			time.Date(2019, time.December, 31, 23, 59, 59, 0, time.UTC),
+			"8e5a1b2c3d4e5f60", "smtp", "disconnected",
+			map[string]string{"reason": "quit"},
+			nil,
+		},
+		{
+			`Feb 28 10:00:00 mx smtpd[123]: info: OpenSMTPD 6.6.4 starting`,
+			time.Time{}, "", "", "", nil,
+			errNoEvent,
+		},
+		{
+			`Feb 28 10:00:00 mx postfix/smtpd[123]: connect from unknown[192.0.2.1]`,
+			time.Time{}, "", "", "", nil,
+			errNoEvent,
+		},
+	}
+
+	for _, table := range tables {
+		ev, err := parseLogLine(table.line, ref)
+		if table.err != nil {
+			assert.Equal(table.err, err)
+			continue
+		}
+
+		assert.Nil(err)
+		assert.True(table.time.Equal(ev.Time), ev.Time)
+		assert.Equal("mx", ev.Host)
+		assert.Equal(123, ev.PID)
+		assert.Equal(table.session, ev.Session)
+		assert.Equal(table.subsystem, ev.Subsystem)
+		assert.Equal(table.event, ev.Event)
+		assert.Equal(table.fields, ev.Fields)
+	}
+}
+
+func TestParseLogLineInvalid(t *testing.T) {
+	_, err := parseLogLine("this is no syslog line", time.Now())
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// handleLine parses a maillog line and passes it to the handler.
+func handleLine(h EventHandler) func(string) {
+	return func(line string) {
+		ev, err := parseLogLine(line, time.Now())
+		if err != nil {
+			if err != errNoEvent {
+				log.WithFields(log.Fields{"line": line, "error": err}).Debug("could not parse line")
+			}
+
+			return
+		}
+
+		h.Handle(ev)
+	}
+}
+
+// tailFile follows a log file like "tail -F" does and calls fn for every new
+// line. It starts at the end of the file and reopens it after it got rotated
+// or truncated.
+func tailFile(path string, poll time.Duration, fn func(string)) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("could not open log file: %w", err)
+	}
+
+	if _, err := f.Seek(0, io.SeekEnd); err != nil {
+		f.Close()
+		return fmt.Errorf("could not seek log file: %w", err)
+	}
+
+	r := bufio.NewReader(f)
+
+	var partial string
+
+	for {
+		line, err := r.ReadString('\n')
+
+		switch {
+		case err == nil:
+			fn(strings.TrimRight(partial+line, "\r\n"))
+
+			partial = ""
+
+			continue
+		case err != io.EOF:
+			f.Close()
+			return fmt.Errorf("could not read log file: %w", err)
+		}
+
+		partial += line
+
+		time.Sleep(poll)
+
+		reopen, err := rotated(f, path)
+		if err != nil {
+			log.WithFields(log.Fields{"file": path, "error": err}).Debug("could not check rotation")
+			continue
+		}
+
+		if !reopen {
+			continue
+		}
+
+		log.WithFields(log.Fields{"file": path}).Debug("reopen log file")
+
+		nf, err := os.Open(path)
+		if err != nil {
+			log.WithFields(log.Fields{"file": path, "error": err}).Error("could not reopen log file")
+			continue
+		}
+
+		f.Close()
+
+		f = nf
+		partial = ""
+
+		r.Reset(f)
+	}
+}
+
+// rotated checks if the path points to another file than f or f got truncated.
+func rotated(f *os.File, path string) (bool, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return false, err
+	}
+
+	cur, err := f.Stat()
+	if err != nil {
+		return false, err
+	}
+
+	if !os.SameFile(fi, cur) {
+		return true, nil
+	}
+
+	pos, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return false, err
+	}
+
+	return fi.Size() < pos, nil
+}
@@ -1,14 +1,22 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
+	"net"
 	"net/http"
 	"os"
 	"os/exec"
+	"os/signal"
 	"regexp"
+	"sort"
 	"strconv"
+	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
@@ -20,7 +28,16 @@ import (
 //go:generate mockery -name Stat -inpkg
 //go:generate mockery -name Initializer -inpkg
 
-const intervalTime = 1
+const (
+	intervalTime         = 1
+	defaultListenAddress = "localhost:9967"
+	// shutdownTimeout limits waiting for the running requests on shutdown.
+	shutdownTimeout = 30 * time.Second
+	// playpenOID is netSnmpPlaypen.25, only meant for trying the agentx
+	// subagent out. It has to be replaced by an oid below the enterprise
+	// number of the site for real use.
+	playpenOID = "1.3.6.1.4.1.8072.9999.9999.25"
+)
 
 // nolint:gochecknoglobals
 var (
@@ -29,8 +46,67 @@ var (
 	version  = flag.Bool("version", false, "version.")
 	debug    = flag.Bool("debug", false, "enable debug.")
 	interval = flag.Duration("interval", intervalTime*time.Second, "seconds to wait before scraping.")
-	port     = flag.Int("port", 9967, "port to listen on.")
-	host     = flag.String("host", "localhost", "host to listen on.")
+
+	listenAddresses = stringsVar("web.listen-address", "address to serve on as host:port, [::1]:port or unix:/path.sock[,mode=0660][,owner=user:group]. can be repeated, defaults to "+defaultListenAddress+". sockets passed by systemd are used instead.")
+	telemetryPath   = flag.String("web.telemetry-path", "/metrics", "path to serve the metrics on.")
+
+	source     = flag.String("source", "exec", "source of the stats: exec runs smtpctl, socket and file read smtpctl output from -source.path, stdin reads snapshots separated by empty lines.")
+	sourcePath = flag.String("source.path", "", "socket or file to read the stats from.")
+	textfile   = flag.String("output.textfile", "", "write the metrics to this .prom file in the textfile collector directory of node_exporter instead of serving them.")
+	once       = flag.Bool("once", false, "collect a single time, write or push the metrics and exit. Without output they get printed.")
+	dumpFormat = flag.String("dump.format", "text", "format of the printed metrics: text, openmetrics or json.")
+	configFile = flag.String("config.file", "", "config file with the smtpd instances and the modules of the /probe endpoint.")
+
+	probeListeners = flag.Bool("probe", false, "probe the listeners of the smtpd config on every scrape.")
+	probeTargets   = stringsVar("probe.listener", "listener to probe as [name=]host:port[,starttls|,smtps]. can be repeated.")
+	probeTimeout   = flag.Duration("probe.timeout", 10*time.Second, "timeout of a listener probe.")
+	probeHelo      = flag.String("probe.helo", "localhost", "name to send with EHLO when probing.")
+	probeInsecure  = flag.Bool("probe.tls-insecure", false, "do not verify certificates when probing.")
+	pushURL        = flag.String("push.url", "", "Pushgateway to push the metrics to instead of serving them.")
+	pushJob        = flag.String("push.job", "smtpd", "job label of the pushed metrics.")
+	pushGrouping   = stringsVar("push.grouping", "grouping label of the pushed metrics as name=value, instance=<hostname> by default. can be repeated.")
+	pushUsername   = flag.String("push.username", "", "username for basic auth at the Pushgateway.")
+	pushPassword   = flag.String("push.password-file", "", "file with the password for basic auth at the Pushgateway.")
+	pushCA         = flag.String("push.tls-ca", "", "ca certificates to verify the Pushgateway with.")
+	pushCert       = flag.String("push.tls-cert", "", "client certificate for the Pushgateway.")
+	pushKey        = flag.String("push.tls-key", "", "key of the client certificate for the Pushgateway.")
+	pushInsecure   = flag.Bool("push.tls-insecure", false, "do not verify the certificate of the Pushgateway.")
+	writeURL       = flag.String("remote-write.url", "", "remote_write receiver to send the metrics to instead of serving them.")
+	writeLabels    = stringsVar("remote-write.label", "label to add to the sent samples as name=value, instance=<hostname> and job=smtpd by default. can be repeated.")
+	writeUsername  = flag.String("remote-write.username", "", "username for basic auth at the remote_write receiver.")
+	writePassword  = flag.String("remote-write.password-file", "", "file with the password for basic auth at the remote_write receiver.")
+	writeBuffer    = flag.Int("remote-write.buffer", 100000, "samples to buffer while the remote_write receiver is unavailable.")
+	writeBatch     = flag.Int("remote-write.batch", 500, "samples to send in one request.")
+	writeRetries   = flag.Int("remote-write.retries", 5, "retries of a failed request before the samples wait for the next interval.")
+	writeTimeout   = flag.Duration("remote-write.timeout", 30*time.Second, "timeout of a remote_write request.")
+	graphiteAddr   = flag.String("graphite.address", "", "graphite host:port to send the stats to in the plaintext protocol.")
+	statsdAddr     = flag.String("statsd.address", "", "statsd host:port to send the stats to.")
+	statsdCounters = flag.Bool("statsd.counters", false, "send the stats to statsd as counters of their increase instead of gauges.")
+	emitPrefix     = flag.String("emit.prefix", "smtpd", "prefix of the graphite and statsd paths.")
+	emitHostname   = flag.String("emit.hostname", "{host}", "hostname part of the graphite and statsd paths, {host} is the short and {fqdn} the full hostname.")
+	influxURL      = flag.String("influxdb.url", "", "influxdb to write the stats to, http(s)://host:8086 for the v2 write api or udp://host:8089.")
+	influxOrg      = flag.String("influxdb.org", "", "influxdb organization to write to.")
+	influxBucket   = flag.String("influxdb.bucket", "smtpd", "influxdb bucket to write to.")
+	influxToken    = flag.String("influxdb.token-file", "", "file with the influxdb api token.")
+	influxBatch    = flag.Int("influxdb.batch", 5000, "lines to write in one request.")
+	influxBuffer   = flag.Int("influxdb.buffer", 100000, "lines to buffer while influxdb is unavailable.")
+	influxRetries  = flag.Int("influxdb.retries", 3, "retries of a failed request before the lines wait for the next collection.")
+	otlpEndpoint   = flag.String("otlp.endpoint", "", "OTLP/HTTP receiver like http://localhost:4318 to export the metrics to instead of serving them.")
+	otlpHeaders    = stringsVar("otlp.header", "header to send to the OTLP receiver as name=value. can be repeated.")
+	otlpInterval   = flag.Duration("otlp.interval", time.Minute, "interval between the OTLP exports.")
+	tlsPKIs        = stringsVar("tls.pki", "certificate to watch as name:cert[:key], instead of the pki entries of the smtpd config. can be repeated.")
+	smtpdConfig    = flag.String("smtpd.config", "/etc/mail/smtpd.conf", "smtpd config to label metrics with listeners and actions.")
+	logFile        = flag.String("log.file", "", "smtpd log file to follow for message metrics.")
+	logSyslog      = flag.String("log.syslog", "", "address to receive smtpd syslog messages on, like udp://:5514, tcp://:5514 or unixgram:///path.sock.")
+	logJournald    = flag.String("log.journald", "", "systemd unit to follow with journalctl or \"-\" to read journalctl json output from stdin.")
+	logCursor      = flag.String("log.journald-cursor", "", "file to checkpoint the journal cursor in.")
+	logMaxMessages = flag.Int("log.max-messages", 10000, "messages to keep in correlation at most.")
+	logMessageTTL  = flag.Duration("log.message-ttl", 96*time.Hour, "time after undelivered messages are dropped from correlation.")
+	agentxSocket   = flag.String("agentx.socket", "", "unix socket of the agentx master agent to serve the stats over snmp with, like /var/agentx/master.")
+	agentxOID      = flag.String("agentx.oid", playpenOID, "oid of the SMTPD-EXPORTER-MIB subtree. the default in the net-snmp playpen is only a placeholder for testing, set an oid below your own enterprise number.")
+	zabbixListen   = flag.String("zabbix.listen", "", "address to answer passive checks of a zabbix server on, like :10050.")
+	zabbixServers  = flag.String("zabbix.allowed-servers", "127.0.0.1,::1", "comma separated addresses and networks of the zabbix servers to answer, like Server= of the zabbix agent.")
+	webConfig      = flag.String("web.config.file", "", "web config file with tls and basic auth settings, read again when it changes.")
 )
 
 // nolint:gochecknoglobals
@@ -50,11 +126,33 @@ var metrics = []*Metric{
 	},
 }
 
+// stringsFlag collects the values of a flag that is given multiple times.
+type stringsFlag []string
+
+func (s *stringsFlag) String() string {
+	return strings.Join(*s, ",")
+}
+
+// Set implements flag.Value.
+func (s *stringsFlag) Set(v string) error {
+	*s = append(*s, v)
+	return nil
+}
+
+// stringsVar defines a flag that can be given multiple times.
+func stringsVar(name, usage string) *stringsFlag {
+	s := &stringsFlag{}
+	flag.Var(s, name, usage)
+
+	return s
+}
+
 // Metric stores a metric to export and all it needed data.
 type Metric struct {
 	Name       string
 	Help       string
 	Regex      string
+	Labels     prometheus.Labels
 	Counter    prometheus.Counter
 	Registerer prometheus.Registerer
 
@@ -134,8 +232,9 @@ func (i initer) Metric(m *Metric) {
 	// init counter
 	m.Counter = prometheus.NewCounter(
 		prometheus.CounterOpts{
-			Name: m.Name,
-			Help: m.Help,
+			Name:        m.Name,
+			Help:        m.Help,
+			ConstLabels: m.Labels,
 		},
 	)
 	if m.Registerer == nil {
@@ -145,16 +244,19 @@ func (i initer) Metric(m *Metric) {
 	m.Registerer.MustRegister(m.Counter)
 }
 
-func collect(interval *time.Duration) {
-	stats := smtpctl{}
-
+// collect collects every interval until ctx is done.
+func collect(ctx context.Context, m []*Metric, stats Stat, interval time.Duration, emitters []Emitter) {
 	for {
-		err := collectValues(metrics, stats)
+		err := collectAndEmit(m, stats, emitters)
 		if err != nil {
 			log.Error(err)
 		}
 
-		time.Sleep(*interval)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
 	}
 }
 
@@ -190,15 +292,260 @@ func collectValues(m []*Metric, stats Stat) error {
 	return nil
 }
 
-// createMetrics iterates over the metrics and initialize the metrics.
-func createMetrics() {
-	i := initer{}
+// newEmitters returns the emitters enabled by flag.
+func newEmitters() ([]Emitter, error) {
+	path := PathTemplate{Prefix: *emitPrefix, Hostname: *emitHostname}
 
-	for _, m := range metrics {
-		log.Debugf("%+v", m)
-		i.Metric(m)
-		log.Debugf("%+v", m)
+	var emitters []Emitter
+
+	if *graphiteAddr != "" {
+		emitters = append(emitters, &GraphiteEmitter{Address: *graphiteAddr, Path: path})
+	}
+
+	if *statsdAddr != "" {
+		emitters = append(emitters, &StatsdEmitter{Address: *statsdAddr, Path: path, Counters: *statsdCounters})
+	}
+
+	if *influxURL != "" {
+		e, err := NewInfluxEmitter(InfluxConfig{
+			URL:        *influxURL,
+			Org:        *influxOrg,
+			Bucket:     *influxBucket,
+			TokenFile:  *influxToken,
+			Timeout:    10 * time.Second,
+			BufferSize: *influxBuffer,
+			BatchSize:  *influxBatch,
+			MinBackoff: time.Second,
+			MaxBackoff: 10 * time.Second,
+			MaxRetries: *influxRetries,
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		emitters = append(emitters, e)
+	}
+
+	return emitters, nil
+}
+
+// closeEmitters sends what the emitters still buffer.
+func closeEmitters(emitters []Emitter) {
+	for _, e := range emitters {
+		if c, ok := e.(io.Closer); ok {
+			if err := c.Close(); err != nil {
+				log.Error(err)
+			}
+		}
+	}
+}
+
+// registerCerts watches the certificates given by flag or the pki entries of
+// the smtpd config.
+func registerCerts(cfg *SmtpdConfig) error {
+	pkis, err := parsePKIFlags(*tlsPKIs)
+	if err != nil {
+		return err
+	}
+
+	if len(pkis) == 0 && cfg != nil {
+		for _, p := range cfg.PKIs {
+			pkis = append(pkis, p)
+		}
+
+		sort.Slice(pkis, func(i, j int) bool { return pkis[i].Name < pkis[j].Name })
+	}
+
+	if len(pkis) == 0 {
+		return nil
+	}
+
+	return prometheus.Register(NewCertCollector(pkis))
+}
+
+// registerProbes probes the listeners given by flag and, if enabled, the ones
+// of the smtpd config.
+func registerProbes(cfg *SmtpdConfig) error {
+	targets, err := parseProbeFlags(*probeTargets)
+	if err != nil {
+		return err
+	}
+
+	if *probeListeners && cfg != nil {
+		targets = append(targets, cfg.probeTargets()...)
+	}
+
+	if len(targets) == 0 {
+		return nil
+	}
+
+	return prometheus.Register(NewProbeCollector(uniqueProbeTargets(targets), ProbeConfig{
+		Timeout:     *probeTimeout,
+		Helo:        *probeHelo,
+		InsecureTLS: *probeInsecure,
+	}))
+}
+
+// writeTextfile writes the metrics to the textfile once and exits, or
+// returns the write loop.
+func writeTextfile() func(ctx context.Context) error {
+	w := NewTextfileWriter(prometheus.DefaultGatherer, *textfile)
+
+	if *once {
+		if err := w.Write(time.Now()); err != nil {
+			log.Fatal(err)
+		}
+
+		os.Exit(0)
+	}
+
+	log.Info(fmt.Sprintf("Beginning to write to %s", *textfile))
+
+	return func(ctx context.Context) error { return w.Run(ctx, *interval) }
+}
+
+// pushMetrics pushes the metrics to the Pushgateway once and exits, or
+// returns the push loop.
+func pushMetrics() func(ctx context.Context) error {
+	p, err := NewPusher(prometheus.DefaultGatherer, PushConfig{
+		URL:          *pushURL,
+		Job:          *pushJob,
+		Grouping:     *pushGrouping,
+		Username:     *pushUsername,
+		PasswordFile: *pushPassword,
+		CAFile:       *pushCA,
+		CertFile:     *pushCert,
+		KeyFile:      *pushKey,
+		InsecureTLS:  *pushInsecure,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *once {
+		if err := p.Push(); err != nil {
+			log.Fatal(err)
+		}
+
+		os.Exit(0)
 	}
+
+	log.Info(fmt.Sprintf("Beginning to push to %s", *pushURL))
+
+	return func(ctx context.Context) error { return p.Run(ctx, *interval) }
+}
+
+// remoteWrite sends the metrics to the remote_write receiver once and exits,
+// or returns the send loop.
+func remoteWrite() func(ctx context.Context) error {
+	w, err := NewRemoteWriter(prometheus.DefaultRegisterer, prometheus.DefaultGatherer, RemoteWriteConfig{
+		URL:          *writeURL,
+		Labels:       *writeLabels,
+		Username:     *writeUsername,
+		PasswordFile: *writePassword,
+		Timeout:      *writeTimeout,
+		BufferSize:   *writeBuffer,
+		BatchSize:    *writeBatch,
+		MinBackoff:   time.Second,
+		MaxBackoff:   time.Minute,
+		MaxRetries:   *writeRetries,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *once {
+		if err := w.Collect(time.Now()); err != nil {
+			log.Fatal(err)
+		}
+
+		if err := w.Flush(); err != nil {
+			log.Fatal(err)
+		}
+
+		os.Exit(0)
+	}
+
+	log.Info(fmt.Sprintf("Beginning to write to %s", *writeURL))
+
+	return func(ctx context.Context) error { return w.Run(ctx, *interval) }
+}
+
+// exportOTLP exports the metrics to the OTLP receiver once and exits, or
+// returns the export loop.
+func exportOTLP() func(ctx context.Context) error {
+	e, err := NewOTLPExporter(prometheus.DefaultGatherer, OTLPConfig{
+		Endpoint: *otlpEndpoint,
+		Headers:  *otlpHeaders,
+		Timeout:  10 * time.Second,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *once {
+		if err := e.Export(time.Now()); err != nil {
+			log.Fatal(err)
+		}
+
+		os.Exit(0)
+	}
+
+	log.Info(fmt.Sprintf("Beginning to export to %s", *otlpEndpoint))
+
+	return func(ctx context.Context) error { return e.Run(ctx, *otlpInterval) }
+}
+
+// dumpMetrics collects a single time, prints the metrics to stdout and exits.
+// A failed collection exits with 1 after printing what got collected.
+func dumpMetrics(config *Config, c *Collectors) {
+	code := 0
+
+	if err := c.Once(config); err != nil {
+		log.Error(err)
+
+		code = 1
+	}
+
+	closeEmitters(c.Emitters)
+
+	if err := dump(os.Stdout, prometheus.DefaultGatherer, *dumpFormat); err != nil {
+		log.Fatal(err)
+	}
+
+	os.Exit(code)
+}
+
+// serveAgentX serves the stats of the source given by flag to the agentx
+// master agent.
+func serveAgentX() {
+	if *source == "stdin" {
+		log.Fatal("agentx can not read stats from stdin")
+	}
+
+	root, err := parseOID(*agentxOID)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *agentxOID == playpenOID {
+		log.WithFields(log.Fields{"oid": *agentxOID}).Warn(
+			"agentx serves the placeholder oid in the net-snmp playpen, set -agentx.oid below your own enterprise number")
+	}
+
+	stats, err := newStat(*source, *sourcePath)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	a := &AgentX{
+		Socket: *agentxSocket,
+		Root:   root,
+		Stats:  stats,
+		Status: commandStat{args: []string{"smtpctl", "show", "status"}},
+	}
+
+	go a.Run()
 }
 
 func main() {
@@ -213,11 +560,320 @@ func main() {
 		log.SetLevel(log.DebugLevel)
 	}
 
-	createMetrics()
+	switch flag.Arg(0) {
+	case "":
+	case "backfill":
+		if err := backfill(flag.Args()[1:]); err != nil {
+			log.Fatal(err)
+		}
 
-	go collect(interval)
+		os.Exit(0)
+	case "check":
+		os.Exit(check(flag.Args()[1:], os.Stdout))
+	case "munin":
+		if err := munin(flag.Args()[1:], os.Stdout); err != nil {
+			log.Fatal(err)
+		}
 
-	http.Handle("/metrics", promhttp.Handler())
-	log.Info(fmt.Sprintf("Beginning to serve on port :%d", *port))
-	log.Fatal(http.ListenAndServe(fmt.Sprintf("%s:%d", *host, *port), nil))
+		os.Exit(0)
+	case "collectd":
+		log.Fatal(collectd(os.Stdout))
+	case "dump":
+		format, err := dumpArgs(flag.Args()[1:], *dumpFormat)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		*dumpFormat = format
+		*once = true
+	default:
+		log.Fatalf("unknown command: %s", flag.Arg(0))
+	}
+
+	if len(*listenAddresses) == 0 {
+		*listenAddresses = stringsFlag{defaultListenAddress}
+	}
+
+	addrs := make([]ListenAddress, 0, len(*listenAddresses))
+
+	for _, s := range *listenAddresses {
+		a, err := parseListenAddress(s)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		addrs = append(addrs, a)
+	}
+
+	if !strings.HasPrefix(*telemetryPath, "/") {
+		log.Fatalf("telemetry path must start with /: %s", *telemetryPath)
+	}
+
+	var config *Config
+
+	if *configFile != "" {
+		c, err := LoadConfig(*configFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		config = c
+	}
+
+	api := NewStatsAPI()
+
+	emitters, err := newEmitters()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	collectors := NewCollectors(api, emitters)
+	prometheus.MustRegister(collectors)
+
+	if *once && *textfile == "" && *pushURL == "" && *writeURL == "" && *otlpEndpoint == "" {
+		dumpMetrics(config, collectors)
+	}
+
+	if *once {
+		err = collectors.Once(config)
+		closeEmitters(emitters)
+	} else {
+		err = collectors.Apply(config)
+	}
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	cfg, err := LoadSmtpdConfig(*smtpdConfig)
+
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		log.WithFields(log.Fields{"error": err}).Debug("metrics will miss listener and action labels")
+	case err != nil:
+		log.WithFields(log.Fields{"error": err}).Warn("metrics will miss listener and action labels")
+	default:
+		prometheus.MustRegister(cfg.ConfigInfo())
+	}
+
+	if err := registerCerts(cfg); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := registerProbes(cfg); err != nil {
+		log.Fatal(err)
+	}
+
+	if *logFile != "" || *logSyslog != "" || *logJournald != "" {
+		c := NewCorrelator(prometheus.DefaultRegisterer, *logMaxMessages, *logMessageTTL)
+		if cfg != nil {
+			c.Labeler = cfg
+		}
+
+		if *logFile != "" {
+			go func() {
+				log.Error(tailFile(*logFile, *interval, handleLine(c)))
+			}()
+		}
+
+		if *logSyslog != "" {
+			s := &SyslogReceiver{Handler: c, Program: "smtpd"}
+
+			go func() {
+				log.Error(s.ListenAndServe(*logSyslog))
+			}()
+		}
+
+		if *logJournald != "" {
+			j := &JournalReader{Handler: c, CursorFile: *logCursor}
+
+			go func() {
+				if *logJournald == "-" {
+					log.Error(j.Read(os.Stdin))
+					return
+				}
+
+				log.Error(j.Follow(*logJournald))
+			}()
+		}
+	}
+
+	if *agentxSocket != "" {
+		serveAgentX()
+	}
+
+	var zabbix *ZabbixAgent
+
+	if *zabbixListen != "" {
+		servers, err := parseZabbixServers(*zabbixServers)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		if len(servers) == 0 {
+			log.Fatal("zabbix.allowed-servers is empty")
+		}
+
+		zabbix = &ZabbixAgent{
+			API:            api,
+			Queue:          commandStat{args: []string{"smtpctl", "show", "queue"}},
+			Config:         cfg,
+			Gatherer:       prometheus.DefaultGatherer,
+			AllowedServers: servers,
+		}
+	}
+
+	var run func(ctx context.Context) error
+
+	switch {
+	case *textfile != "":
+		run = writeTextfile()
+	case *pushURL != "":
+		run = pushMetrics()
+	case *writeURL != "":
+		run = remoteWrite()
+	case *otlpEndpoint != "":
+		run = exportOTLP()
+	}
+
+	if run != nil {
+		if err := runUntilStopped(withZabbix(run, zabbix, *zabbixListen), NewReloader(*configFile, config, collectors, nil), collectors); err != nil {
+			log.Fatal(err)
+		}
+
+		os.Exit(0)
+	}
+
+	srv, err := NewWebServer(*webConfig, http.DefaultServeMux)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	reloader := NewReloader(*configFile, config, collectors, srv)
+
+	if *configFile != "" {
+		http.HandleFunc("/probe", reloader.ServeProbe)
+	}
+
+	http.Handle(*telemetryPath, promhttp.Handler())
+	http.Handle("/api/v1/stats", api.StatsHandler())
+	http.Handle("/api/v1/rates", api.RatesHandler())
+	http.Handle("/-/reload", reloader.Handler())
+
+	listeners, err := webListeners(addrs)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	serve := func(ctx context.Context) error { return serveWeb(ctx, srv, listeners) }
+
+	if err := runUntilStopped(withZabbix(serve, zabbix, *zabbixListen), reloader, collectors); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// runUntilStopped runs one of the long-running modes and reloads the config
+// on SIGHUP. On SIGINT and SIGTERM it cancels run and stops the collections
+// after run returned.
+func runUntilStopped(run func(ctx context.Context) error, reloader *Reloader, collectors *Collectors) error {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+
+	defer signal.Stop(sigs)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	done := make(chan error, 1)
+
+	go func() { done <- run(ctx) }()
+
+	for {
+		select {
+		case err := <-done:
+			return err
+		case sig := <-sigs:
+			if sig == syscall.SIGHUP {
+				if err := reloader.Reload(); err != nil {
+					log.WithFields(log.Fields{"error": err}).Error("could not reload config")
+				}
+
+				continue
+			}
+
+			log.WithFields(log.Fields{"signal": sig}).Info("shutting down")
+			cancel()
+
+			err := <-done
+
+			collectors.Stop()
+			closeEmitters(collectors.Emitters)
+
+			return err
+		}
+	}
+}
+
+// withZabbix answers the passive checks of z on addr next to run, if there
+// is an agent. Both stop when ctx is done or one of them fails.
+func withZabbix(run func(ctx context.Context) error, z *ZabbixAgent, addr string) func(ctx context.Context) error {
+	if z == nil {
+		return run
+	}
+
+	return func(ctx context.Context) error {
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+
+		zabbix := make(chan error, 1)
+		done := make(chan error, 1)
+
+		go func() { zabbix <- z.ListenAndServe(ctx, addr) }()
+		go func() { done <- run(ctx) }()
+
+		select {
+		case err := <-zabbix:
+			cancel()
+			<-done
+
+			return err
+		case err := <-done:
+			cancel()
+
+			if zerr := <-zabbix; err == nil {
+				err = zerr
+			}
+
+			return err
+		}
+	}
+}
+
+// serveWeb serves on the listeners until ctx is done and waits for the
+// running requests then.
+func serveWeb(ctx context.Context, srv *WebServer, listeners []net.Listener) error {
+	errs := make(chan error, len(listeners))
+
+	for _, l := range listeners {
+		log.Info(fmt.Sprintf("Beginning to serve on %s", l.Addr()))
+
+		go func(l net.Listener) {
+			errs <- srv.Serve(l)
+		}(l)
+	}
+
+	select {
+	case err := <-errs:
+		return err
+	case <-ctx.Done():
+	}
+
+	shutdown, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	if err := srv.Shutdown(shutdown); err != nil {
+		log.WithFields(log.Fields{"error": err}).Error("could not finish the running requests")
+	}
+
+	return nil
 }
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// graphField is a value of a graph taken from `smtpctl show stats`.
+type graphField struct {
+	Name  string
+	Label string
+	Stat  string
+	// Counter values only grow until smtpd restarts.
+	Counter bool
+}
+
+// graph groups stats for Munin and collectd.
+type graph struct {
+	Name   string
+	Title  string
+	VLabel string
+	Fields []graphField
+}
+
+// nolint:gochecknoglobals
+var graphs = []graph{
+	{
+		Name:   "deliveries",
+		Title:  "OpenSMTPD deliveries",
+		VLabel: "deliveries per ${graph_period}",
+		Fields: []graphField{
+			{"ok", "ok", "scheduler.delivery.ok", true},
+			{"permfail", "permfail", "scheduler.delivery.permfail", true},
+			{"tempfail", "tempfail", "scheduler.delivery.tempfail", true},
+			{"loop", "loop", "scheduler.delivery.loop", true},
+		},
+	},
+	{
+		Name:   "sessions",
+		Title:  "OpenSMTPD sessions",
+		VLabel: "sessions",
+		Fields: []graphField{
+			{"smtp", "smtp", "smtp.session", false},
+			{"mta", "mta", "mta.session", false},
+		},
+	},
+	{
+		Name:   "queue",
+		Title:  "OpenSMTPD queue",
+		VLabel: "envelopes",
+		Fields: []graphField{
+			{"envelopes", "envelopes", "scheduler.envelope", false},
+			{"incoming", "incoming", "scheduler.envelope.incoming", false},
+			{"inflight", "inflight", "scheduler.envelope.inflight", false},
+		},
+	},
+}
+
+// namedStat is the stats source of an instance, unnamed without instances.
+type namedStat struct {
+	Name string
+	Stat Stat
+}
+
+// statSources returns the instances of -config.file or the source given by
+// flag.
+func statSources() ([]namedStat, error) {
+	if *configFile != "" {
+		config, err := LoadConfig(*configFile)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(config.Instances) > 0 {
+			s := make([]namedStat, 0, len(config.Instances))
+			for _, i := range config.Instances {
+				s = append(s, namedStat{Name: i.Name, Stat: i.Stat()})
+			}
+
+			return s, nil
+		}
+	}
+
+	stats, err := newStat(*source, *sourcePath)
+	if err != nil {
+		return nil, err
+	}
+
+	return []namedStat{{Stat: stats}}, nil
+}
+
+// graphName is the name of a graph for an instance with only the characters
+// Munin allows.
+func graphName(g graph, instance string) string {
+	if instance == "" {
+		return g.Name
+	}
+
+	return g.Name + "_" + strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+			return r
+		}
+
+		return '_'
+	}, instance)
+}
+
+// muninConfig writes the multigraph config of the graphs of the instances.
+func muninConfig(w io.Writer, instances []string) {
+	for _, instance := range instances {
+		for _, g := range graphs {
+			title := g.Title
+			if instance != "" {
+				title += " of " + instance
+			}
+
+			fmt.Fprintf(w, "multigraph smtpd_%s\n", graphName(g, instance))
+			fmt.Fprintf(w, "graph_title %s\n", title)
+			fmt.Fprintf(w, "graph_vlabel %s\n", g.VLabel)
+			fmt.Fprintf(w, "graph_category mail\n")
+			fmt.Fprintf(w, "graph_args --base 1000 -l 0\n")
+
+			for _, f := range g.Fields {
+				fmt.Fprintf(w, "%s.label %s\n", f.Name, f.Label)
+
+				if f.Counter {
+					fmt.Fprintf(w, "%s.type DERIVE\n%s.min 0\n", f.Name, f.Name)
+				} else {
+					fmt.Fprintf(w, "%s.type GAUGE\n", f.Name)
+				}
+			}
+		}
+	}
+}
+
+// muninValues writes the values of the graphs of an instance, a missing stat
+// is unknown.
+func muninValues(w io.Writer, instance string, stats map[string]interface{}) {
+	for _, g := range graphs {
+		fmt.Fprintf(w, "multigraph smtpd_%s\n", graphName(g, instance))
+
+		for _, f := range g.Fields {
+			value := "U"
+			if n, ok := stats[f.Stat].(int64); ok {
+				value = fmt.Sprintf("%d", n)
+			}
+
+			fmt.Fprintf(w, "%s.value %s\n", f.Name, value)
+		}
+	}
+}
+
+// munin runs as multigraph Munin plugin, answering config or fetching the
+// values without an argument.
+func munin(args []string, w io.Writer) error {
+	// the plugin needs munin-node to support multigraph
+	if len(args) > 0 && args[0] == "capabilities" {
+		fmt.Fprintln(w, "multigraph")
+
+		return nil
+	}
+
+	sources, err := statSources()
+
+	if len(args) > 0 && args[0] == "autoconf" {
+		if err != nil {
+			fmt.Fprintf(w, "no (%s)\n", err)
+			return nil
+		}
+
+		fmt.Fprintln(w, "yes")
+
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case len(args) > 0 && args[0] == "config":
+		instances := make([]string, 0, len(sources))
+		for _, s := range sources {
+			instances = append(instances, s.Name)
+		}
+
+		muninConfig(w, instances)
+
+		return nil
+	case len(args) > 0:
+		return fmt.Errorf("unknown munin command: %s", args[0])
+	}
+
+	for _, s := range sources {
+		if r, ok := s.Stat.(*readerStat); ok {
+			r.Wait()
+		}
+
+		out, err := s.Stat.Now()
+		if err != nil {
+			return err
+		}
+
+		muninValues(w, s.Name, parseStats(out))
+	}
+
+	return nil
+}
+
+// putvals returns the stats of an instance as PUTVAL lines of the collectd
+// exec plugin, like `PUTVAL "mx1/smtpd-deliveries/derive-ok" interval=10 N:42`.
+func putvals(host, instance string, stats map[string]interface{}, interval time.Duration) []string {
+	var lines []string
+
+	for _, g := range graphs {
+		plugin := "smtpd-" + g.Name
+		if instance != "" {
+			plugin = "smtpd-" + pathElement(instance) + "_" + g.Name
+		}
+
+		for _, f := range g.Fields {
+			n, ok := stats[f.Stat].(int64)
+			if !ok {
+				continue
+			}
+
+			typ := "gauge"
+			if f.Counter {
+				typ = "derive"
+			}
+
+			lines = append(lines, fmt.Sprintf("PUTVAL \"%s/%s/%s-%s\" interval=%d N:%d",
+				host, plugin, typ, f.Name, int(interval.Seconds()), n))
+		}
+	}
+
+	return lines
+}
+
+// collectd runs as collectd exec plugin and prints the stats every interval,
+// taking hostname and interval from the environment collectd sets.
+func collectd(w io.Writer) error {
+	sources, err := statSources()
+	if err != nil {
+		return err
+	}
+
+	host := os.Getenv("COLLECTD_HOSTNAME")
+	if host == "" {
+		if host, err = os.Hostname(); err != nil {
+			return fmt.Errorf("could not get hostname: %w", err)
+		}
+	}
+
+	d := *interval
+
+	if s := os.Getenv("COLLECTD_INTERVAL"); s != "" {
+		var secs float64
+		if _, err := fmt.Sscanf(s, "%g", &secs); err != nil || secs <= 0 {
+			return fmt.Errorf("invalid COLLECTD_INTERVAL: %s", s)
+		}
+
+		d = time.Duration(secs * float64(time.Second))
+	}
+
+	// a piped snapshot is complete at the end of the input
+	for _, s := range sources {
+		if r, ok := s.Stat.(*readerStat); ok {
+			r.Wait()
+		}
+	}
+
+	for {
+		for _, s := range sources {
+			out, err := s.Stat.Now()
+			if err != nil {
+				log.Error(err)
+				continue
+			}
+
+			// collectd reads the lines as they get written
+			for _, line := range putvals(host, s.Name, parseStats(out), d) {
+				if _, err := fmt.Fprintln(w, line); err != nil {
+					return err
+				}
+			}
+		}
+
+		time.Sleep(d)
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMuninConfig(t *testing.T) {
+	var buf bytes.Buffer
+
+	muninConfig(&buf, []string{"mx in"})
+
+	out := buf.String()
+	assert.True(t, strings.HasPrefix(out, "multigraph smtpd_deliveries_mx_in\ngraph_title OpenSMTPD deliveries of mx in\n"))
+	assert.Contains(t, out, "tempfail.type DERIVE\ntempfail.min 0\n")
+	assert.Contains(t, out, "multigraph smtpd_queue_mx_in\n")
+	assert.Contains(t, out, "envelopes.type GAUGE\n")
+}
+
+func TestMuninCapabilities(t *testing.T) {
+	var buf bytes.Buffer
+
+	assert.Nil(t, munin([]string{"capabilities"}, &buf))
+	assert.Equal(t, "multigraph\n", buf.String())
+}
+
+func TestMuninValues(t *testing.T) {
+	var buf bytes.Buffer
+
+	muninValues(&buf, "", parseStats("scheduler.delivery.ok=42\nsmtp.session=3\nscheduler.envelope=5\n"))
+
+	assert.Equal(t, `multigraph smtpd_deliveries
+ok.value 42
+permfail.value U
+tempfail.value U
+loop.value U
+multigraph smtpd_sessions
+smtp.value 3
+mta.value U
+multigraph smtpd_queue
+envelopes.value 5
+incoming.value U
+inflight.value U
+`, buf.String())
+}
+
+func TestPutvals(t *testing.T) {
+	assert.Equal(t, []string{
+		`PUTVAL "mx1/smtpd-mx_deliveries/derive-ok" interval=10 N:42`,
+		`PUTVAL "mx1/smtpd-mx_queue/gauge-envelopes" interval=10 N:5`,
+	}, putvals("mx1", "mx", parseStats("scheduler.delivery.ok=42\nscheduler.envelope=5\n"), 10*time.Second))
+}
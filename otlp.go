@@ -0,0 +1,388 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	log "github.com/sirupsen/logrus"
+)
+
+// aggregationCumulative is AGGREGATION_TEMPORALITY_CUMULATIVE of OTLP.
+const aggregationCumulative = 2
+
+// The messages of opentelemetry/proto/collector/metrics/v1 that the exporter
+// sends. Oneof fields are plain optional fields, only one of them gets set.
+
+type otlpRequest struct {
+	ResourceMetrics []*otlpResourceMetrics `protobuf:"bytes,1,rep,name=resource_metrics,proto3"`
+}
+
+func (m *otlpRequest) Reset()         { *m = otlpRequest{} }
+func (m *otlpRequest) String() string { return proto.CompactTextString(m) }
+func (*otlpRequest) ProtoMessage()    {}
+
+type otlpResourceMetrics struct {
+	Resource     *otlpResource       `protobuf:"bytes,1,opt,name=resource,proto3"`
+	ScopeMetrics []*otlpScopeMetrics `protobuf:"bytes,2,rep,name=scope_metrics,proto3"`
+}
+
+func (m *otlpResourceMetrics) Reset()         { *m = otlpResourceMetrics{} }
+func (m *otlpResourceMetrics) String() string { return proto.CompactTextString(m) }
+func (*otlpResourceMetrics) ProtoMessage()    {}
+
+type otlpResource struct {
+	Attributes []*otlpKeyValue `protobuf:"bytes,1,rep,name=attributes,proto3"`
+}
+
+func (m *otlpResource) Reset()         { *m = otlpResource{} }
+func (m *otlpResource) String() string { return proto.CompactTextString(m) }
+func (*otlpResource) ProtoMessage()    {}
+
+type otlpKeyValue struct {
+	Key   string        `protobuf:"bytes,1,opt,name=key,proto3"`
+	Value *otlpAnyValue `protobuf:"bytes,2,opt,name=value,proto3"`
+}
+
+func (m *otlpKeyValue) Reset()         { *m = otlpKeyValue{} }
+func (m *otlpKeyValue) String() string { return proto.CompactTextString(m) }
+func (*otlpKeyValue) ProtoMessage()    {}
+
+type otlpAnyValue struct {
+	StringValue *string `protobuf:"bytes,1,opt,name=string_value"`
+}
+
+func (m *otlpAnyValue) Reset()         { *m = otlpAnyValue{} }
+func (m *otlpAnyValue) String() string { return proto.CompactTextString(m) }
+func (*otlpAnyValue) ProtoMessage()    {}
+
+type otlpScopeMetrics struct {
+	Scope   *otlpScope    `protobuf:"bytes,1,opt,name=scope,proto3"`
+	Metrics []*otlpMetric `protobuf:"bytes,2,rep,name=metrics,proto3"`
+}
+
+func (m *otlpScopeMetrics) Reset()         { *m = otlpScopeMetrics{} }
+func (m *otlpScopeMetrics) String() string { return proto.CompactTextString(m) }
+func (*otlpScopeMetrics) ProtoMessage()    {}
+
+type otlpScope struct {
+	Name    string `protobuf:"bytes,1,opt,name=name,proto3"`
+	Version string `protobuf:"bytes,2,opt,name=version,proto3"`
+}
+
+func (m *otlpScope) Reset()         { *m = otlpScope{} }
+func (m *otlpScope) String() string { return proto.CompactTextString(m) }
+func (*otlpScope) ProtoMessage()    {}
+
+type otlpMetric struct {
+	Name        string         `protobuf:"bytes,1,opt,name=name,proto3"`
+	Description string         `protobuf:"bytes,2,opt,name=description,proto3"`
+	Gauge       *otlpGauge     `protobuf:"bytes,5,opt,name=gauge"`
+	Sum         *otlpSum       `protobuf:"bytes,7,opt,name=sum"`
+	Histogram   *otlpHistogram `protobuf:"bytes,9,opt,name=histogram"`
+	Summary     *otlpSummary   `protobuf:"bytes,11,opt,name=summary"`
+}
+
+func (m *otlpMetric) Reset()         { *m = otlpMetric{} }
+func (m *otlpMetric) String() string { return proto.CompactTextString(m) }
+func (*otlpMetric) ProtoMessage()    {}
+
+type otlpGauge struct {
+	DataPoints []*otlpNumberDataPoint `protobuf:"bytes,1,rep,name=data_points,proto3"`
+}
+
+func (m *otlpGauge) Reset()         { *m = otlpGauge{} }
+func (m *otlpGauge) String() string { return proto.CompactTextString(m) }
+func (*otlpGauge) ProtoMessage()    {}
+
+type otlpSum struct {
+	DataPoints             []*otlpNumberDataPoint `protobuf:"bytes,1,rep,name=data_points,proto3"`
+	AggregationTemporality int32                  `protobuf:"varint,2,opt,name=aggregation_temporality,proto3"`
+	IsMonotonic            bool                   `protobuf:"varint,3,opt,name=is_monotonic,proto3"`
+}
+
+func (m *otlpSum) Reset()         { *m = otlpSum{} }
+func (m *otlpSum) String() string { return proto.CompactTextString(m) }
+func (*otlpSum) ProtoMessage()    {}
+
+type otlpNumberDataPoint struct {
+	StartTimeUnixNano uint64          `protobuf:"fixed64,2,opt,name=start_time_unix_nano,proto3"`
+	TimeUnixNano      uint64          `protobuf:"fixed64,3,opt,name=time_unix_nano,proto3"`
+	AsDouble          *float64        `protobuf:"fixed64,4,opt,name=as_double"`
+	Attributes        []*otlpKeyValue `protobuf:"bytes,7,rep,name=attributes,proto3"`
+}
+
+func (m *otlpNumberDataPoint) Reset()         { *m = otlpNumberDataPoint{} }
+func (m *otlpNumberDataPoint) String() string { return proto.CompactTextString(m) }
+func (*otlpNumberDataPoint) ProtoMessage()    {}
+
+type otlpHistogram struct {
+	DataPoints             []*otlpHistogramDataPoint `protobuf:"bytes,1,rep,name=data_points,proto3"`
+	AggregationTemporality int32                     `protobuf:"varint,2,opt,name=aggregation_temporality,proto3"`
+}
+
+func (m *otlpHistogram) Reset()         { *m = otlpHistogram{} }
+func (m *otlpHistogram) String() string { return proto.CompactTextString(m) }
+func (*otlpHistogram) ProtoMessage()    {}
+
+type otlpHistogramDataPoint struct {
+	StartTimeUnixNano uint64          `protobuf:"fixed64,2,opt,name=start_time_unix_nano,proto3"`
+	TimeUnixNano      uint64          `protobuf:"fixed64,3,opt,name=time_unix_nano,proto3"`
+	Count             uint64          `protobuf:"fixed64,4,opt,name=count,proto3"`
+	Sum               *float64        `protobuf:"fixed64,5,opt,name=sum"`
+	BucketCounts      []uint64        `protobuf:"fixed64,6,rep,packed,name=bucket_counts,proto3"`
+	ExplicitBounds    []float64       `protobuf:"fixed64,7,rep,packed,name=explicit_bounds,proto3"`
+	Attributes        []*otlpKeyValue `protobuf:"bytes,9,rep,name=attributes,proto3"`
+}
+
+func (m *otlpHistogramDataPoint) Reset()         { *m = otlpHistogramDataPoint{} }
+func (m *otlpHistogramDataPoint) String() string { return proto.CompactTextString(m) }
+func (*otlpHistogramDataPoint) ProtoMessage()    {}
+
+type otlpSummary struct {
+	DataPoints []*otlpSummaryDataPoint `protobuf:"bytes,1,rep,name=data_points,proto3"`
+}
+
+func (m *otlpSummary) Reset()         { *m = otlpSummary{} }
+func (m *otlpSummary) String() string { return proto.CompactTextString(m) }
+func (*otlpSummary) ProtoMessage()    {}
+
+type otlpSummaryDataPoint struct {
+	StartTimeUnixNano uint64               `protobuf:"fixed64,2,opt,name=start_time_unix_nano,proto3"`
+	TimeUnixNano      uint64               `protobuf:"fixed64,3,opt,name=time_unix_nano,proto3"`
+	Count             uint64               `protobuf:"fixed64,4,opt,name=count,proto3"`
+	Sum               float64              `protobuf:"fixed64,5,opt,name=sum,proto3"`
+	QuantileValues    []*otlpValueQuantile `protobuf:"bytes,6,rep,name=quantile_values,proto3"`
+	Attributes        []*otlpKeyValue      `protobuf:"bytes,7,rep,name=attributes,proto3"`
+}
+
+func (m *otlpSummaryDataPoint) Reset()         { *m = otlpSummaryDataPoint{} }
+func (m *otlpSummaryDataPoint) String() string { return proto.CompactTextString(m) }
+func (*otlpSummaryDataPoint) ProtoMessage()    {}
+
+type otlpValueQuantile struct {
+	Quantile float64 `protobuf:"fixed64,1,opt,name=quantile,proto3"`
+	Value    float64 `protobuf:"fixed64,2,opt,name=value,proto3"`
+}
+
+func (m *otlpValueQuantile) Reset()         { *m = otlpValueQuantile{} }
+func (m *otlpValueQuantile) String() string { return proto.CompactTextString(m) }
+func (*otlpValueQuantile) ProtoMessage()    {}
+
+// OTLPConfig holds the settings of the OTLP exporter.
+type OTLPConfig struct {
+	// Endpoint is the base URL of an OTLP/HTTP receiver, like
+	// http://localhost:4318.
+	Endpoint string
+	Headers  []string
+	Timeout  time.Duration
+}
+
+// OTLPExporter sends the metrics to an OTLP/HTTP receiver.
+type OTLPExporter struct {
+	cfg      OTLPConfig
+	client   *http.Client
+	gatherer prometheus.Gatherer
+	headers  http.Header
+	resource *otlpResource
+	start    time.Time
+}
+
+// NewOTLPExporter creates an exporter of the metrics of g. The go and
+// process metrics are left out.
+func NewOTLPExporter(g prometheus.Gatherer, cfg OTLPConfig) (*OTLPExporter, error) {
+	host, err := os.Hostname()
+	if err != nil {
+		return nil, fmt.Errorf("could not get hostname: %w", err)
+	}
+
+	e := &OTLPExporter{
+		cfg:      cfg,
+		client:   &http.Client{Timeout: cfg.Timeout},
+		gatherer: withoutRuntimeMetrics(g),
+		headers:  http.Header{},
+		resource: &otlpResource{Attributes: []*otlpKeyValue{
+			otlpAttribute("host.name", host),
+			otlpAttribute("service.name", "smtpd"),
+			otlpAttribute("service.version", Version),
+		}},
+		start: time.Now(),
+	}
+
+	for _, h := range cfg.Headers {
+		i := strings.Index(h, "=")
+		if i < 1 {
+			return nil, fmt.Errorf("invalid otlp header: %s", h)
+		}
+
+		e.headers.Add(h[:i], h[i+1:])
+	}
+
+	return e, nil
+}
+
+func otlpAttribute(key, value string) *otlpKeyValue {
+	return &otlpKeyValue{Key: key, Value: &otlpAnyValue{StringValue: proto.String(value)}}
+}
+
+func otlpAttributes(m *dto.Metric) []*otlpKeyValue {
+	attrs := make([]*otlpKeyValue, 0, len(m.Label))
+	for _, l := range m.Label {
+		attrs = append(attrs, otlpAttribute(l.GetName(), l.GetValue()))
+	}
+
+	return attrs
+}
+
+// request converts the gathered metrics. Counters become cumulative
+// monotonic sums, gauges and untyped metrics gauges.
+func (e *OTLPExporter) request(mfs []*dto.MetricFamily, now time.Time) *otlpRequest {
+	start, ts := uint64(e.start.UnixNano()), uint64(now.UnixNano())
+	metrics := make([]*otlpMetric, 0, len(mfs))
+
+	for _, mf := range mfs {
+		m := &otlpMetric{Name: mf.GetName(), Description: mf.GetHelp()}
+
+		switch mf.GetType() {
+		case dto.MetricType_COUNTER:
+			m.Sum = &otlpSum{AggregationTemporality: aggregationCumulative, IsMonotonic: true}
+			for _, metric := range mf.Metric {
+				m.Sum.DataPoints = append(m.Sum.DataPoints, &otlpNumberDataPoint{
+					StartTimeUnixNano: start, TimeUnixNano: ts,
+					AsDouble: proto.Float64(metric.GetCounter().GetValue()), Attributes: otlpAttributes(metric),
+				})
+			}
+		case dto.MetricType_GAUGE, dto.MetricType_UNTYPED:
+			m.Gauge = &otlpGauge{}
+			for _, metric := range mf.Metric {
+				value := metric.GetGauge().GetValue()
+				if mf.GetType() == dto.MetricType_UNTYPED {
+					value = metric.GetUntyped().GetValue()
+				}
+
+				m.Gauge.DataPoints = append(m.Gauge.DataPoints, &otlpNumberDataPoint{
+					TimeUnixNano: ts, AsDouble: proto.Float64(value), Attributes: otlpAttributes(metric),
+				})
+			}
+		case dto.MetricType_HISTOGRAM:
+			m.Histogram = &otlpHistogram{AggregationTemporality: aggregationCumulative}
+			for _, metric := range mf.Metric {
+				m.Histogram.DataPoints = append(m.Histogram.DataPoints, histogramDataPoint(metric, start, ts))
+			}
+		case dto.MetricType_SUMMARY:
+			m.Summary = &otlpSummary{}
+			for _, metric := range mf.Metric {
+				s := metric.GetSummary()
+				dp := &otlpSummaryDataPoint{
+					StartTimeUnixNano: start, TimeUnixNano: ts, Count: s.GetSampleCount(), Sum: s.GetSampleSum(),
+					Attributes: otlpAttributes(metric),
+				}
+
+				for _, q := range s.Quantile {
+					dp.QuantileValues = append(dp.QuantileValues, &otlpValueQuantile{Quantile: q.GetQuantile(), Value: q.GetValue()})
+				}
+
+				m.Summary.DataPoints = append(m.Summary.DataPoints, dp)
+			}
+		}
+
+		metrics = append(metrics, m)
+	}
+
+	return &otlpRequest{ResourceMetrics: []*otlpResourceMetrics{{
+		Resource: e.resource,
+		ScopeMetrics: []*otlpScopeMetrics{{
+			Scope:   &otlpScope{Name: "smtpd_exporter", Version: Version},
+			Metrics: metrics,
+		}},
+	}}}
+}
+
+// histogramDataPoint turns the cumulative prometheus buckets into the counts
+// per bucket of OTLP, the last one for the values above all bounds.
+func histogramDataPoint(m *dto.Metric, start, ts uint64) *otlpHistogramDataPoint {
+	h := m.GetHistogram()
+	dp := &otlpHistogramDataPoint{
+		StartTimeUnixNano: start, TimeUnixNano: ts, Count: h.GetSampleCount(),
+		Sum: proto.Float64(h.GetSampleSum()), Attributes: otlpAttributes(m),
+	}
+
+	var last uint64
+
+	for _, b := range h.Bucket {
+		dp.ExplicitBounds = append(dp.ExplicitBounds, b.GetUpperBound())
+		dp.BucketCounts = append(dp.BucketCounts, b.GetCumulativeCount()-last)
+		last = b.GetCumulativeCount()
+	}
+
+	dp.BucketCounts = append(dp.BucketCounts, h.GetSampleCount()-last)
+
+	return dp
+}
+
+// Export sends the current metrics.
+func (e *OTLPExporter) Export(now time.Time) error {
+	mfs, err := e.gatherer.Gather()
+	if err != nil {
+		return fmt.Errorf("could not gather metrics: %w", err)
+	}
+
+	data, err := proto.Marshal(e.request(mfs, now))
+	if err != nil {
+		return fmt.Errorf("could not marshal otlp request: %w", err)
+	}
+
+	req, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(e.cfg.Endpoint, "/")+"/v1/metrics", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+
+	for k, v := range e.headers {
+		req.Header[k] = v
+	}
+
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("User-Agent", "smtpd_exporter/"+Version)
+
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("could not export metrics: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, maxErrorBody))
+		return fmt.Errorf("could not export metrics: %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+
+	io.Copy(ioutil.Discard, resp.Body) // nolint:errcheck
+
+	return nil
+}
+
+// Run exports the metrics every interval until ctx is done and exports them
+// a last time then.
+func (e *OTLPExporter) Run(ctx context.Context, interval time.Duration) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			if err := e.Export(now); err != nil {
+				log.Error(err)
+			}
+		case <-ctx.Done():
+			return e.Export(time.Now())
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+)
+
+// otlpReceiver is an OTLP/HTTP stand-in keeping the decoded requests.
+type otlpReceiver struct {
+	mux      sync.Mutex
+	requests []*otlpRequest
+	headers  []http.Header
+}
+
+func (r *otlpReceiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.URL.Path != "/v1/metrics" || req.Header.Get("Content-Type") != "application/x-protobuf" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	data, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	m := &otlpRequest{}
+	if err := proto.Unmarshal(data, m); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	r.mux.Lock()
+	r.requests = append(r.requests, m)
+	r.headers = append(r.headers, req.Header)
+	r.mux.Unlock()
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func TestOTLPExporter(t *testing.T) {
+	assert := assert.New(t)
+	r := &otlpReceiver{}
+	s := httptest.NewServer(r)
+	defer s.Close()
+
+	reg := prometheus.NewRegistry()
+	c := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "smtpd_delivery_ok", Help: "Shows how often a delivery was ok."},
+		[]string{"instance_name"})
+	c.WithLabelValues("mx").Add(0)
+	g := prometheus.NewGauge(prometheus.GaugeOpts{Name: "smtpd_probe_success", Help: "Probe success."})
+	g.Set(1)
+	h := prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name: "smtpd_message_attempts", Help: "Delivery attempts.", Buckets: []float64{1, 2},
+	})
+	h.Observe(1)
+	h.Observe(2)
+	h.Observe(5)
+	reg.MustRegister(c, g, h, prometheus.NewGoCollector())
+
+	e, err := NewOTLPExporter(reg, OTLPConfig{Endpoint: s.URL, Headers: []string{"Authorization=Bearer secret"}, Timeout: time.Second})
+	assert.Nil(err)
+
+	now := time.Unix(1577836800, 0)
+	assert.Nil(e.Export(now))
+	assert.Len(r.requests, 1)
+	assert.Equal("Bearer secret", r.headers[0].Get("Authorization"))
+
+	rm := r.requests[0].ResourceMetrics[0]
+	host, _ := os.Hostname()
+
+	attrs := map[string]string{}
+	for _, a := range rm.Resource.Attributes {
+		attrs[a.Key] = *a.Value.StringValue
+	}
+
+	assert.Equal(host, attrs["host.name"])
+	assert.Equal("smtpd", attrs["service.name"])
+
+	metrics := map[string]*otlpMetric{}
+	for _, m := range rm.ScopeMetrics[0].Metrics {
+		metrics[m.Name] = m
+	}
+
+	sum := metrics["smtpd_delivery_ok"].Sum
+	assert.True(sum.IsMonotonic)
+	assert.Equal(int32(aggregationCumulative), sum.AggregationTemporality)
+	// a zero value is still sent
+	assert.Equal(float64(0), *sum.DataPoints[0].AsDouble)
+	assert.Equal("instance_name", sum.DataPoints[0].Attributes[0].Key)
+	assert.Equal(uint64(now.UnixNano()), sum.DataPoints[0].TimeUnixNano)
+	assert.NotZero(sum.DataPoints[0].StartTimeUnixNano)
+
+	assert.Equal(float64(1), *metrics["smtpd_probe_success"].Gauge.DataPoints[0].AsDouble)
+	assert.NotContains(metrics, "go_goroutines")
+
+	hist := metrics["smtpd_message_attempts"].Histogram
+	assert.Equal(int32(aggregationCumulative), hist.AggregationTemporality)
+	assert.Equal([]float64{1, 2}, hist.DataPoints[0].ExplicitBounds)
+	assert.Equal([]uint64{1, 1, 1}, hist.DataPoints[0].BucketCounts)
+	assert.Equal(uint64(3), hist.DataPoints[0].Count)
+	assert.Equal(float64(8), *hist.DataPoints[0].Sum)
+}
+
+func TestOTLPWireFormat(t *testing.T) {
+	data, err := proto.Marshal(&otlpNumberDataPoint{TimeUnixNano: 1, AsDouble: proto.Float64(0)})
+	assert.Nil(t, err)
+	// time_unix_nano is field 3 and as_double field 4, both fixed64
+	assert.Equal(t, []byte{
+		0x19, 1, 0, 0, 0, 0, 0, 0, 0,
+		0x21, 0, 0, 0, 0, 0, 0, 0, 0,
+	}, data)
+}
+
+func TestOTLPExporterErrors(t *testing.T) {
+	assert := assert.New(t)
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer s.Close()
+
+	e, err := NewOTLPExporter(prometheus.NewRegistry(), OTLPConfig{Endpoint: s.URL, Timeout: time.Second})
+	assert.Nil(err)
+	assert.NotNil(e.Export(time.Now()))
+
+	_, err = NewOTLPExporter(prometheus.NewRegistry(), OTLPConfig{Endpoint: s.URL, Headers: []string{"Authorization"}})
+	assert.NotNil(err)
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os/exec"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	log "github.com/sirupsen/logrus"
+)
+
+// nolint:gochecknoglobals
+var (
+	// targets end up in commands and URLs, so only allow host names and
+	// addresses with an optional port.
+	targetRe = regexp.MustCompile(`^[A-Za-z0-9_\[][A-Za-z0-9._:\[\]-]*$`)
+
+	probeHTTPSuccessDesc = prometheus.NewDesc(
+		"probe_success", "Shows if the probe of the target succeeded.", nil, nil,
+	)
+	probeHTTPDurationDesc = prometheus.NewDesc(
+		"probe_duration_seconds", "Time the probe of the target took.", nil, nil,
+	)
+)
+
+// collectFunc is a prometheus.Collector that sends already known metrics.
+type collectFunc func(chan<- prometheus.Metric)
+
+// Describe sends nothing, which makes it an unchecked collector.
+func (f collectFunc) Describe(chan<- *prometheus.Desc) {}
+
+// Collect implements prometheus.Collector.
+func (f collectFunc) Collect(ch chan<- prometheus.Metric) {
+	f(ch)
+}
+
+// probeHandler probes the target with the module given in the request and
+// answers with the metrics of a fresh registry, like blackbox_exporter does.
+func probeHandler(modules map[string]*Module) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		target := r.URL.Query().Get("target")
+		if !targetRe.MatchString(target) {
+			http.Error(w, fmt.Sprintf("invalid target: %q", target), http.StatusBadRequest)
+			return
+		}
+
+		name := r.URL.Query().Get("module")
+
+		module, ok := modules[name]
+		if !ok {
+			http.Error(w, fmt.Sprintf("unknown module: %q", name), http.StatusBadRequest)
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), module.Timeout)
+		defer cancel()
+
+		start := time.Now()
+		collect, err := runProbe(ctx, module, target)
+		duration := time.Since(start)
+
+		success := 1.0
+		if err != nil {
+			success = 0
+
+			log.WithFields(log.Fields{"target": target, "module": name, "error": err}).Debug("probe failed")
+		}
+
+		reg := prometheus.NewRegistry()
+		reg.MustRegister(collectFunc(func(ch chan<- prometheus.Metric) {
+			ch <- prometheus.MustNewConstMetric(probeHTTPSuccessDesc, prometheus.GaugeValue, success)
+			ch <- prometheus.MustNewConstMetric(probeHTTPDurationDesc, prometheus.GaugeValue, duration.Seconds())
+
+			if collect != nil {
+				collect(ch)
+			}
+		}))
+
+		promhttp.HandlerFor(reg, promhttp.HandlerOpts{}).ServeHTTP(w, r)
+	}
+}
+
+// runProbe runs the prober of the module and returns a function sending the
+// metrics it found.
+func runProbe(ctx context.Context, m *Module, target string) (collectFunc, error) {
+	switch m.Prober {
+	case "smtp":
+		deadline, _ := ctx.Deadline()
+		res := probeSMTP(
+			ProbeTarget{Name: target, Address: target, TLS: m.SMTP.TLS},
+			ProbeConfig{Timeout: time.Until(deadline), Helo: m.SMTP.Helo, InsecureTLS: m.SMTP.InsecureTLS},
+		)
+
+		return func(ch chan<- prometheus.Metric) { res.collect(ch, target) }, res.Err
+	case "command":
+		args := make([]string, 0, len(m.Command.Args))
+		for _, arg := range m.Command.Args {
+			args = append(args, strings.Replace(arg, "{target}", target, -1))
+		}
+
+		out, err := exec.CommandContext(ctx, args[0], args[1:]...).Output() // nolint:gosec
+		if err != nil {
+			return nil, fmt.Errorf("could not run command: %w", err)
+		}
+
+		return statsCollector(string(out)), nil
+	case "file":
+		out, err := fetchStats(ctx, strings.Replace(m.File.URL, "{target}", target, -1))
+		if err != nil {
+			return nil, err
+		}
+
+		return statsCollector(out), nil
+	}
+
+	return nil, fmt.Errorf("unknown prober: %s", m.Prober)
+}
+
+// fetchStats gets the stats over http(s) or from a local path.
+func fetchStats(ctx context.Context, url string) (string, error) {
+	if !strings.HasPrefix(url, "http://") && !strings.HasPrefix(url, "https://") {
+		b, err := ioutil.ReadFile(url)
+		if err != nil {
+			return "", fmt.Errorf("could not read stats file: %w", err)
+		}
+
+		return string(b), nil
+	}
+
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return "", fmt.Errorf("could not fetch stats: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("could not fetch stats: %s", resp.Status)
+	}
+
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("could not read stats: %w", err)
+	}
+
+	return string(b), nil
+}
+
+// statsCollector sends the metrics found in `smtpctl show stats` output.
+func statsCollector(out string) collectFunc {
+	return func(ch chan<- prometheus.Metric) {
+		for _, m := range metrics {
+			value, err := m.value(out)
+			if err != nil {
+				log.WithFields(log.Fields{"metric": m.Name, "error": err}).Debug("could not get value")
+			}
+
+			ch <- prometheus.MustNewConstMetric(
+				prometheus.NewDesc(m.Name, m.Help, nil, nil), prometheus.CounterValue, float64(value),
+			)
+		}
+	}
+}
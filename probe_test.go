@@ -0,0 +1,169 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testStats = `control.session=1
+mda.envelope=0
+scheduler.delivery.ok=42
+scheduler.delivery.permfail=3
+scheduler.delivery.tempfail=7
+`
+
+func probe(t *testing.T, modules map[string]*Module, target, module string) (int, string) {
+	s := httptest.NewServer(probeHandler(modules))
+	defer s.Close()
+
+	resp, err := http.Get(s.URL + "?" + url.Values{"target": {target}, "module": {module}}.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return resp.StatusCode, string(b)
+}
+
+func TestProbeHandler(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "smtpd_exporter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "relay1.txt"), []byte(testStats), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	stats := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/relay1.txt" {
+			http.NotFound(w, r)
+			return
+		}
+
+		w.Write([]byte(testStats)) // nolint:errcheck
+	}))
+	defer stats.Close()
+
+	s := newFakeSMTP(t, false)
+	defer s.listener.Close()
+
+	modules := map[string]*Module{
+		"smtp":    {Prober: "smtp", Timeout: 2 * time.Second, SMTP: SMTPModule{Helo: "probe.example.org"}},
+		"command": {Prober: "command", Timeout: 2 * time.Second, Command: CommandModule{Args: []string{"cat", dir + "/{target}.txt"}}},
+		"file":    {Prober: "file", Timeout: 2 * time.Second, File: FileModule{URL: dir + "/{target}.txt"}},
+		"http":    {Prober: "file", Timeout: 2 * time.Second, File: FileModule{URL: stats.URL + "/{target}.txt"}},
+	}
+
+	code, body := probe(t, modules, s.listener.Addr().String(), "smtp")
+	assert.Equal(http.StatusOK, code)
+	assert.Contains(body, "probe_success 1")
+	assert.Contains(body, `smtpd_probe_extension_info{extension="STARTTLS",listener="`+s.listener.Addr().String()+`"} 1`)
+
+	for _, module := range []string{"command", "file", "http"} {
+		code, body = probe(t, modules, "relay1", module)
+		assert.Equal(http.StatusOK, code, module)
+		assert.Contains(body, "probe_success 1", module)
+		assert.Contains(body, "smtpd_delivery_ok 42", module)
+		assert.Contains(body, "smtpd_delivery_tempfail 7", module)
+
+		code, body = probe(t, modules, "relay2", module)
+		assert.Equal(http.StatusOK, code, module)
+		assert.Contains(body, "probe_success 0", module)
+		assert.NotContains(body, "smtpd_delivery_ok", module)
+	}
+
+	code, _ = probe(t, modules, "relay1", "unknown")
+	assert.Equal(http.StatusBadRequest, code)
+
+	for _, target := range []string{"", "-oProxyCommand=id", "relay1;id", "../relay1"} {
+		code, _ = probe(t, modules, target, "command")
+		assert.Equal(http.StatusBadRequest, code, target)
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	tables := []struct {
+		name   string
+		config string
+		err    string
+	}{
+		{"valid", `
+modules:
+  smtp_starttls:
+    prober: smtp
+    timeout: 5s
+    smtp:
+      tls: starttls
+      helo: monitor.example.org
+  smtps:
+    prober: smtp
+    smtp:
+      tls: smtps
+  ssh:
+    prober: command
+    command:
+      args: [ssh, "{target}", smtpctl, show, stats]
+`, ""},
+		{"unknown prober", "modules:\n  x:\n    prober: icmp\n", "unknown prober"},
+		{"unknown field", "modules:\n  x:\n    prober: smtp\n    tls: smtps\n", "could not parse config"},
+		{"invalid tls", "modules:\n  x:\n    prober: smtp\n    smtp:\n      tls: tls\n", "invalid tls mode"},
+		{"missing args", "modules:\n  x:\n    prober: command\n", "missing command args"},
+		{"missing url", "modules:\n  x:\n    prober: file\n", "missing file url"},
+		{"metric without group", "metrics: [{name: smtpd_x, help: x, regex: x}]\n", "exactly one group"},
+		{"metric label", "metrics: [{name: smtpd_x, help: x, regex: 'x=(\\d+)', labels: {instance_name: mx}}]\n", "invalid label name"},
+		{"duplicate metric", "metrics: [{name: smtpd_x, help: x, regex: '(x)'}, {name: smtpd_x, help: x, regex: '(x)'}]\n", "duplicate name"},
+	}
+
+	for _, table := range tables {
+		t.Run(table.name, func(t *testing.T) {
+			assert := assert.New(t)
+
+			f, err := ioutil.TempFile("", "smtpd_exporter")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.Remove(f.Name())
+
+			if _, err := f.WriteString(table.config); err != nil {
+				t.Fatal(err)
+			}
+
+			f.Close()
+
+			c, err := LoadConfig(f.Name())
+			if table.err != "" {
+				assert.NotNil(err)
+				assert.True(strings.Contains(err.Error(), table.err), err.Error())
+
+				return
+			}
+
+			assert.Nil(err)
+			assert.Equal(5*time.Second, c.Modules["smtp_starttls"].Timeout)
+			assert.Equal(tlsStartTLS, c.Modules["smtp_starttls"].SMTP.TLS)
+			assert.Equal("monitor.example.org", c.Modules["smtp_starttls"].SMTP.Helo)
+			assert.Equal(defaultModuleHelo, c.Modules["smtps"].SMTP.Helo)
+			assert.Equal(defaultModuleTimeout, c.Modules["ssh"].Timeout)
+			assert.Equal(defaultMetrics(), c.Metrics)
+			assert.Equal([]string{"ssh", "{target}", "smtpctl", "show", "stats"}, c.Modules["ssh"].Command.Args)
+		})
+	}
+}
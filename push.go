@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/push"
+	dto "github.com/prometheus/client_model/go"
+	log "github.com/sirupsen/logrus"
+)
+
+// pushTimeout limits a single request to the Pushgateway.
+const pushTimeout = 30 * time.Second
+
+// PushConfig holds the settings of the push mode.
+type PushConfig struct {
+	URL          string
+	Job          string
+	Grouping     []string
+	Username     string
+	PasswordFile string
+	CAFile       string
+	CertFile     string
+	KeyFile      string
+	InsecureTLS  bool
+}
+
+// Pusher sends the metrics to a Pushgateway.
+type Pusher struct {
+	pusher *push.Pusher
+}
+
+// NewPusher creates a pusher of the metrics of g. Without grouping labels
+// the metrics are grouped by the hostname as instance.
+func NewPusher(g prometheus.Gatherer, cfg PushConfig) (*Pusher, error) {
+	client, err := pushClient(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	p := push.New(cfg.URL, cfg.Job).Gatherer(withoutRuntimeMetrics(g)).Client(client)
+
+	grouping := cfg.Grouping
+	if len(grouping) == 0 {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return nil, fmt.Errorf("could not get hostname: %w", err)
+		}
+
+		grouping = []string{"instance=" + hostname}
+	}
+
+	for _, g := range grouping {
+		i := strings.Index(g, "=")
+		if i < 1 {
+			return nil, fmt.Errorf("invalid grouping label: %s", g)
+		}
+
+		p = p.Grouping(g[:i], g[i+1:])
+	}
+
+	if cfg.Username != "" {
+		password, err := ioutil.ReadFile(cfg.PasswordFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not read push password: %w", err)
+		}
+
+		p = p.BasicAuth(cfg.Username, strings.TrimSpace(string(password)))
+	}
+
+	return &Pusher{pusher: p}, nil
+}
+
+// withoutRuntimeMetrics leaves the go and process metrics of g out like the
+// textfile does, they describe the exporter and not the pushed job.
+func withoutRuntimeMetrics(g prometheus.Gatherer) prometheus.Gatherer {
+	return prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		mfs, err := g.Gather()
+
+		families := make([]*dto.MetricFamily, 0, len(mfs))
+
+		for _, mf := range mfs {
+			if strings.HasPrefix(mf.GetName(), "go_") || strings.HasPrefix(mf.GetName(), "process_") {
+				continue
+			}
+
+			families = append(families, mf)
+		}
+
+		return families, err
+	})
+}
+
+// pushClient creates a http client with the TLS settings.
+func pushClient(cfg PushConfig) (*http.Client, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: cfg.InsecureTLS} // nolint:gosec
+
+	if cfg.CAFile != "" {
+		ca, err := ioutil.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not read push ca: %w", err)
+		}
+
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("no certificates in push ca: %s", cfg.CAFile)
+		}
+	}
+
+	if cfg.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not load push client certificate: %w", err)
+		}
+
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return &http.Client{
+		Timeout:   pushTimeout,
+		Transport: &http.Transport{Proxy: http.ProxyFromEnvironment, TLSClientConfig: tlsConfig},
+	}, nil
+}
+
+// Push replaces the metrics of the group.
+func (p *Pusher) Push() error {
+	if err := p.pusher.Push(); err != nil {
+		return fmt.Errorf("could not push metrics: %w", err)
+	}
+
+	return nil
+}
+
+// Delete removes the group from the Pushgateway.
+func (p *Pusher) Delete() error {
+	if err := p.pusher.Delete(); err != nil {
+		return fmt.Errorf("could not delete metrics: %w", err)
+	}
+
+	return nil
+}
+
+// Run pushes the metrics every interval until ctx is done and deletes the
+// group then.
+func (p *Pusher) Run(ctx context.Context, interval time.Duration) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := p.Push(); err != nil {
+				log.Error(err)
+			}
+		case <-ctx.Done():
+			return p.Delete()
+		}
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"github.com/stretchr/testify/assert"
+)
+
+type pushRequest struct {
+	method   string
+	job      string
+	grouping map[string]string
+	user     string
+	password string
+	metrics  []string
+}
+
+// pushgateway is a stand-in recording the requests it gets.
+type pushgateway struct {
+	mux      sync.Mutex
+	requests []pushRequest
+}
+
+func (g *pushgateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	req := pushRequest{method: r.Method, grouping: map[string]string{}}
+
+	// the order of the grouping labels in the path is not fixed
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/metrics/job/"), "/")
+	req.job = parts[0]
+
+	for i := 1; i+1 < len(parts); i += 2 {
+		req.grouping[parts[i]] = parts[i+1]
+	}
+
+	req.user, req.password, _ = r.BasicAuth()
+
+	if r.Method == http.MethodPut {
+		dec := expfmt.NewDecoder(r.Body, expfmt.ResponseFormat(r.Header))
+
+		for {
+			mf := &dto.MetricFamily{}
+			if err := dec.Decode(mf); err != nil {
+				break
+			}
+
+			req.metrics = append(req.metrics, mf.GetName())
+		}
+	}
+
+	g.mux.Lock()
+	g.requests = append(g.requests, req)
+	g.mux.Unlock()
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (g *pushgateway) received() []pushRequest {
+	g.mux.Lock()
+	defer g.mux.Unlock()
+
+	return append([]pushRequest{}, g.requests...)
+}
+
+func pushRegistry() *prometheus.Registry {
+	reg := prometheus.NewRegistry()
+	c := prometheus.NewCounter(prometheus.CounterOpts{Name: "smtpd_delivery_ok", Help: "Shows how often a delivery was ok."})
+	c.Add(42)
+	reg.MustRegister(c, prometheus.NewGoCollector())
+
+	return reg
+}
+
+func TestPusher(t *testing.T) {
+	assert := assert.New(t)
+	g := &pushgateway{}
+	s := httptest.NewServer(g)
+	defer s.Close()
+
+	dir, err := ioutil.TempDir("", "smtpd_exporter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	passwordFile := filepath.Join(dir, "password")
+	if err := ioutil.WriteFile(passwordFile, []byte("secret\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := NewPusher(pushRegistry(), PushConfig{
+		URL:          s.URL,
+		Job:          "smtpd",
+		Grouping:     []string{"instance=relay1", "site=dc1"},
+		Username:     "smtpd",
+		PasswordFile: passwordFile,
+	})
+	assert.Nil(err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+
+	go func() {
+		done <- p.Run(ctx, 10*time.Millisecond)
+	}()
+
+	assert.True(waitFor(func() bool { return len(g.received()) >= 2 }))
+	cancel()
+	assert.Nil(<-done)
+
+	requests := g.received()
+	push, last := requests[0], requests[len(requests)-1]
+
+	assert.Equal(pushRequest{
+		method:   http.MethodPut,
+		job:      "smtpd",
+		grouping: map[string]string{"instance": "relay1", "site": "dc1"},
+		user:     "smtpd",
+		password: "secret",
+		metrics:  []string{"smtpd_delivery_ok"},
+	}, push)
+	assert.Equal(pushRequest{
+		method:   http.MethodDelete,
+		job:      "smtpd",
+		grouping: map[string]string{"instance": "relay1", "site": "dc1"},
+		user:     "smtpd",
+		password: "secret",
+	}, last)
+}
+
+func TestPusherTLS(t *testing.T) {
+	assert := assert.New(t)
+	g := &pushgateway{}
+	s := httptest.NewTLSServer(g)
+	defer s.Close()
+
+	dir, err := ioutil.TempDir("", "smtpd_exporter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// the certificate of the server is unknown
+	p, err := NewPusher(pushRegistry(), PushConfig{URL: s.URL, Job: "smtpd"})
+	assert.Nil(err)
+	assert.NotNil(p.Push())
+
+	caFile := filepath.Join(dir, "ca.crt")
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: s.Certificate().Raw})
+
+	if err := ioutil.WriteFile(caFile, ca, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	p, err = NewPusher(pushRegistry(), PushConfig{URL: s.URL, Job: "smtpd", CAFile: caFile})
+	assert.Nil(err)
+	assert.Nil(p.Push())
+
+	hostname, err := os.Hostname()
+	assert.Nil(err)
+	assert.Equal(map[string]string{"instance": hostname}, g.received()[0].grouping)
+
+	p, err = NewPusher(pushRegistry(), PushConfig{URL: s.URL, Job: "smtpd", InsecureTLS: true})
+	assert.Nil(err)
+	assert.Nil(p.Push())
+}
+
+func TestNewPusherErrors(t *testing.T) {
+	assert := assert.New(t)
+
+	_, err := NewPusher(pushRegistry(), PushConfig{URL: "http://localhost:9091", Job: "smtpd", Grouping: []string{"relay1"}})
+	assert.NotNil(err)
+
+	_, err = NewPusher(pushRegistry(), PushConfig{URL: "http://localhost:9091", Job: "smtpd", Username: "smtpd"})
+	assert.NotNil(err)
+
+	_, err = NewPusher(pushRegistry(), PushConfig{URL: "http://localhost:9091", Job: "smtpd", CAFile: "/nonexistent/ca.crt"})
+	assert.NotNil(err)
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Reloader reads the config file again and applies it to the collect loops
+// and the /probe modules, and reads the web config again.
+type Reloader struct {
+	// Path is the config file, without it only the web config gets read.
+	Path       string
+	Collectors *Collectors
+	// Web is nil in the modes that send the metrics instead of serving them.
+	Web *WebServer
+
+	// reload keeps a SIGHUP and a /-/reload from applying at once
+	reload sync.Mutex
+
+	mux   sync.Mutex
+	probe http.Handler
+}
+
+// NewReloader creates a reloader that starts with the loaded config.
+func NewReloader(path string, config *Config, c *Collectors, web *WebServer) *Reloader {
+	r := &Reloader{Path: path, Collectors: c, Web: web}
+	r.setProbe(config)
+
+	return r
+}
+
+// Reload applies the config file and the web config. Both get read and
+// checked first, a broken one leaves everything as it is.
+func (r *Reloader) Reload() error {
+	r.reload.Lock()
+	defer r.reload.Unlock()
+
+	var config *Config
+
+	if r.Path != "" {
+		c, err := LoadConfig(r.Path)
+		if err != nil {
+			return err
+		}
+
+		config = c
+	}
+
+	if err := r.Collectors.Check(config); err != nil {
+		return err
+	}
+
+	var web *webState
+
+	if r.Web != nil {
+		w, err := r.Web.load()
+		if err != nil {
+			return err
+		}
+
+		web = w
+	}
+
+	if err := r.Collectors.Apply(config); err != nil {
+		return err
+	}
+
+	if r.Web != nil {
+		r.Web.set(web)
+	}
+	r.setProbe(config)
+
+	log.WithFields(log.Fields{"file": r.Path}).Info("reloaded config")
+
+	return nil
+}
+
+func (r *Reloader) setProbe(config *Config) {
+	var modules map[string]*Module
+	if config != nil {
+		modules = config.Modules
+	}
+
+	r.mux.Lock()
+	r.probe = probeHandler(modules)
+	r.mux.Unlock()
+}
+
+// ServeProbe serves /probe with the modules of the current config.
+func (r *Reloader) ServeProbe(w http.ResponseWriter, req *http.Request) {
+	r.mux.Lock()
+	probe := r.probe
+	r.mux.Unlock()
+
+	probe.ServeHTTP(w, req)
+}
+
+// Handler serves /-/reload. It only reloads for users of the web config, as
+// anyone reaching the exporter could trigger it otherwise.
+func (r *Reloader) Handler() http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost && req.Method != http.MethodPut {
+			w.Header().Set("Allow", "POST, PUT")
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+
+			return
+		}
+
+		if !r.Web.Authenticated() {
+			http.Error(w, "reload needs basic_auth_users in the web config", http.StatusForbidden)
+			return
+		}
+
+		if err := r.Reload(); err != nil {
+			log.WithFields(log.Fields{"error": err}).Error("could not reload config")
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReloader(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "reload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	stats := filepath.Join(dir, "mx")
+	if err := ioutil.WriteFile(stats, []byte("scheduler.delivery.ok=1\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(dir, "config.yml")
+	if err := ioutil.WriteFile(path, []byte("instances:\n  - name: mx\n    file: "+stats+"\n    interval: 1h\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	webPath := filepath.Join(dir, "web.yml")
+	writeWebConfig(t, webPath, "")
+
+	web, err := NewWebServer(webPath, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := NewCollectors(NewStatsAPI(), nil)
+	defer c.Stop()
+
+	r := NewReloader(path, nil, c, web)
+	web.Handler = r.Handler()
+
+	reload := func(method, user string) int {
+		req := httptest.NewRequest(method, "/-/reload", nil)
+		if user != "" {
+			req.SetBasicAuth(user, "secret")
+		}
+
+		w := httptest.NewRecorder()
+		web.ServeHTTP(w, req)
+
+		return w.Code
+	}
+
+	// without users anyone could reload
+	assert.Equal(http.StatusForbidden, reload("POST", ""))
+
+	writeWebConfig(t, webPath, "basic_auth_users:\n  alice: "+testHash+"\n")
+	assert.Nil(os.Chtimes(webPath, time.Now(), time.Now().Add(time.Minute)))
+
+	assert.Equal(http.StatusUnauthorized, reload("POST", ""))
+	assert.Equal(http.StatusMethodNotAllowed, reload("GET", "alice"))
+	assert.Equal(http.StatusNoContent, reload("POST", "alice"))
+
+	c.current.RLock()
+	assert.Len(c.current.metrics, len(metrics))
+	assert.Equal("mx", c.current.metrics[0].Labels["instance_name"])
+	c.current.RUnlock()
+
+	// a broken config keeps the running one
+	if err := ioutil.WriteFile(path, []byte("instances: [{name: mx, socket: /a, file: /b}]\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(http.StatusInternalServerError, reload("PUT", "alice"))
+
+	c.current.RLock()
+	assert.Len(c.current.metrics, len(metrics))
+	c.current.RUnlock()
+
+	// so does a broken web config
+	config := "instances:\n  - name: mx\n    file: " + stats + "\n  - name: submission\n    file: " + stats + "\n"
+	if err := ioutil.WriteFile(path, []byte(config), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	missing := filepath.Join(dir, "missing.pem")
+	writeWebConfig(t, webPath, "tls_server_config:\n  cert_file: "+missing+"\n  key_file: "+missing+"\n")
+	assert.Nil(os.Chtimes(webPath, time.Now(), time.Now().Add(2*time.Minute)))
+
+	assert.NotNil(r.Reload())
+
+	c.current.RLock()
+	assert.Len(c.current.metrics, len(metrics))
+	c.current.RUnlock()
+	// and a changed web config only gets used with a working config
+	writeWebConfig(t, webPath, "basic_auth_users:\n  bob: "+testHash+"\n")
+	assert.Nil(os.Chtimes(webPath, time.Now(), time.Now().Add(3*time.Minute)))
+
+	if err := ioutil.WriteFile(path, []byte("instances: []\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(s, j string) { *source, *logJournald = s, j }(*source, *logJournald)
+	*source, *logJournald = "stdin", "-"
+
+	assert.NotNil(r.Reload())
+
+	web.mux.Lock()
+	assert.Contains(web.cfg.Users, "alice")
+	web.mux.Unlock()
+}
+
+func TestReloaderMetrics(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "reload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	stats := filepath.Join(dir, "mx")
+	if err := ioutil.WriteFile(stats, []byte("scheduler.delivery.ok=3\nscheduler.delivery.tempfail=2\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(dir, "config.yml")
+	instances := "instances:\n  - name: mx\n    file: " + stats + "\n    interval: 1h\n"
+
+	if err := ioutil.WriteFile(path, []byte(instances), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	c := NewCollectors(NewStatsAPI(), nil)
+	defer c.Stop()
+
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(c)
+
+	// family returns the smtpd_delivery_ok family once it has the value
+	family := func(value float64) *dto.MetricFamily {
+		var found *dto.MetricFamily
+
+		waitFor(func() bool {
+			mfs, err := reg.Gather()
+			if err != nil {
+				return false
+			}
+
+			for _, mf := range mfs {
+				if mf.GetName() == "smtpd_delivery_ok" && mf.GetMetric()[0].GetCounter().GetValue() == value {
+					found = mf
+					return true
+				}
+			}
+
+			return false
+		})
+
+		return found
+	}
+
+	tempfail := func() *Metric {
+		c.current.RLock()
+		defer c.current.RUnlock()
+
+		for _, m := range c.current.metrics {
+			if m.Name == "smtpd_delivery_tempfail" {
+				return m
+			}
+		}
+
+		return nil
+	}
+
+	r := NewReloader(path, nil, c, nil)
+	assert.Nil(r.Reload())
+
+	mf := family(3)
+	if assert.NotNil(mf) {
+		assert.Equal("Shows how often a delivery was ok.", mf.GetHelp())
+	}
+
+	running := tempfail()
+
+	// a new help and label for ok, tempfail stays and permfail is gone
+	config := instances + `metrics:
+  - name: smtpd_delivery_ok
+    help: Deliveries that went fine.
+    regex: 'scheduler\.delivery\.ok=(\d+)'
+    labels:
+      site: dc1
+  - name: smtpd_delivery_tempfail
+    help: Shows how often a delivery tempfailed.
+    regex: 'scheduler\.delivery\.tempfail=(?P<number>\d+)'
+`
+	if err := ioutil.WriteFile(path, []byte(config), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Nil(r.Reload())
+
+	mf = family(3)
+	if assert.NotNil(mf) {
+		assert.Equal("Deliveries that went fine.", mf.GetHelp())
+		assert.Len(mf.GetMetric()[0].GetLabel(), 2)
+		assert.Equal("site", mf.GetMetric()[0].GetLabel()[1].GetName())
+	}
+
+	// the unchanged series keeps counting
+	assert.True(running == tempfail())
+	assert.Equal(float64(2), testutil.ToFloat64(running.Counter))
+
+	c.current.RLock()
+	assert.Len(c.current.metrics, 2)
+	c.current.RUnlock()
+
+	// a broken definition keeps the running ones
+	if err := ioutil.WriteFile(path, []byte(instances+"metrics: [{name: smtpd_delivery_ok, help: ok, regex: ok}]\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	assert.NotNil(r.Reload())
+	assert.True(running == tempfail())
+}
+
+func TestWebServerShutdown(t *testing.T) {
+	assert := assert.New(t)
+
+	started := make(chan struct{})
+	finish := make(chan struct{})
+
+	s, err := NewWebServer("", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-finish
+		_, _ = w.Write([]byte("metrics"))
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	served := make(chan error, 1)
+
+	go func() { served <- s.Serve(l) }()
+
+	scraped := make(chan string, 1)
+
+	go func() {
+		res, err := http.Get("http://" + l.Addr().String() + "/metrics")
+		if err != nil {
+			scraped <- err.Error()
+			return
+		}
+		defer res.Body.Close()
+
+		body, _ := ioutil.ReadAll(res.Body)
+		scraped <- string(body)
+	}()
+
+	<-started
+
+	shutdown := make(chan error, 1)
+
+	go func() { shutdown <- s.Shutdown(context.Background()) }()
+
+	// the running scrape finishes
+	close(finish)
+	assert.Equal("metrics", <-scraped)
+	assert.Nil(<-shutdown)
+	assert.Equal(http.ErrServerClosed, <-served)
+
+	assert.Equal(http.ErrServerClosed, s.Serve(l))
+}
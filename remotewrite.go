@@ -0,0 +1,364 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	log "github.com/sirupsen/logrus"
+)
+
+// maxErrorBody limits how much of an error response gets logged.
+const maxErrorBody = 256
+
+// writeRequest is the remote_write WriteRequest of prometheus/prompb.
+type writeRequest struct {
+	Timeseries []*timeSeries `protobuf:"bytes,1,rep,name=timeseries,proto3"`
+}
+
+func (m *writeRequest) Reset()         { *m = writeRequest{} }
+func (m *writeRequest) String() string { return proto.CompactTextString(m) }
+func (*writeRequest) ProtoMessage()    {}
+
+type timeSeries struct {
+	Labels  []*label  `protobuf:"bytes,1,rep,name=labels,proto3"`
+	Samples []*sample `protobuf:"bytes,2,rep,name=samples,proto3"`
+}
+
+func (m *timeSeries) Reset()         { *m = timeSeries{} }
+func (m *timeSeries) String() string { return proto.CompactTextString(m) }
+func (*timeSeries) ProtoMessage()    {}
+
+type label struct {
+	Name  string `protobuf:"bytes,1,opt,name=name,proto3"`
+	Value string `protobuf:"bytes,2,opt,name=value,proto3"`
+}
+
+func (m *label) Reset()         { *m = label{} }
+func (m *label) String() string { return proto.CompactTextString(m) }
+func (*label) ProtoMessage()    {}
+
+type sample struct {
+	Value     float64 `protobuf:"fixed64,1,opt,name=value,proto3"`
+	Timestamp int64   `protobuf:"varint,2,opt,name=timestamp,proto3"`
+}
+
+func (m *sample) Reset()         { *m = sample{} }
+func (m *sample) String() string { return proto.CompactTextString(m) }
+func (*sample) ProtoMessage()    {}
+
+// RemoteWriteConfig holds the settings of the remote_write sender.
+type RemoteWriteConfig struct {
+	URL          string
+	Labels       []string
+	Username     string
+	PasswordFile string
+	Timeout      time.Duration
+	BufferSize   int
+	BatchSize    int
+	MinBackoff   time.Duration
+	MaxBackoff   time.Duration
+	MaxRetries   int
+}
+
+// recoverableError is a failed request worth retrying.
+type recoverableError struct {
+	error
+}
+
+// RemoteWriter sends the collected samples to a remote_write receiver. The
+// samples are buffered until they are sent, the oldest get dropped when the
+// buffer is full.
+type RemoteWriter struct {
+	cfg      RemoteWriteConfig
+	client   *http.Client
+	gatherer prometheus.Gatherer
+	labels   []*label
+	password string
+
+	mux     sync.Mutex
+	pending []*timeSeries
+
+	dropped *prometheus.CounterVec
+	buffer  prometheus.Gauge
+}
+
+// NewRemoteWriter creates a sender of the metrics of g. Without labels the
+// samples get instance=<hostname> and job=smtpd.
+func NewRemoteWriter(reg prometheus.Registerer, g prometheus.Gatherer, cfg RemoteWriteConfig) (*RemoteWriter, error) {
+	w := &RemoteWriter{
+		cfg:      cfg,
+		client:   &http.Client{Timeout: cfg.Timeout},
+		gatherer: g,
+		dropped: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "smtpd_exporter_remote_write_dropped_samples_total",
+			Help: "Samples dropped because the buffer was full or the receiver rejected them.",
+		}, []string{"reason"}),
+		buffer: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "smtpd_exporter_remote_write_pending_samples",
+			Help: "Samples waiting to be sent.",
+		}),
+	}
+
+	labels := cfg.Labels
+	if len(labels) == 0 {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return nil, fmt.Errorf("could not get hostname: %w", err)
+		}
+
+		labels = []string{"instance=" + hostname, "job=smtpd"}
+	}
+
+	for _, l := range labels {
+		i := strings.Index(l, "=")
+		if i < 1 {
+			return nil, fmt.Errorf("invalid remote write label: %s", l)
+		}
+
+		w.labels = append(w.labels, &label{Name: l[:i], Value: l[i+1:]})
+	}
+
+	if cfg.Username != "" {
+		password, err := ioutil.ReadFile(cfg.PasswordFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not read remote write password: %w", err)
+		}
+
+		w.password = strings.TrimSpace(string(password))
+	}
+
+	for _, c := range []prometheus.Collector{w.dropped, w.buffer} {
+		if err := reg.Register(c); err != nil {
+			return nil, err
+		}
+	}
+
+	return w, nil
+}
+
+// Collect adds the current metrics to the buffer.
+func (w *RemoteWriter) Collect(now time.Time) error {
+	mfs, err := w.gatherer.Gather()
+	if err != nil {
+		return fmt.Errorf("could not gather metrics: %w", err)
+	}
+
+	ts := now.UnixNano() / int64(time.Millisecond)
+
+	var series []*timeSeries
+
+	for _, mf := range mfs {
+		series = append(series, w.series(mf, ts)...)
+	}
+
+	w.mux.Lock()
+	defer w.mux.Unlock()
+
+	w.pending = append(w.pending, series...)
+
+	if over := len(w.pending) - w.cfg.BufferSize; over > 0 {
+		w.dropped.WithLabelValues("buffer").Add(float64(over))
+		w.pending = w.pending[over:]
+	}
+
+	w.buffer.Set(float64(len(w.pending)))
+
+	return nil
+}
+
+// series turns a metric family into time series with a single sample.
+func (w *RemoteWriter) series(mf *dto.MetricFamily, ts int64) []*timeSeries {
+	var series []*timeSeries
+
+	add := func(m *dto.Metric, name string, value float64, extra ...string) {
+		labels := []*label{{Name: "__name__", Value: name}}
+		for _, l := range m.Label {
+			labels = append(labels, &label{Name: l.GetName(), Value: l.GetValue()})
+		}
+
+		for i := 0; i+1 < len(extra); i += 2 {
+			labels = append(labels, &label{Name: extra[i], Value: extra[i+1]})
+		}
+
+		labels = append(labels, w.labels...)
+		sort.Slice(labels, func(i, j int) bool { return labels[i].Name < labels[j].Name })
+
+		series = append(series, &timeSeries{Labels: labels, Samples: []*sample{{Value: value, Timestamp: ts}}})
+	}
+
+	name := mf.GetName()
+
+	for _, m := range mf.Metric {
+		switch mf.GetType() {
+		case dto.MetricType_COUNTER:
+			add(m, name, m.GetCounter().GetValue())
+		case dto.MetricType_GAUGE:
+			add(m, name, m.GetGauge().GetValue())
+		case dto.MetricType_UNTYPED:
+			add(m, name, m.GetUntyped().GetValue())
+		case dto.MetricType_SUMMARY:
+			for _, q := range m.GetSummary().Quantile {
+				add(m, name, q.GetValue(), "quantile", formatFloat(q.GetQuantile()))
+			}
+
+			add(m, name+"_sum", m.GetSummary().GetSampleSum())
+			add(m, name+"_count", float64(m.GetSummary().GetSampleCount()))
+		case dto.MetricType_HISTOGRAM:
+			for _, b := range m.GetHistogram().Bucket {
+				add(m, name+"_bucket", float64(b.GetCumulativeCount()), "le", formatFloat(b.GetUpperBound()))
+			}
+
+			add(m, name+"_bucket", float64(m.GetHistogram().GetSampleCount()), "le", "+Inf")
+			add(m, name+"_sum", m.GetHistogram().GetSampleSum())
+			add(m, name+"_count", float64(m.GetHistogram().GetSampleCount()))
+		}
+	}
+
+	return series
+}
+
+func formatFloat(f float64) string {
+	if math.IsInf(f, 1) {
+		return "+Inf"
+	}
+
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// Flush sends the buffered samples in batches. Samples the receiver could
+// not take for now stay in the buffer.
+func (w *RemoteWriter) Flush() error {
+	for {
+		w.mux.Lock()
+		n := len(w.pending)
+		if n > w.cfg.BatchSize {
+			n = w.cfg.BatchSize
+		}
+		batch := w.pending[:n]
+		w.mux.Unlock()
+
+		if len(batch) == 0 {
+			return nil
+		}
+
+		err := w.sendWithRetries(batch)
+		if _, ok := err.(recoverableError); ok {
+			return err
+		}
+
+		if err != nil {
+			log.WithFields(log.Fields{"error": err, "samples": len(batch)}).Error("remote write rejected samples")
+			w.dropped.WithLabelValues("rejected").Add(float64(len(batch)))
+		}
+
+		w.mux.Lock()
+		// Collect might have dropped from the front meanwhile
+		for i := n - 1; i >= 0; i-- {
+			if i < len(w.pending) && w.pending[i] == batch[n-1] {
+				w.pending = w.pending[i+1:]
+				break
+			}
+		}
+
+		w.buffer.Set(float64(len(w.pending)))
+		w.mux.Unlock()
+	}
+}
+
+// sendWithRetries retries recoverable errors with doubling backoff.
+func (w *RemoteWriter) sendWithRetries(batch []*timeSeries) error {
+	backoff := w.cfg.MinBackoff
+
+	for try := 0; ; try++ {
+		err := w.send(batch)
+		if _, ok := err.(recoverableError); !ok || try >= w.cfg.MaxRetries {
+			return err
+		}
+
+		log.WithFields(log.Fields{"error": err, "backoff": backoff}).Debug("retrying remote write")
+		time.Sleep(backoff)
+
+		backoff *= 2
+		if backoff > w.cfg.MaxBackoff {
+			backoff = w.cfg.MaxBackoff
+		}
+	}
+}
+
+func (w *RemoteWriter) send(batch []*timeSeries) error {
+	data, err := proto.Marshal(&writeRequest{Timeseries: batch})
+	if err != nil {
+		return fmt.Errorf("could not marshal write request: %w", err)
+	}
+
+	req, err := http.NewRequest(http.MethodPost, w.cfg.URL, bytes.NewReader(snappy.Encode(nil, data)))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("User-Agent", "smtpd_exporter/"+Version)
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+
+	if w.cfg.Username != "" {
+		req.SetBasicAuth(w.cfg.Username, w.password)
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return recoverableError{fmt.Errorf("could not send samples: %w", err)}
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 == 2 {
+		io.Copy(ioutil.Discard, resp.Body) // nolint:errcheck
+		return nil
+	}
+
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, maxErrorBody))
+	err = fmt.Errorf("could not send samples: %s: %s", resp.Status, strings.TrimSpace(string(body)))
+
+	if resp.StatusCode/100 == 5 || resp.StatusCode == http.StatusTooManyRequests {
+		return recoverableError{err}
+	}
+
+	return err
+}
+
+// Run collects and sends the samples every interval until ctx is done and
+// tries to send the rest then.
+func (w *RemoteWriter) Run(ctx context.Context, interval time.Duration) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			if err := w.Collect(now); err != nil {
+				log.Error(err)
+			}
+
+			if err := w.Flush(); err != nil {
+				log.Error(err)
+			}
+		case <-ctx.Done():
+			return w.Flush()
+		}
+	}
+}
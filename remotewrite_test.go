@@ -0,0 +1,176 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+// receiver is a remote_write stand-in that decodes the requests and answers
+// with the queued status codes first.
+type receiver struct {
+	mux      sync.Mutex
+	statuses []int
+	requests []*writeRequest
+}
+
+func (r *receiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	if len(r.statuses) > 0 {
+		status := r.statuses[0]
+		r.statuses = r.statuses[1:]
+		w.WriteHeader(status)
+
+		return
+	}
+
+	if req.Header.Get("Content-Encoding") != "snappy" || req.Header.Get("Content-Type") != "application/x-protobuf" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	compressed, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	data, err := snappy.Decode(nil, compressed)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	wr := &writeRequest{}
+	if err := proto.Unmarshal(data, wr); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	r.requests = append(r.requests, wr)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// samples returns the received samples by their labels.
+func (r *receiver) samples() map[string]float64 {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	samples := map[string]float64{}
+
+	for _, wr := range r.requests {
+		for _, ts := range wr.Timeseries {
+			key := ""
+			for _, l := range ts.Labels {
+				key += l.Name + "=" + l.Value + ","
+			}
+
+			samples[key] = ts.Samples[0].Value
+		}
+	}
+
+	return samples
+}
+
+func testRemoteWriter(t *testing.T, url string, bufferSize, retries int) (*RemoteWriter, prometheus.Counter) {
+	reg := prometheus.NewRegistry()
+	c := prometheus.NewCounter(prometheus.CounterOpts{Name: "smtpd_delivery_ok", Help: "Shows how often a delivery was ok."})
+	h := prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name: "smtpd_message_attempts", Help: "Delivery attempts.", Buckets: []float64{1, 2},
+	})
+	h.Observe(1)
+	reg.MustRegister(c, h)
+
+	w, err := NewRemoteWriter(prometheus.NewRegistry(), reg, RemoteWriteConfig{
+		URL:        url,
+		Labels:     []string{"instance=relay1", "job=smtpd"},
+		Timeout:    time.Second,
+		BufferSize: bufferSize,
+		BatchSize:  2,
+		MinBackoff: time.Millisecond,
+		MaxBackoff: 2 * time.Millisecond,
+		MaxRetries: retries,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return w, c
+}
+
+func TestRemoteWriter(t *testing.T) {
+	assert := assert.New(t)
+	r := &receiver{statuses: []int{http.StatusServiceUnavailable, http.StatusTooManyRequests}}
+	s := httptest.NewServer(r)
+	defer s.Close()
+
+	w, c := testRemoteWriter(t, s.URL, 100, 2)
+	c.Add(42)
+
+	assert.Nil(w.Collect(time.Unix(1577836800, 0)))
+	assert.Nil(w.Flush())
+
+	assert.Equal(map[string]float64{
+		"__name__=smtpd_delivery_ok,instance=relay1,job=smtpd,":                     42,
+		"__name__=smtpd_message_attempts_bucket,instance=relay1,job=smtpd,le=1,":    1,
+		"__name__=smtpd_message_attempts_bucket,instance=relay1,job=smtpd,le=2,":    1,
+		"__name__=smtpd_message_attempts_bucket,instance=relay1,job=smtpd,le=+Inf,": 1,
+		"__name__=smtpd_message_attempts_sum,instance=relay1,job=smtpd,":            1,
+		"__name__=smtpd_message_attempts_count,instance=relay1,job=smtpd,":          1,
+	}, r.samples())
+
+	// batches of two samples
+	assert.Len(r.requests, 3)
+	assert.Equal(int64(1577836800000), r.requests[0].Timeseries[0].Samples[0].Timestamp)
+	assert.Equal(float64(0), testutil.ToFloat64(w.buffer))
+}
+
+func TestRemoteWriterOutage(t *testing.T) {
+	assert := assert.New(t)
+	r := &receiver{statuses: []int{
+		http.StatusBadGateway, http.StatusBadGateway, http.StatusBadGateway, http.StatusBadRequest,
+	}}
+	s := httptest.NewServer(r)
+	defer s.Close()
+
+	w, c := testRemoteWriter(t, s.URL, 8, 1)
+
+	// the receiver is down, samples stay buffered
+	assert.Nil(w.Collect(time.Unix(1577836800, 0)))
+	assert.NotNil(w.Flush())
+	assert.Equal(float64(6), testutil.ToFloat64(w.buffer))
+
+	// the oldest samples are dropped when the buffer is full
+	c.Add(1)
+	assert.Nil(w.Collect(time.Unix(1577836860, 0)))
+	assert.Equal(float64(8), testutil.ToFloat64(w.buffer))
+	assert.Equal(float64(4), testutil.ToFloat64(w.dropped.WithLabelValues("buffer")))
+
+	// the next batch is rejected for good and dropped, the rest gets sent
+	assert.Nil(w.Flush())
+	assert.Equal(float64(2), testutil.ToFloat64(w.dropped.WithLabelValues("rejected")))
+	assert.Equal(float64(0), testutil.ToFloat64(w.buffer))
+	assert.Equal(float64(1), r.samples()["__name__=smtpd_delivery_ok,instance=relay1,job=smtpd,"])
+}
+
+func TestNewRemoteWriterErrors(t *testing.T) {
+	assert := assert.New(t)
+	reg := prometheus.NewRegistry()
+
+	_, err := NewRemoteWriter(reg, reg, RemoteWriteConfig{Labels: []string{"relay1"}})
+	assert.NotNil(err)
+
+	_, err = NewRemoteWriter(reg, reg, RemoteWriteConfig{Username: "smtpd", PasswordFile: "/nonexistent"})
+	assert.NotNil(err)
+}
@@ -0,0 +1,506 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// default ports of plain and smtps listeners.
+const (
+	smtpPort  = 25
+	smtpsPort = 465
+)
+
+// SmtpdConfig holds the parts of a smtpd.conf we use for labeling.
+type SmtpdConfig struct {
+	Listeners []*Listener
+	Actions   []*Action
+	Matches   []*Match
+	Tables    map[string]*Table
+	PKIs      map[string]*PKI
+
+	macros map[string]string
+}
+
+// Listener is a "listen on" directive.
+type Listener struct {
+	Interface string
+	Family    string
+	Port      int
+	Tag       string
+	TLS       string
+	PKI       []string
+	Auth      string
+	Hostname  string
+}
+
+// Name is the tag of the listener or its interface and port.
+func (l *Listener) Name() string {
+	if l.Tag != "" {
+		return l.Tag
+	}
+
+	return l.Address()
+}
+
+// Address is the interface and port the listener is bound to.
+func (l *Listener) Address() string {
+	if l.Interface == "socket" {
+		return l.Interface
+	}
+
+	return net.JoinHostPort(l.Interface, strconv.Itoa(l.Port))
+}
+
+// Action is an "action" directive like `action "relay" relay host smtp://mx`.
+type Action struct {
+	Name    string
+	Method  string
+	Options []string
+}
+
+// Match is a "match" rule with its criteria and the action it leads to.
+type Match struct {
+	Criteria []Criterion
+	Action   string
+	Reject   bool
+}
+
+// Criterion is a single match condition like "from local" or "!for domain <t>".
+type Criterion struct {
+	Negate  bool
+	Keyword string
+	Kind    string
+	Value   string
+}
+
+// Table is a "table" directive. Values of file tables are read when parsing.
+type Table struct {
+	Name    string
+	Backend string
+	Path    string
+	Values  []string
+	Loaded  bool
+}
+
+// PKI holds the certificate and key paths of a "pki" directive.
+type PKI struct {
+	Name string
+	Cert string
+	Key  string
+}
+
+// LoadSmtpdConfig reads and parses a smtpd.conf.
+func LoadSmtpdConfig(path string) (*SmtpdConfig, error) {
+	c := &SmtpdConfig{
+		Tables: map[string]*Table{},
+		PKIs:   map[string]*PKI{},
+		macros: map[string]string{},
+	}
+
+	if err := c.parseFile(path); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+func (c *SmtpdConfig) parseFile(path string) error {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("could not read smtpd config: %w", err)
+	}
+
+	for i, line := range joinContinued(string(b)) {
+		tokens := c.tokenize(line)
+		if len(tokens) == 0 {
+			continue
+		}
+
+		if err := c.directive(filepath.Dir(path), tokens); err != nil {
+			return fmt.Errorf("%s:%d: %w", path, i+1, err)
+		}
+	}
+
+	return nil
+}
+
+// joinContinued splits the config into lines and joins the ones ending in a
+// backslash with their successors.
+func joinContinued(s string) []string {
+	var (
+		lines []string
+		cur   string
+	)
+
+	scanner := bufio.NewScanner(strings.NewReader(s))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasSuffix(line, `\`) {
+			cur += strings.TrimSuffix(line, `\`) + " "
+			continue
+		}
+
+		lines = append(lines, cur+line)
+		cur = ""
+	}
+
+	if cur != "" {
+		lines = append(lines, cur)
+	}
+
+	return lines
+}
+
+// tokenize splits a line into words. Quotes get removed, comments dropped,
+// macros expanded and braces, commas and equal signs become their own tokens.
+func (c *SmtpdConfig) tokenize(line string) []string {
+	var (
+		tokens []string
+		cur    strings.Builder
+		quoted bool
+		inWord bool
+	)
+
+	flush := func() {
+		if !inWord {
+			return
+		}
+
+		token := cur.String()
+		if strings.HasPrefix(token, "$") {
+			if v, ok := c.macros[token[1:]]; ok {
+				token = v
+			}
+		}
+
+		tokens = append(tokens, token)
+		cur.Reset()
+
+		inWord = false
+	}
+
+	for _, r := range line {
+		switch {
+		case quoted && r == '"':
+			quoted = false
+			tokens = append(tokens, cur.String())
+			cur.Reset()
+
+			inWord = false
+		case quoted:
+			cur.WriteRune(r)
+		case r == '"':
+			flush()
+
+			quoted = true
+		case r == '#':
+			flush()
+			return tokens
+		case r == ' ' || r == '\t':
+			flush()
+		case r == '{' || r == '}' || r == ',' || r == '=':
+			flush()
+
+			tokens = append(tokens, string(r))
+		default:
+			cur.WriteRune(r)
+
+			inWord = true
+		}
+	}
+
+	flush()
+
+	return tokens
+}
+
+func (c *SmtpdConfig) directive(dir string, tokens []string) error {
+	// macro definition: name = "value"
+	if len(tokens) >= 3 && tokens[1] == "=" {
+		c.macros[tokens[0]] = strings.Join(tokens[2:], " ")
+		return nil
+	}
+
+	switch tokens[0] {
+	case "include":
+		if len(tokens) < 2 { //nolint:gomnd
+			return fmt.Errorf("missing include file")
+		}
+
+		path := tokens[1]
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(dir, path)
+		}
+
+		return c.parseFile(path)
+	case "table":
+		return c.table(tokens[1:])
+	case "pki":
+		return c.pki(tokens[1:])
+	case "listen":
+		return c.listen(tokens[1:])
+	case "action":
+		return c.action(tokens[1:])
+	case "match":
+		return c.match(tokens[1:])
+	}
+
+	return nil
+}
+
+// table parses `table name file:/path` and `table name { a, b = c }`.
+func (c *SmtpdConfig) table(tokens []string) error {
+	if len(tokens) < 2 { //nolint:gomnd
+		return fmt.Errorf("invalid table directive")
+	}
+
+	t := &Table{Name: tokens[0]}
+	c.Tables[t.Name] = t
+
+	if tokens[1] == "{" {
+		t.Backend = "static"
+		t.Loaded = true
+
+		// only keys count, values of "key = value" pairs get skipped
+		for i := 2; i < len(tokens) && tokens[i] != "}"; i++ {
+			switch {
+			case tokens[i] == ",":
+			case tokens[i] == "=":
+				i++
+			default:
+				t.Values = append(t.Values, tokens[i])
+			}
+		}
+
+		return nil
+	}
+
+	t.Backend = "file"
+	t.Path = tokens[1]
+
+	if i := strings.Index(tokens[1], ":"); i > 0 {
+		t.Backend = tokens[1][:i]
+		t.Path = tokens[1][i+1:]
+	}
+
+	if t.Backend != "file" {
+		return nil
+	}
+
+	values, err := readTableFile(t.Path)
+	if err == nil {
+		t.Values = values
+		t.Loaded = true
+	}
+
+	return nil
+}
+
+// readTableFile returns the keys of a file table, the first word on each line.
+func readTableFile(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var keys []string
+
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		fields := strings.Fields(strings.SplitN(s.Text(), "#", 2)[0]) //nolint:gomnd
+		if len(fields) > 0 {
+			keys = append(keys, strings.TrimSuffix(fields[0], ":"))
+		}
+	}
+
+	return keys, s.Err()
+}
+
+// pki parses `pki name cert "path"` and `pki name key "path"`.
+func (c *SmtpdConfig) pki(tokens []string) error {
+	minTokens := 3
+	if len(tokens) < minTokens {
+		return fmt.Errorf("invalid pki directive")
+	}
+
+	p, ok := c.PKIs[tokens[0]]
+	if !ok {
+		p = &PKI{Name: tokens[0]}
+		c.PKIs[p.Name] = p
+	}
+
+	switch tokens[1] {
+	case "cert":
+		p.Cert = tokens[2]
+	case "key":
+		p.Key = tokens[2]
+	}
+
+	return nil
+}
+
+// listen parses `listen on interface [options]`.
+func (c *SmtpdConfig) listen(tokens []string) error {
+	if len(tokens) < 2 || tokens[0] != "on" { //nolint:gomnd
+		return fmt.Errorf("invalid listen directive")
+	}
+
+	l := &Listener{Interface: tokens[1]}
+
+	for i := 2; i < len(tokens); i++ {
+		next := func() string {
+			if i+1 < len(tokens) {
+				i++
+				return tokens[i]
+			}
+
+			return ""
+		}
+
+		switch tokens[i] {
+		case "family":
+			l.Family = next()
+		case "port":
+			value := next()
+
+			port, err := strconv.Atoi(value)
+			if err != nil {
+				return fmt.Errorf("invalid listen port: %s", value)
+			}
+
+			l.Port = port
+		case "tag":
+			l.Tag = next()
+		case "hostname":
+			l.Hostname = next()
+		case "pki":
+			l.PKI = append(l.PKI, next())
+		case "tls", "tls-require", "smtps":
+			l.TLS = tokens[i]
+		case "auth", "auth-optional":
+			l.Auth = tokens[i]
+
+			if i+1 < len(tokens) && strings.HasPrefix(tokens[i+1], "<") {
+				i++
+			}
+		case "ca", "filter", "hostnames", "senders":
+			next()
+		}
+	}
+
+	if l.Port == 0 && l.Interface != "socket" {
+		l.Port = smtpPort
+		if l.TLS == "smtps" {
+			l.Port = smtpsPort
+		}
+	}
+
+	c.Listeners = append(c.Listeners, l)
+
+	return nil
+}
+
+// action parses `action name method [options]`.
+func (c *SmtpdConfig) action(tokens []string) error {
+	if len(tokens) < 2 { //nolint:gomnd
+		return fmt.Errorf("invalid action directive")
+	}
+
+	c.Actions = append(c.Actions, &Action{Name: tokens[0], Method: tokens[1], Options: tokens[2:]})
+
+	return nil
+}
+
+// match parses `match [!]criteria... action name` and `match ... reject`.
+func (c *SmtpdConfig) match(tokens []string) error {
+	m := &Match{}
+
+	for i := 0; i < len(tokens); i++ {
+		next := func() string {
+			if i+1 < len(tokens) {
+				i++
+				return tokens[i]
+			}
+
+			return ""
+		}
+
+		cr := Criterion{Keyword: tokens[i]}
+		if cr.Keyword == "!" {
+			cr.Negate = true
+			cr.Keyword = next()
+		} else if strings.HasPrefix(cr.Keyword, "!") {
+			cr.Negate = true
+			cr.Keyword = cr.Keyword[1:]
+		}
+
+		switch cr.Keyword {
+		case "action":
+			m.Action = next()
+			continue
+		case "reject":
+			m.Reject = true
+			continue
+		case "from", "for":
+			cr.Kind = next()
+
+			switch cr.Kind {
+			case "src", "domain", "rcpt-to", "mail-from":
+				cr.Value = next()
+				if cr.Value == "regex" {
+					cr.Kind += " regex"
+					cr.Value = next()
+				}
+			case "auth", "rdns":
+				if i+1 < len(tokens) && strings.HasPrefix(tokens[i+1], "<") {
+					cr.Value = next()
+				}
+			}
+		case "auth":
+			if i+1 < len(tokens) && strings.HasPrefix(tokens[i+1], "<") {
+				cr.Value = next()
+			}
+		case "tag", "helo", "mail-from", "rcpt-to":
+			cr.Value = next()
+		}
+
+		m.Criteria = append(m.Criteria, cr)
+	}
+
+	if m.Action == "" && !m.Reject {
+		return fmt.Errorf("match without action")
+	}
+
+	c.Matches = append(c.Matches, m)
+
+	return nil
+}
+
+// ConfigInfo creates the smtpd_config_info metric with a series for every
+// listener and action.
+func (c *SmtpdConfig) ConfigInfo() *prometheus.GaugeVec {
+	info := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "smtpd_config_info",
+		Help: "Listeners and actions configured in smtpd.conf.",
+	}, []string{"kind", "name", "address", "tls", "auth", "method"})
+
+	for _, l := range c.Listeners {
+		info.WithLabelValues("listener", l.Name(), l.Address(), l.TLS, l.Auth, "").Set(1)
+	}
+
+	for _, a := range c.Actions {
+		info.WithLabelValues("action", a.Name, "", "", "", a.Method).Set(1)
+	}
+
+	return info
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+const testSmtpdConf = `# test config
+ext = "192.0.2.10"
+
+pki mx.example.org cert "/etc/ssl/mx.example.org.crt"
+pki mx.example.org key "/etc/ssl/private/mx.example.org.key"
+
+table aliases file:/etc/mail/aliases
+table domains { example.org, \
+	example.net }
+table relays { 198.51.100.0/24 }
+
+listen on $ext tls pki mx.example.org tag MX
+listen on $ext port 587 tls-require pki mx.example.org auth tag SUBMISSION
+listen on socket
+
+action "local_mail" mbox alias <aliases>
+action "outbound" relay helo mx.example.org
+
+match from any for domain <domains> action "local_mail" # inbound
+match from local for local action "local_mail"
+match from src <relays> for any action "outbound"
+match tag SUBMISSION from any auth for any action "outbound"
+match from any for rcpt-to "spam@example.com" reject
+match from local for any action "outbound"
+`
+
+func loadTestConfig(t *testing.T) *SmtpdConfig {
+	dir, err := ioutil.TempDir("", "smtpd_exporter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "smtpd.conf")
+	if err := ioutil.WriteFile(path, []byte(testSmtpdConf), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := LoadSmtpdConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return c
+}
+
+func TestLoadSmtpdConfig(t *testing.T) {
+	assert := assert.New(t)
+	c := loadTestConfig(t)
+
+	assert.Equal(&PKI{
+		Name: "mx.example.org",
+		Cert: "/etc/ssl/mx.example.org.crt",
+		Key:  "/etc/ssl/private/mx.example.org.key",
+	}, c.PKIs["mx.example.org"])
+
+	assert.Equal([]string{"example.org", "example.net"}, c.Tables["domains"].Values)
+	assert.False(c.Tables["aliases"].Loaded)
+
+	assert.Len(c.Listeners, 3) //nolint:gomnd
+	assert.Equal(&Listener{
+		Interface: "192.0.2.10",
+		Port:      587,
+		Tag:       "SUBMISSION",
+		TLS:       "tls-require",
+		PKI:       []string{"mx.example.org"},
+		Auth:      "auth",
+	}, c.Listeners[1])
+	assert.Equal("192.0.2.10:25", c.Listeners[0].Address())
+	assert.Equal("socket", c.Listeners[2].Name())
+
+	assert.Len(c.Actions, 2) //nolint:gomnd
+	assert.Equal(&Action{Name: "outbound", Method: "relay", Options: []string{"helo", "mx.example.org"}}, c.Actions[1])
+
+	assert.Len(c.Matches, 6) //nolint:gomnd
+	assert.Equal([]Criterion{
+		{Keyword: "tag", Value: "SUBMISSION"},
+		{Keyword: "from", Kind: "any"},
+		{Keyword: "auth"},
+		{Keyword: "for", Kind: "any"},
+	}, c.Matches[3].Criteria)
+	assert.True(c.Matches[4].Reject)
+
+	expected := `
+# HELP smtpd_config_info Listeners and actions configured in smtpd.conf.
+# TYPE smtpd_config_info gauge
+smtpd_config_info{address="",auth="",kind="action",method="mbox",name="local_mail",tls=""} 1
+smtpd_config_info{address="",auth="",kind="action",method="relay",name="outbound",tls=""} 1
+smtpd_config_info{address="192.0.2.10:25",auth="",kind="listener",method="",name="MX",tls="tls"} 1
+smtpd_config_info{address="192.0.2.10:587",auth="auth",kind="listener",method="",name="SUBMISSION",tls="tls-require"} 1
+smtpd_config_info{address="socket",auth="",kind="listener",method="",name="socket",tls=""} 1
+`
+	assert.Nil(testutil.CollectAndCompare(c.ConfigInfo(), strings.NewReader(expected)))
+}
+
+func TestSmtpdConfigLabels(t *testing.T) {
+	assert := assert.New(t)
+	c := loadTestConfig(t)
+
+	tables := []struct {
+		session  *Session
+		from     string
+		to       string
+		listener string
+		action   string
+	}{
+		// inbound mail
+		{&Session{Address: "203.0.113.1"}, "<a@example.com>", "<b@example.org>", "MX", "local_mail"},
+		// submission relayed to the outside
+		{&Session{Address: "203.0.113.1", Authenticated: true}, "<b@example.org>", "<a@example.com>", "SUBMISSION", "outbound"},
+		// allowed relay network
+		{&Session{Address: "198.51.100.7"}, "<c@example.org>", "<a@example.com>", "MX", "outbound"},
+		{&Session{Address: "203.0.113.1"}, "<a@example.com>", "<spam@example.com>", "MX", "reject"},
+		// local sendmail
+		{&Session{Address: "local"}, "<root@mx>", "<a@example.com>", "socket", "outbound"},
+		// no session known, only the for part can be decided
+		{nil, "<a@example.com>", "<b@example.net>", "", "local_mail"},
+		{nil, "<a@example.com>", "<a@example.com>", "", ""},
+	}
+
+	for _, table := range tables {
+		listener, action := c.Labels(table.session, table.from, table.to)
+		assert.Equal(table.listener, listener, table.to)
+		assert.Equal(table.action, action, table.to)
+	}
+}
+
+func TestSmtpdConfigInvalidPort(t *testing.T) {
+	c := &SmtpdConfig{Tables: map[string]*Table{}, PKIs: map[string]*PKI{}, macros: map[string]string{}}
+
+	err := c.directive("", []string{"listen", "on", "lo0", "port", "smtp"})
+	assert.EqualError(t, err, "invalid listen port: smtp")
+}
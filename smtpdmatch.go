@@ -0,0 +1,285 @@
+package main
+
+import (
+	"net"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Session holds what the log tells about a smtp session.
+type Session struct {
+	Address       string
+	Host          string
+	User          string
+	Authenticated bool
+}
+
+// local returns true for sessions of the local socket or from loopback.
+func (s *Session) local() bool {
+	if s.Address == "local" {
+		return true
+	}
+
+	ip := net.ParseIP(s.Address)
+
+	return ip != nil && ip.IsLoopback()
+}
+
+// Labels resolves the listener and the action of an envelope. As the log does
+// not name them, the listener is the only one that could have accepted the
+// session and the action the one of the first match rule that surely matches.
+// Both are empty if that can not be decided.
+func (c *SmtpdConfig) Labels(s *Session, from, to string) (string, string) {
+	l := c.listener(s)
+
+	var listener string
+	if l != nil {
+		listener = l.Name()
+	}
+
+	for _, m := range c.Matches {
+		matched, known := c.matches(m, l, s, from, to)
+		if !known {
+			return listener, ""
+		}
+
+		if !matched {
+			continue
+		}
+
+		if m.Reject {
+			return listener, "reject"
+		}
+
+		return listener, m.Action
+	}
+
+	return listener, ""
+}
+
+// listener returns the single listener that fits the session or nil.
+func (c *SmtpdConfig) listener(s *Session) *Listener {
+	if s == nil {
+		return nil
+	}
+
+	var candidates []*Listener
+
+	for _, l := range c.Listeners {
+		switch {
+		case (l.Interface == "socket") != (s.Address == "local"):
+		case l.Auth == "auth" && !s.Authenticated:
+		case l.Auth == "" && s.Authenticated:
+		default:
+			candidates = append(candidates, l)
+		}
+	}
+
+	if len(candidates) != 1 {
+		return nil
+	}
+
+	return candidates[0]
+}
+
+// matches evaluates all criteria of the rule. known is false if one of them
+// can not be decided from the log. A rule without from is from local like in
+// smtpd.
+func (c *SmtpdConfig) matches(m *Match, l *Listener, s *Session, from, to string) (matched, known bool) {
+	known = true
+	criteria := m.Criteria
+
+	if !hasFrom(criteria) {
+		criteria = append([]Criterion{{Keyword: "from", Kind: "local"}}, criteria...)
+	}
+
+	for _, cr := range criteria {
+		ok, k := c.criterion(cr, l, s, from, to)
+		if k && ok == cr.Negate {
+			return false, true
+		}
+
+		known = known && k
+	}
+
+	return known, known
+}
+
+func hasFrom(criteria []Criterion) bool {
+	for _, cr := range criteria {
+		if cr.Keyword == "from" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// nolint:gocyclo
+func (c *SmtpdConfig) criterion(cr Criterion, l *Listener, s *Session, from, to string) (matched, known bool) {
+	if s == nil && (cr.Keyword == "auth" || cr.Keyword == "tag" || (cr.Keyword == "from" && cr.Kind != "any")) {
+		return false, false
+	}
+
+	// envelopes seen only on delivery have no addresses
+	if to == "" && ((cr.Keyword == "for" && cr.Kind != "any") || cr.Keyword == "rcpt-to") {
+		return false, false
+	}
+
+	if from == "" && (cr.Keyword == "mail-from" || cr.Kind == "mail-from") {
+		return false, false
+	}
+
+	switch {
+	case cr.Keyword == "from" && cr.Kind == "any", cr.Keyword == "for" && cr.Kind == "any":
+		return true, true
+	case cr.Keyword == "from" && cr.Kind == "local":
+		return s.local(), true
+	case cr.Keyword == "from" && cr.Kind == "socket":
+		return s.Address == "local", true
+	case cr.Keyword == "from" && cr.Kind == "src":
+		return c.lookupAddress(cr.Value, s.Address)
+	case cr.Keyword == "from" && cr.Kind == "auth", cr.Keyword == "auth":
+		if cr.Value == "" || !s.Authenticated {
+			return s.Authenticated, true
+		}
+
+		return c.lookup(cr.Value, s.User)
+	case cr.Keyword == "for" && cr.Kind == "local":
+		return isLocalDomain(domain(to)), true
+	case cr.Keyword == "for" && cr.Kind == "domain":
+		return c.lookupDomain(cr.Value, domain(to))
+	case cr.Keyword == "for" && cr.Kind == "rcpt-to", cr.Keyword == "rcpt-to":
+		return c.lookup(cr.Value, strings.Trim(to, "<>"))
+	case cr.Keyword == "mail-from", cr.Keyword == "from" && cr.Kind == "mail-from":
+		return c.lookup(cr.Value, strings.Trim(from, "<>"))
+	case cr.Keyword == "tag":
+		if l == nil {
+			return false, false
+		}
+
+		return l.Tag == cr.Value, true
+	}
+
+	return false, false
+}
+
+// values returns the values of a "<table>" reference or the literal value.
+func (c *SmtpdConfig) values(ref string) ([]string, bool) {
+	if !strings.HasPrefix(ref, "<") {
+		return []string{ref}, true
+	}
+
+	t, ok := c.Tables[strings.Trim(ref, "<>")]
+	if !ok || !t.Loaded {
+		return nil, false
+	}
+
+	return t.Values, true
+}
+
+func (c *SmtpdConfig) lookup(ref, value string) (bool, bool) {
+	values, ok := c.values(ref)
+	if !ok {
+		return false, false
+	}
+
+	for _, v := range values {
+		if strings.EqualFold(v, value) {
+			return true, true
+		}
+	}
+
+	return false, true
+}
+
+// lookupDomain also matches wildcards like "*.example.org".
+func (c *SmtpdConfig) lookupDomain(ref, d string) (bool, bool) {
+	values, ok := c.values(ref)
+	if !ok {
+		return false, false
+	}
+
+	for _, v := range values {
+		v = strings.ToLower(v)
+		if v == d || (strings.HasPrefix(v, "*.") && strings.HasSuffix(d, v[1:])) {
+			return true, true
+		}
+	}
+
+	return false, true
+}
+
+// Domains returns the domains of the "for domain" rules, sorted and without
+// duplicates.
+func (c *SmtpdConfig) Domains() []string {
+	seen := map[string]bool{}
+	domains := []string{}
+
+	for _, m := range c.Matches {
+		for _, cr := range m.Criteria {
+			if cr.Keyword != "for" || cr.Kind != "domain" {
+				continue
+			}
+
+			values, _ := c.values(cr.Value)
+			for _, v := range values {
+				v = strings.ToLower(v)
+				if !seen[v] {
+					seen[v] = true
+					domains = append(domains, v)
+				}
+			}
+		}
+	}
+
+	sort.Strings(domains)
+
+	return domains
+}
+
+// lookupAddress also matches networks like "192.0.2.0/24".
+func (c *SmtpdConfig) lookupAddress(ref, addr string) (bool, bool) {
+	values, ok := c.values(ref)
+	if !ok {
+		return false, false
+	}
+
+	ip := net.ParseIP(addr)
+
+	for _, v := range values {
+		if _, n, err := net.ParseCIDR(v); err == nil && ip != nil && n.Contains(ip) {
+			return true, true
+		}
+
+		if v == addr {
+			return true, true
+		}
+	}
+
+	return false, true
+}
+
+// domain returns the lower cased domain of an address like "<a@example.org>".
+func domain(addr string) string {
+	addr = strings.Trim(addr, "<>")
+
+	i := strings.LastIndex(addr, "@")
+	if i < 0 {
+		return ""
+	}
+
+	return strings.ToLower(addr[i+1:])
+}
+
+// isLocalDomain returns true for the domains "for local" matches.
+func isLocalDomain(d string) bool {
+	if d == "localhost" {
+		return true
+	}
+
+	hostname, err := os.Hostname()
+
+	return err == nil && strings.EqualFold(d, hostname)
+}
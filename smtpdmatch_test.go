@@ -0,0 +1,75 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSmtpdConfigMatches(t *testing.T) {
+	c := &SmtpdConfig{
+		Tables: map[string]*Table{
+			"domains": {Name: "domains", Values: []string{"example.org", "*.example.net"}, Loaded: true},
+			"relays":  {Name: "relays", Values: []string{"198.51.100.0/24"}, Loaded: true},
+			"aliases": {Name: "aliases", Backend: "file"},
+		},
+	}
+
+	remote := &Session{Address: "203.0.113.1"}
+	local := &Session{Address: "local"}
+
+	tables := []struct {
+		name     string
+		criteria []Criterion
+		session  *Session
+		to       string
+		matched  bool
+		known    bool
+	}{
+		// smtpd matches from local without from
+		{"default from local", []Criterion{{Keyword: "for", Kind: "any"}}, local, "<a@example.com>", true, true},
+		{"default from remote", []Criterion{{Keyword: "for", Kind: "any"}}, remote, "<a@example.com>", false, true},
+		{"loopback is local", nil, &Session{Address: "127.0.0.1"}, "<a@example.com>", true, true},
+		{"from any", []Criterion{{Keyword: "from", Kind: "any"}}, remote, "<a@example.com>", true, true},
+		{"negated from local", []Criterion{{Negate: true, Keyword: "from", Kind: "local"}}, remote, "<a@example.com>", true, true},
+		{"negated for any", []Criterion{{Keyword: "from", Kind: "any"}, {Negate: true, Keyword: "for", Kind: "any"}},
+			remote, "<a@example.com>", false, true},
+		{"domain table", []Criterion{{Keyword: "from", Kind: "any"}, {Keyword: "for", Kind: "domain", Value: "<domains>"}},
+			remote, "<a@example.org>", true, true},
+		{"domain wildcard", []Criterion{{Keyword: "from", Kind: "any"}, {Keyword: "for", Kind: "domain", Value: "<domains>"}},
+			remote, "<a@mx.example.net>", true, true},
+		{"domain not in table", []Criterion{{Keyword: "from", Kind: "any"}, {Keyword: "for", Kind: "domain", Value: "<domains>"}},
+			remote, "<a@example.com>", false, true},
+		{"network table", []Criterion{{Keyword: "from", Kind: "src", Value: "<relays>"}},
+			&Session{Address: "198.51.100.7"}, "<a@example.com>", true, true},
+		// the content of a file table is not known
+		{"unloaded table", []Criterion{{Keyword: "from", Kind: "any"}, {Keyword: "for", Kind: "rcpt-to", Value: "<aliases>"}},
+			remote, "<a@example.com>", false, false},
+		{"missing table", []Criterion{{Keyword: "from", Kind: "src", Value: "<missing>"}}, remote, "<a@example.com>", false, false},
+		// a rule failing on a known criterion is decided anyway
+		{"unknown and failing", []Criterion{{Keyword: "from", Kind: "src", Value: "<missing>"}, {Keyword: "for", Kind: "domain", Value: "<domains>"}},
+			remote, "<a@example.com>", false, true},
+		{"no session", []Criterion{{Keyword: "for", Kind: "any"}}, nil, "<a@example.com>", false, false},
+		{"no recipient", []Criterion{{Keyword: "from", Kind: "any"}, {Keyword: "for", Kind: "domain", Value: "<domains>"}},
+			remote, "", false, false},
+	}
+
+	for _, table := range tables {
+		matched, known := c.matches(&Match{Criteria: table.criteria}, nil, table.session, "<b@example.com>", table.to)
+		assert.Equal(t, table.matched, matched, table.name)
+		assert.Equal(t, table.known, known, table.name)
+	}
+}
+
+func TestSmtpdConfigLabelsDefaultFrom(t *testing.T) {
+	c := &SmtpdConfig{Matches: []*Match{
+		{Criteria: []Criterion{{Keyword: "for", Kind: "any"}}, Action: "local_only"},
+		{Criteria: []Criterion{{Keyword: "from", Kind: "any"}, {Keyword: "for", Kind: "any"}}, Action: "any"},
+	}}
+
+	_, action := c.Labels(&Session{Address: "203.0.113.1"}, "<a@example.com>", "<b@example.org>")
+	assert.Equal(t, "any", action)
+
+	_, action = c.Labels(&Session{Address: "local"}, "<a@example.com>", "<b@example.org>")
+	assert.Equal(t, "local_only", action)
+}
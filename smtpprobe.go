@@ -0,0 +1,499 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+// SMTP reply codes the probe expects.
+const (
+	codeReady   = 220
+	codeOK      = 250
+	codeClosing = 221
+)
+
+// TLS modes of a probe target.
+const (
+	tlsNone     = ""
+	tlsStartTLS = "starttls"
+	tlsSMTPS    = "smtps"
+)
+
+// nolint:gochecknoglobals
+var (
+	probeSuccessDesc = prometheus.NewDesc(
+		"smtpd_probe_success",
+		"Shows if the SMTP handshake with the listener succeeded.",
+		[]string{"listener"}, nil,
+	)
+	probeDurationDesc = prometheus.NewDesc(
+		"smtpd_probe_duration_seconds",
+		"Time the whole probe of the listener took.",
+		[]string{"listener"}, nil,
+	)
+	probePhaseDesc = prometheus.NewDesc(
+		"smtpd_probe_phase_duration_seconds",
+		"Time the phases of the probe of the listener took.",
+		[]string{"listener", "phase"}, nil,
+	)
+	probeExtensionDesc = prometheus.NewDesc(
+		"smtpd_probe_extension_info",
+		"Extensions the listener advertised in its last EHLO response.",
+		[]string{"listener", "extension"}, nil,
+	)
+	probeTLSVersionDesc = prometheus.NewDesc(
+		"smtpd_probe_tls_version_info",
+		"TLS version negotiated with the listener.",
+		[]string{"listener", "version"}, nil,
+	)
+	probeCertNotAfterDesc = prometheus.NewDesc(
+		"smtpd_probe_cert_not_after_seconds",
+		"Expiry of the certificates the listener presented as unix timestamp.",
+		[]string{"listener", "subject", "issuer"}, nil,
+	)
+)
+
+// ProbeTarget is a listener to probe. ServerName is the name to verify the
+// certificate against, the host of the address if empty.
+type ProbeTarget struct {
+	Name       string
+	Address    string
+	TLS        string
+	ServerName string
+}
+
+// ProbeConfig holds the settings of all probes.
+type ProbeConfig struct {
+	Timeout     time.Duration
+	Helo        string
+	InsecureTLS bool
+}
+
+// ProbeResult holds what a probe found out.
+type ProbeResult struct {
+	Success    bool
+	Duration   time.Duration
+	Phases     map[string]time.Duration
+	Extensions []string
+	TLSVersion string
+	Certs      []*x509.Certificate
+	Err        error
+}
+
+// smtpProbe runs a SMTP handshake against the target.
+type smtpProbe struct {
+	target ProbeTarget
+	cfg    ProbeConfig
+	result *ProbeResult
+	conn   net.Conn
+	text   *textproto.Conn
+}
+
+// probeSMTP connects to the target, reads the banner, sends EHLO, does
+// STARTTLS if configured and quits.
+func probeSMTP(target ProbeTarget, cfg ProbeConfig) *ProbeResult {
+	p := &smtpProbe{
+		target: target,
+		cfg:    cfg,
+		result: &ProbeResult{Phases: map[string]time.Duration{}},
+	}
+
+	start := time.Now()
+	p.result.Err = p.run()
+	p.result.Duration = time.Since(start)
+	p.result.Success = p.result.Err == nil
+
+	if p.conn != nil {
+		p.conn.Close()
+	}
+
+	if p.result.Err != nil {
+		log.WithFields(log.Fields{"listener": target.Name, "error": p.result.Err}).Debug("probe failed")
+	}
+
+	return p.result
+}
+
+func (p *smtpProbe) run() error {
+	err := p.phase("connect", func() error {
+		conn, err := net.DialTimeout("tcp", p.target.Address, p.cfg.Timeout)
+		if err != nil {
+			return err
+		}
+
+		p.conn = conn
+
+		return conn.SetDeadline(time.Now().Add(p.cfg.Timeout))
+	})
+	if err != nil {
+		return err
+	}
+
+	if p.target.TLS == tlsSMTPS {
+		if err := p.phase("tls", p.handshake); err != nil {
+			return err
+		}
+	}
+
+	p.text = textproto.NewConn(p.conn)
+
+	if err := p.phase("banner", func() error {
+		_, _, err := p.text.ReadResponse(codeReady)
+		return err
+	}); err != nil {
+		return err
+	}
+
+	if err := p.phase("ehlo", p.ehlo); err != nil {
+		return err
+	}
+
+	if p.target.TLS == tlsStartTLS {
+		if err := p.phase("starttls", func() error {
+			if !p.hasExtension("STARTTLS") {
+				return fmt.Errorf("STARTTLS not advertised")
+			}
+
+			return p.cmd(codeReady, "STARTTLS")
+		}); err != nil {
+			return err
+		}
+
+		if err := p.phase("tls", p.handshake); err != nil {
+			return err
+		}
+
+		p.text = textproto.NewConn(p.conn)
+
+		// the session starts over after STARTTLS
+		if err := p.phase("ehlo_tls", p.ehlo); err != nil {
+			return err
+		}
+	}
+
+	return p.phase("quit", func() error {
+		return p.cmd(codeClosing, "QUIT")
+	})
+}
+
+// phase runs fn and records how long it took.
+func (p *smtpProbe) phase(name string, fn func() error) error {
+	start := time.Now()
+	err := fn()
+	p.result.Phases[name] = time.Since(start)
+
+	if err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+
+	return nil
+}
+
+func (p *smtpProbe) cmd(code int, format string, args ...interface{}) error {
+	id, err := p.text.Cmd(format, args...)
+	if err != nil {
+		return err
+	}
+
+	p.text.StartResponse(id)
+	defer p.text.EndResponse(id)
+
+	_, _, err = p.text.ReadResponse(code)
+
+	return err
+}
+
+// ehlo sends EHLO and keeps the advertised extensions.
+func (p *smtpProbe) ehlo() error {
+	id, err := p.text.Cmd("EHLO %s", p.cfg.Helo)
+	if err != nil {
+		return err
+	}
+
+	p.text.StartResponse(id)
+	defer p.text.EndResponse(id)
+
+	_, msg, err := p.text.ReadResponse(codeOK)
+	if err != nil {
+		return err
+	}
+
+	// the first line is the greeting, every further line an extension
+	p.result.Extensions = nil
+
+	lines := strings.Split(msg, "\n")
+	for _, line := range lines[1:] {
+		if fields := strings.Fields(line); len(fields) > 0 {
+			p.result.Extensions = append(p.result.Extensions, strings.ToUpper(fields[0]))
+		}
+	}
+
+	return nil
+}
+
+func (p *smtpProbe) hasExtension(name string) bool {
+	for _, ext := range p.result.Extensions {
+		if ext == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// handshake upgrades the connection to TLS and keeps the certificates.
+func (p *smtpProbe) handshake() error {
+	host := p.target.ServerName
+	if host == "" {
+		h, _, err := net.SplitHostPort(p.target.Address)
+		if err != nil {
+			return err
+		}
+
+		host = h
+	}
+
+	conn := tls.Client(p.conn, &tls.Config{
+		ServerName:         host,
+		InsecureSkipVerify: p.cfg.InsecureTLS, // nolint:gosec
+	})
+	if err := conn.Handshake(); err != nil {
+		return err
+	}
+
+	state := conn.ConnectionState()
+	p.result.TLSVersion = tlsVersion(state.Version)
+	p.result.Certs = state.PeerCertificates
+	p.conn = conn
+
+	return nil
+}
+
+// tlsVersion names a TLS version like "TLS 1.3".
+func tlsVersion(v uint16) string {
+	switch v {
+	case tls.VersionTLS10:
+		return "TLS 1.0"
+	case tls.VersionTLS11:
+		return "TLS 1.1"
+	case tls.VersionTLS12:
+		return "TLS 1.2"
+	case tls.VersionTLS13:
+		return "TLS 1.3"
+	}
+
+	return fmt.Sprintf("0x%04x", v)
+}
+
+// collect sends the metrics of the result.
+func (r *ProbeResult) collect(ch chan<- prometheus.Metric, listener string) {
+	var success float64
+	if r.Success {
+		success = 1
+	}
+
+	ch <- prometheus.MustNewConstMetric(probeSuccessDesc, prometheus.GaugeValue, success, listener)
+	ch <- prometheus.MustNewConstMetric(probeDurationDesc, prometheus.GaugeValue, r.Duration.Seconds(), listener)
+
+	for phase, d := range r.Phases {
+		ch <- prometheus.MustNewConstMetric(probePhaseDesc, prometheus.GaugeValue, d.Seconds(), listener, phase)
+	}
+
+	for _, ext := range r.Extensions {
+		ch <- prometheus.MustNewConstMetric(probeExtensionDesc, prometheus.GaugeValue, 1, listener, ext)
+	}
+
+	if r.TLSVersion != "" {
+		ch <- prometheus.MustNewConstMetric(probeTLSVersionDesc, prometheus.GaugeValue, 1, listener, r.TLSVersion)
+	}
+
+	// a chain may hold the same certificate twice, like a cross signed
+	// intermediate, which would be a duplicate series
+	seen := map[string]bool{}
+
+	for _, cert := range r.Certs {
+		key := cert.Subject.String() + "\x00" + cert.Issuer.String()
+		if seen[key] {
+			continue
+		}
+
+		seen[key] = true
+		ch <- prometheus.MustNewConstMetric(
+			probeCertNotAfterDesc, prometheus.GaugeValue, float64(cert.NotAfter.Unix()),
+			listener, cert.Subject.String(), cert.Issuer.String(),
+		)
+	}
+}
+
+// ProbeCollector probes all targets on every scrape.
+type ProbeCollector struct {
+	targets []ProbeTarget
+	cfg     ProbeConfig
+}
+
+// NewProbeCollector creates a collector probing the targets.
+func NewProbeCollector(targets []ProbeTarget, cfg ProbeConfig) *ProbeCollector {
+	return &ProbeCollector{targets: targets, cfg: cfg}
+}
+
+// Describe implements prometheus.Collector.
+func (c *ProbeCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- probeSuccessDesc
+	ch <- probeDurationDesc
+	ch <- probePhaseDesc
+	ch <- probeExtensionDesc
+	ch <- probeTLSVersionDesc
+	ch <- probeCertNotAfterDesc
+}
+
+// Collect implements prometheus.Collector.
+func (c *ProbeCollector) Collect(ch chan<- prometheus.Metric) {
+	var wg sync.WaitGroup
+
+	for _, t := range c.targets {
+		wg.Add(1)
+
+		go func(t ProbeTarget) {
+			defer wg.Done()
+
+			probeSMTP(t, c.cfg).collect(ch, t.Name)
+		}(t)
+	}
+
+	wg.Wait()
+}
+
+// parseProbeFlags turns "[name=]host:port[,starttls|,smtps]" values into
+// probe targets.
+func parseProbeFlags(values []string) ([]ProbeTarget, error) {
+	targets := make([]ProbeTarget, 0, len(values))
+
+	for _, v := range values {
+		t := ProbeTarget{}
+
+		if i := strings.Index(v, "="); i >= 0 {
+			t.Name, v = v[:i], v[i+1:]
+		}
+
+		if i := strings.LastIndex(v, ","); i >= 0 {
+			t.TLS, v = v[i+1:], v[:i]
+		}
+
+		if t.TLS != tlsNone && t.TLS != tlsStartTLS && t.TLS != tlsSMTPS {
+			return nil, fmt.Errorf("invalid probe tls mode: %s", t.TLS)
+		}
+
+		if _, _, err := net.SplitHostPort(v); err != nil {
+			return nil, fmt.Errorf("invalid probe address: %w", err)
+		}
+
+		t.Address = v
+		if t.Name == "" {
+			t.Name = v
+		}
+
+		targets = append(targets, t)
+	}
+
+	return targets, nil
+}
+
+// probeTargets returns the TCP listeners of the smtpd config as targets.
+// Interface names get resolved to their first address. The certificate is
+// verified against the hostname of the listener or else the name of its pki.
+func (c *SmtpdConfig) probeTargets() []ProbeTarget {
+	targets := make([]ProbeTarget, 0, len(c.Listeners))
+
+	for _, l := range c.Listeners {
+		if l.Interface == "socket" {
+			continue
+		}
+
+		t := ProbeTarget{
+			Name:       l.Name(),
+			Address:    net.JoinHostPort(listenerHost(l.Interface), strconv.Itoa(l.Port)),
+			ServerName: l.Hostname,
+		}
+
+		if t.ServerName == "" && len(l.PKI) > 0 {
+			t.ServerName = l.PKI[0]
+		}
+
+		switch l.TLS {
+		case "tls", "tls-require":
+			t.TLS = tlsStartTLS
+		case "smtps":
+			t.TLS = tlsSMTPS
+		}
+
+		targets = append(targets, t)
+	}
+
+	return uniqueProbeTargets(targets)
+}
+
+// uniqueProbeTargets names targets apart that share a name, like two listen
+// on lines with the same tag, by appending their address. Targets of the
+// same name and address are probed once.
+func uniqueProbeTargets(targets []ProbeTarget) []ProbeTarget {
+	count := map[string]int{}
+	for _, t := range targets {
+		count[t.Name]++
+	}
+
+	unique := make([]ProbeTarget, 0, len(targets))
+	seen := map[string]bool{}
+
+	for _, t := range targets {
+		if count[t.Name] > 1 {
+			t.Name += "/" + t.Address
+		}
+
+		if seen[t.Name] {
+			continue
+		}
+
+		seen[t.Name] = true
+		unique = append(unique, t)
+	}
+
+	return unique
+}
+
+// listenerHost returns a host to connect to for a listen on interface.
+func listenerHost(iface string) string {
+	if net.ParseIP(iface) != nil {
+		return iface
+	}
+
+	i, err := net.InterfaceByName(iface)
+	if err != nil {
+		// all, egress and host names
+		if iface == "all" || iface == "egress" {
+			return "localhost"
+		}
+
+		return iface
+	}
+
+	addrs, err := i.Addrs()
+	if err != nil || len(addrs) == 0 {
+		return iface
+	}
+
+	if ipNet, ok := addrs[0].(*net.IPNet); ok {
+		return ipNet.IP.String()
+	}
+
+	return iface
+}
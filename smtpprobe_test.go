@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeSMTP is a minimal SMTP server that speaks just enough for the probe.
+type fakeSMTP struct {
+	listener    net.Listener
+	cert        tls.Certificate
+	smtps       bool
+	serverNames chan string
+}
+
+func newFakeSMTP(t *testing.T, smtps bool) *fakeSMTP {
+	dir, err := ioutil.TempDir("", "smtpd_exporter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	certPath, keyPath := filepath.Join(dir, "mx.crt"), filepath.Join(dir, "mx.key")
+	writeCert(t, certPath, keyPath, "mx.example.org", time.Now().Add(time.Hour))
+
+	cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &fakeSMTP{listener: l, cert: cert, smtps: smtps, serverNames: make(chan string, 10)}
+
+	go s.serve()
+
+	return s
+}
+
+func (s *fakeSMTP) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		go s.session(conn)
+	}
+}
+
+func (s *fakeSMTP) session(conn net.Conn) {
+	defer conn.Close()
+
+	tlsConfig := &tls.Config{GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		s.serverNames <- hello.ServerName
+		return &s.cert, nil
+	}}
+	secure := s.smtps
+
+	if s.smtps {
+		conn = tls.Server(conn, tlsConfig)
+	}
+
+	r := bufio.NewReader(conn)
+	conn.Write([]byte("220 mx.example.org ESMTP OpenSMTPD\r\n")) // nolint:errcheck
+
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+
+		switch cmd := strings.ToUpper(strings.Fields(line)[0]); {
+		case cmd == "EHLO" && secure:
+			conn.Write([]byte("250-mx.example.org Hello\r\n250-8BITMIME\r\n250-AUTH PLAIN LOGIN\r\n250 HELP\r\n")) // nolint:errcheck
+		case cmd == "EHLO":
+			conn.Write([]byte("250-mx.example.org Hello\r\n250-8BITMIME\r\n250-STARTTLS\r\n250 HELP\r\n")) // nolint:errcheck
+		case cmd == "STARTTLS":
+			conn.Write([]byte("220 2.0.0 Ready to start TLS\r\n")) // nolint:errcheck
+			conn = tls.Server(conn, tlsConfig)
+			r = bufio.NewReader(conn)
+			secure = true
+		case cmd == "QUIT":
+			conn.Write([]byte("221 2.0.0 Bye\r\n")) // nolint:errcheck
+			return
+		default:
+			conn.Write([]byte("500 5.5.1 Invalid command\r\n")) // nolint:errcheck
+		}
+	}
+}
+
+func TestProbeSMTP(t *testing.T) {
+	cfg := ProbeConfig{Timeout: 2 * time.Second, Helo: "probe.example.org", InsecureTLS: true}
+	tables := []struct {
+		name       string
+		tls        string
+		phases     []string
+		extensions []string
+	}{
+		{"plain", tlsNone, []string{"connect", "banner", "ehlo", "quit"}, []string{"8BITMIME", "STARTTLS", "HELP"}},
+		{
+			"starttls", tlsStartTLS,
+			[]string{"connect", "banner", "ehlo", "starttls", "tls", "ehlo_tls", "quit"},
+			[]string{"8BITMIME", "AUTH", "HELP"},
+		},
+		{"smtps", tlsSMTPS, []string{"connect", "tls", "banner", "ehlo", "quit"}, []string{"8BITMIME", "AUTH", "HELP"}},
+	}
+
+	for _, table := range tables {
+		t.Run(table.name, func(t *testing.T) {
+			assert := assert.New(t)
+			s := newFakeSMTP(t, table.tls == tlsSMTPS)
+			defer s.listener.Close()
+
+			r := probeSMTP(ProbeTarget{
+				Name: "mx", Address: s.listener.Addr().String(), TLS: table.tls, ServerName: "mx.example.org",
+			}, cfg)
+
+			assert.Nil(r.Err)
+			assert.True(r.Success)
+			assert.Equal(table.extensions, r.Extensions)
+
+			for _, phase := range table.phases {
+				assert.Contains(r.Phases, phase)
+			}
+
+			assert.Len(r.Phases, len(table.phases))
+
+			if table.tls != tlsNone {
+				assert.Equal("mx.example.org", r.Certs[0].Subject.CommonName)
+				assert.NotEmpty(r.TLSVersion)
+				assert.Equal("mx.example.org", <-s.serverNames)
+			}
+		})
+	}
+}
+
+func TestProbeSMTPFailures(t *testing.T) {
+	assert := assert.New(t)
+	s := newFakeSMTP(t, false)
+	cfg := ProbeConfig{Timeout: 2 * time.Second, Helo: "probe.example.org"}
+
+	// the certificate is self signed
+	r := probeSMTP(ProbeTarget{Name: "mx", Address: s.listener.Addr().String(), TLS: tlsStartTLS}, cfg)
+	assert.False(r.Success)
+	assert.Contains(r.Err.Error(), "tls:")
+
+	s.listener.Close()
+
+	r = probeSMTP(ProbeTarget{Name: "mx", Address: s.listener.Addr().String()}, cfg)
+	assert.False(r.Success)
+	assert.Contains(r.Err.Error(), "connect:")
+}
+
+func TestProbeCollector(t *testing.T) {
+	assert := assert.New(t)
+	s := newFakeSMTP(t, false)
+	defer s.listener.Close()
+
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(NewProbeCollector(
+		[]ProbeTarget{{Name: "mx", Address: s.listener.Addr().String()}},
+		ProbeConfig{Timeout: 2 * time.Second, Helo: "probe.example.org"},
+	))
+
+	mfs, err := reg.Gather()
+	assert.Nil(err)
+
+	values := map[string]float64{}
+
+	for _, mf := range mfs {
+		for _, m := range mf.Metric {
+			if mf.GetName() == "smtpd_probe_extension_info" {
+				values[mf.GetName()+"/"+m.Label[0].GetValue()] = m.Gauge.GetValue()
+				continue
+			}
+
+			values[mf.GetName()] = m.Gauge.GetValue()
+		}
+	}
+
+	assert.Equal(float64(1), values["smtpd_probe_success"])
+	assert.Equal(float64(1), values["smtpd_probe_extension_info/STARTTLS"])
+	assert.Contains(values, "smtpd_probe_phase_duration_seconds")
+}
+
+func TestParseProbeFlags(t *testing.T) {
+	assert := assert.New(t)
+
+	targets, err := parseProbeFlags([]string{"mx=192.0.2.10:25,starttls", "[2001:db8::1]:465,smtps"})
+	assert.Nil(err)
+	assert.Equal([]ProbeTarget{
+		{Name: "mx", Address: "192.0.2.10:25", TLS: tlsStartTLS},
+		{Name: "[2001:db8::1]:465", Address: "[2001:db8::1]:465", TLS: tlsSMTPS},
+	}, targets)
+
+	_, err = parseProbeFlags([]string{"192.0.2.10:25,tls"})
+	assert.NotNil(err)
+
+	_, err = parseProbeFlags([]string{"192.0.2.10"})
+	assert.NotNil(err)
+}
+
+func TestSmtpdConfigProbeTargets(t *testing.T) {
+	assert.Equal(t, []ProbeTarget{
+		{Name: "MX", Address: "192.0.2.10:25", TLS: tlsStartTLS, ServerName: "mx.example.org"},
+		{Name: "SUBMISSION", Address: "192.0.2.10:587", TLS: tlsStartTLS, ServerName: "mx.example.org"},
+	}, loadTestConfig(t).probeTargets())
+
+	// the hostname of the listener wins over its pki
+	c := &SmtpdConfig{Listeners: []*Listener{
+		{Interface: "192.0.2.10", Port: 25, TLS: "tls", PKI: []string{"mx.example.org"}, Hostname: "mail.example.org"},
+	}}
+	assert.Equal(t, "mail.example.org", c.probeTargets()[0].ServerName)
+}
+
+func TestProbeResultDuplicateCerts(t *testing.T) {
+	leaf := &x509.Certificate{
+		Subject:  pkix.Name{CommonName: "mx.example.org"},
+		Issuer:   pkix.Name{CommonName: "CA"},
+		NotAfter: time.Now(),
+	}
+	r := &ProbeResult{Certs: []*x509.Certificate{leaf, leaf}}
+
+	ch := make(chan prometheus.Metric, 10)
+	r.collect(ch, "mx")
+	close(ch)
+
+	var certs int
+
+	for m := range ch {
+		if m.Desc() == probeCertNotAfterDesc {
+			certs++
+		}
+	}
+
+	assert.Equal(t, 1, certs)
+}
+
+func TestUniqueProbeTargets(t *testing.T) {
+	targets := uniqueProbeTargets([]ProbeTarget{
+		{Name: "MX", Address: "192.0.2.10:25"},
+		{Name: "MX", Address: "[2001:db8::10]:25"},
+		{Name: "SUBMISSION", Address: "localhost:587"},
+		{Name: "all:25", Address: "localhost:25"},
+		{Name: "all:25", Address: "localhost:25"},
+	})
+
+	assert.Equal(t, []ProbeTarget{
+		{Name: "MX/192.0.2.10:25", Address: "192.0.2.10:25"},
+		{Name: "MX/[2001:db8::10]:25", Address: "[2001:db8::10]:25"},
+		{Name: "SUBMISSION", Address: "localhost:587"},
+		{Name: "all:25/localhost:25", Address: "localhost:25"},
+	}, targets)
+}
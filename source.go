@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// errNoSnapshot is returned until the first stats snapshot is complete.
+var errNoSnapshot = errors.New("no stats snapshot read yet")
+
+// fileStat reads `smtpctl show stats` output from a file on every collection.
+type fileStat struct {
+	path string
+}
+
+func (s fileStat) Now() (string, error) {
+	out, err := ioutil.ReadFile(s.path)
+	if err != nil {
+		return "", fmt.Errorf("could not read stats file: %w", err)
+	}
+
+	return string(out), nil
+}
+
+// readerStat reads snapshots of `smtpctl show stats` output separated by empty
+// lines and returns the last complete one on every collection.
+type readerStat struct {
+	mux      sync.Mutex
+	snapshot string
+	ok       bool
+	err      error
+	done     chan struct{}
+}
+
+// newReaderStat starts reading snapshots from r.
+func newReaderStat(r io.Reader) *readerStat {
+	s := &readerStat{done: make(chan struct{})}
+
+	go s.read(r)
+
+	return s
+}
+
+func (s *readerStat) read(r io.Reader) {
+	var b strings.Builder
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.TrimSpace(line) == "" {
+			s.publish(b.String())
+			b.Reset()
+
+			continue
+		}
+
+		b.WriteString(line)
+		b.WriteString("\n")
+	}
+
+	s.publish(b.String())
+
+	if err := scanner.Err(); err != nil {
+		s.mux.Lock()
+		s.err = err
+		s.mux.Unlock()
+	}
+
+	close(s.done)
+	log.Debug("stats input closed")
+}
+
+// Wait blocks until the input is read completely.
+func (s *readerStat) Wait() {
+	<-s.done
+}
+
+func (s *readerStat) publish(snapshot string) {
+	if snapshot == "" {
+		return
+	}
+
+	s.mux.Lock()
+	s.snapshot = snapshot
+	s.ok = true
+	s.mux.Unlock()
+}
+
+func (s *readerStat) Now() (string, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	if s.err != nil {
+		return "", fmt.Errorf("could not read stats: %w", s.err)
+	}
+
+	if !s.ok {
+		return "", errNoSnapshot
+	}
+
+	return s.snapshot, nil
+}
+
+// newStat returns the stats source selected by the source flags.
+func newStat(source, path string) (Stat, error) {
+	switch source {
+	case "exec":
+		return smtpctl{}, nil
+	case "socket", "file":
+		if path == "" {
+			return nil, fmt.Errorf("source %s needs a path", source)
+		}
+
+		if source == "socket" {
+			return socketStat{path: path}, nil
+		}
+
+		return fileStat{path: path}, nil
+	case "stdin":
+		return newReaderStat(os.Stdin), nil
+	}
+
+	return nil, fmt.Errorf("unknown source: %s", source)
+}
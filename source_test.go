@@ -0,0 +1,83 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFileStat(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "smtpd_exporter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "stats.txt")
+	s, err := newStat("file", path)
+	assert.Nil(err)
+
+	_, err = s.Now()
+	assert.NotNil(err)
+
+	// the file gets read again on every collection
+	for _, stats := range []string{testStats, "scheduler.delivery.ok=43\n"} {
+		if err := ioutil.WriteFile(path, []byte(stats), 0o600); err != nil {
+			t.Fatal(err)
+		}
+
+		out, err := s.Now()
+		assert.Nil(err)
+		assert.Equal(stats, out)
+	}
+}
+
+func TestReaderStat(t *testing.T) {
+	assert := assert.New(t)
+	r, w := io.Pipe()
+	s := newReaderStat(r)
+
+	_, err := s.Now()
+	assert.Equal(errNoSnapshot, err)
+
+	now := func() string {
+		out, _ := s.Now()
+		return out
+	}
+
+	w.Write([]byte("scheduler.delivery.ok=1\nscheduler.delivery.permfail=2\n\n")) // nolint:errcheck
+	assert.Eventually(func() bool { return now() == "scheduler.delivery.ok=1\nscheduler.delivery.permfail=2\n" },
+		time.Second, 10*time.Millisecond)
+
+	// an incomplete snapshot is not used before the empty line or the end
+	w.Write([]byte("scheduler.delivery.ok=3\n")) // nolint:errcheck
+	assert.Equal("scheduler.delivery.ok=1\nscheduler.delivery.permfail=2\n", now())
+
+	w.Close()
+	assert.Eventually(func() bool { return now() == "scheduler.delivery.ok=3\n" }, time.Second, 10*time.Millisecond)
+}
+
+func TestNewStat(t *testing.T) {
+	assert := assert.New(t)
+
+	s, err := newStat("exec", "")
+	assert.Nil(err)
+	assert.Equal(smtpctl{}, s)
+
+	s, err = newStat("socket", "/run/smtpd.stats")
+	assert.Nil(err)
+	assert.Equal(socketStat{path: "/run/smtpd.stats"}, s)
+
+	_, err = newStat("file", "")
+	assert.NotNil(err)
+
+	_, err = newStat("smtpctl", "")
+	assert.NotNil(err)
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// rateWindows are the windows of /api/v1/rates, the history is kept for the
+// longest one.
+// nolint:gochecknoglobals
+var rateWindows = []struct {
+	Name     string
+	Duration time.Duration
+}{
+	{"1m", time.Minute},
+	{"5m", 5 * time.Minute},
+	{"15m", 15 * time.Minute},
+}
+
+// QueueSummary sums up the queue of smtpd from its scheduler stats.
+type QueueSummary struct {
+	Envelopes int64 `json:"envelopes"`
+	Incoming  int64 `json:"incoming"`
+	Inflight  int64 `json:"inflight"`
+	Expired   int64 `json:"expired"`
+	Messages  int64 `json:"messages"`
+}
+
+// InstanceStats is the last collection of an instance in /api/v1/stats.
+type InstanceStats struct {
+	Instance    string                 `json:"instance"`
+	Source      string                 `json:"source"`
+	Timestamp   time.Time              `json:"timestamp"`
+	Duration    float64                `json:"duration_seconds"`
+	Collections int                    `json:"collections"`
+	Errors      int                    `json:"errors"`
+	LastError   string                 `json:"last_error,omitempty"`
+	Stats       map[string]interface{} `json:"stats"`
+	Queue       QueueSummary           `json:"queue"`
+}
+
+// InstanceRates holds the per-second rates of the metrics of an instance in
+// /api/v1/rates, a window without two samples yet is left out.
+type InstanceRates struct {
+	Instance  string                        `json:"instance"`
+	Timestamp time.Time                     `json:"timestamp"`
+	Rates     map[string]map[string]float64 `json:"rates"`
+}
+
+// rateSample holds the metric values of a successful collection.
+type rateSample struct {
+	time   time.Time
+	values map[string]float64
+}
+
+type instanceHistory struct {
+	stats   InstanceStats
+	samples []rateSample
+}
+
+// StatsAPI keeps the last collection and the sample history of every
+// instance for the JSON api.
+type StatsAPI struct {
+	mux       sync.Mutex
+	instances map[string]*instanceHistory
+}
+
+// NewStatsAPI creates an empty StatsAPI.
+func NewStatsAPI() *StatsAPI {
+	return &StatsAPI{instances: map[string]*instanceHistory{}}
+}
+
+// Stat returns a stats source recording every collection of s.
+func (a *StatsAPI) Stat(instance, source string, s Stat) Stat {
+	return &apiStat{api: a, instance: instance, source: source, stat: s}
+}
+
+type apiStat struct {
+	api      *StatsAPI
+	instance string
+	source   string
+	stat     Stat
+}
+
+func (s *apiStat) Now() (string, error) {
+	start := time.Now()
+	out, err := s.stat.Now()
+	s.api.record(s.instance, s.source, start, time.Since(start), out, err)
+
+	return out, err
+}
+
+func (a *StatsAPI) record(instance, source string, start time.Time, d time.Duration, out string, err error) {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+
+	h, ok := a.instances[instance]
+	if !ok {
+		h = &instanceHistory{stats: InstanceStats{Instance: instance, Stats: map[string]interface{}{}}}
+		a.instances[instance] = h
+	}
+
+	h.stats.Source = source
+	h.stats.Timestamp = start
+	h.stats.Duration = d.Seconds()
+	h.stats.Collections++
+
+	if err != nil {
+		h.stats.Errors++
+		h.stats.LastError = err.Error()
+
+		return
+	}
+
+	h.stats.LastError = ""
+	h.stats.Stats = parseStats(out)
+	h.stats.Queue = queueSummary(h.stats.Stats)
+
+	sample := rateSample{time: start, values: map[string]float64{}}
+
+	for _, m := range metrics {
+		if v, err := m.value(out); err == nil {
+			sample.values[m.Name] = float64(v)
+		}
+	}
+
+	h.samples = append(h.samples, sample)
+
+	// keep one sample older than the longest window to cover all of it
+	oldest := start.Add(-rateWindows[len(rateWindows)-1].Duration)
+	for len(h.samples) > 1 && !h.samples[1].time.After(oldest) {
+		h.samples = h.samples[1:]
+	}
+}
+
+// Retain drops the history of the instances not in keep, like the ones a
+// reload removed.
+func (a *StatsAPI) Retain(keep map[string]bool) {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+
+	for name := range a.instances {
+		if !keep[name] {
+			delete(a.instances, name)
+		}
+	}
+}
+
+// Stats returns the last collection of every instance ordered by name.
+func (a *StatsAPI) Stats() []InstanceStats {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+
+	s := make([]InstanceStats, 0, len(a.instances))
+	for _, h := range a.instances {
+		s = append(s, h.stats)
+	}
+
+	sort.Slice(s, func(i, j int) bool { return s[i].Instance < s[j].Instance })
+
+	return s
+}
+
+// Last returns the stats of the last successful collection of an instance.
+func (a *StatsAPI) Last(instance string) (map[string]interface{}, bool) {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+
+	h, ok := a.instances[instance]
+	if !ok || len(h.samples) == 0 {
+		return nil, false
+	}
+
+	return h.stats.Stats, true
+}
+
+// Rates returns the rates of every instance ordered by name.
+func (a *StatsAPI) Rates() []InstanceRates {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+
+	r := make([]InstanceRates, 0, len(a.instances))
+
+	for name, h := range a.instances {
+		ir := InstanceRates{Instance: name, Rates: map[string]map[string]float64{}}
+
+		if len(h.samples) > 0 {
+			last := h.samples[len(h.samples)-1]
+			ir.Timestamp = last.time
+
+			for metric := range last.values {
+				rates := map[string]float64{}
+
+				for _, w := range rateWindows {
+					if v, ok := rate(h.samples, metric, last.time.Add(-w.Duration)); ok {
+						rates[w.Name] = v
+					}
+				}
+
+				ir.Rates[metric] = rates
+			}
+		}
+
+		r = append(r, ir)
+	}
+
+	sort.Slice(r, func(i, j int) bool { return r[i].Instance < r[j].Instance })
+
+	return r
+}
+
+// rate returns the per-second increase of the metric from the last sample at
+// or before since to the newest one. A smaller value means smtpd restarted
+// and counts from zero.
+func rate(samples []rateSample, metric string, since time.Time) (float64, bool) {
+	first := 0
+	for i, s := range samples {
+		if s.time.After(since) {
+			break
+		}
+
+		first = i
+	}
+
+	var (
+		increase float64
+		prev     *rateSample
+		start    time.Time
+	)
+
+	for i := first; i < len(samples); i++ {
+		v, ok := samples[i].values[metric]
+		if !ok {
+			continue
+		}
+
+		if prev == nil {
+			start = samples[i].time
+		} else if last := prev.values[metric]; v >= last {
+			increase += v - last
+		} else {
+			increase += v
+		}
+
+		prev = &samples[i]
+	}
+
+	if prev == nil || !prev.time.After(start) {
+		return 0, false
+	}
+
+	return increase / prev.time.Sub(start).Seconds(), true
+}
+
+// parseStats turns `smtpctl show stats` output into a map with numbers where
+// the values are numbers.
+func parseStats(out string) map[string]interface{} {
+	stats := map[string]interface{}{}
+
+	scanner := bufio.NewScanner(strings.NewReader(out))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+
+		i := strings.Index(line, "=")
+		if i < 1 {
+			continue
+		}
+
+		key, value := line[:i], line[i+1:]
+		if n, err := strconv.ParseInt(value, 10, 64); err == nil {
+			stats[key] = n
+			continue
+		}
+
+		stats[key] = value
+	}
+
+	return stats
+}
+
+func queueSummary(stats map[string]interface{}) QueueSummary {
+	get := func(key string) int64 {
+		n, _ := stats[key].(int64)
+		return n
+	}
+
+	return QueueSummary{
+		Envelopes: get("scheduler.envelope"),
+		Incoming:  get("scheduler.envelope.incoming"),
+		Inflight:  get("scheduler.envelope.inflight"),
+		Expired:   get("scheduler.envelope.expired"),
+		Messages:  get("scheduler.ramqueue.message"),
+	}
+}
+
+// StatsHandler serves /api/v1/stats.
+func (a *StatsAPI) StatsHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, struct {
+			Instances []InstanceStats `json:"instances"`
+		}{a.Stats()})
+	}
+}
+
+// RatesHandler serves /api/v1/rates.
+func (a *StatsAPI) RatesHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, struct {
+			Instances []InstanceRates `json:"instances"`
+		}{a.Rates()})
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.WithFields(log.Fields{"error": err}).Debug("could not write json")
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStatsAPI(t *testing.T) {
+	assert := assert.New(t)
+	api := NewStatsAPI()
+
+	stats := new(MockStat)
+	stats.On("Now").Return("scheduler.delivery.ok=42\nscheduler.envelope=3\nuptime.human=2m\n", nil).Once()
+	stats.On("Now").Return("", errors.New("smtpctl failed")).Once()
+
+	s := api.Stat("mx", "socket", stats)
+	_, err := s.Now()
+	assert.Nil(err)
+	_, err = s.Now()
+	assert.NotNil(err)
+
+	rec := httptest.NewRecorder()
+	api.StatsHandler()(rec, httptest.NewRequest("GET", "/api/v1/stats", nil))
+	assert.Equal("application/json", rec.Header().Get("Content-Type"))
+
+	var resp struct {
+		Instances []InstanceStats `json:"instances"`
+	}
+
+	assert.Nil(json.Unmarshal(rec.Body.Bytes(), &resp))
+	assert.Len(resp.Instances, 1)
+
+	i := resp.Instances[0]
+	assert.Equal("mx", i.Instance)
+	assert.Equal("socket", i.Source)
+	assert.Equal(2, i.Collections)
+	assert.Equal(1, i.Errors)
+	assert.Equal("smtpctl failed", i.LastError)
+	// the stats of the last successful collection stay
+	assert.Equal(float64(42), i.Stats["scheduler.delivery.ok"])
+	assert.Equal("2m", i.Stats["uptime.human"])
+	assert.Equal(int64(3), i.Queue.Envelopes)
+}
+
+func TestRate(t *testing.T) {
+	now := time.Unix(1577836800, 0)
+	samples := []rateSample{
+		{time: now.Add(-20 * time.Minute), values: map[string]float64{"smtpd_delivery_ok": 0}},
+		{time: now.Add(-10 * time.Minute), values: map[string]float64{"smtpd_delivery_ok": 300}},
+		// smtpd restarted
+		{time: now.Add(-5 * time.Minute), values: map[string]float64{"smtpd_delivery_ok": 60}},
+		{time: now.Add(-time.Minute), values: map[string]float64{"smtpd_delivery_ok": 120}},
+		{time: now, values: map[string]float64{"smtpd_delivery_ok": 180}},
+	}
+
+	tests := []struct {
+		name   string
+		window time.Duration
+		rate   float64
+		ok     bool
+	}{
+		{"1m", time.Minute, 1, true},
+		{"5m", 5 * time.Minute, 0.4, true},
+		{"15m", 15 * time.Minute, 0.4, true},
+	}
+
+	for _, test := range tests {
+		r, ok := rate(samples, "smtpd_delivery_ok", now.Add(-test.window))
+		assert.Equal(t, test.ok, ok, test.name)
+		assert.InDelta(t, test.rate, r, 1e-9, test.name)
+	}
+
+	_, ok := rate(samples[4:], "smtpd_delivery_ok", now.Add(-time.Minute))
+	assert.False(t, ok)
+}
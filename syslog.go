@@ -0,0 +1,297 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// maxSyslogSize is the biggest syslog message we accept.
+const maxSyslogSize = 64 * 1024
+
+// nolint:gochecknoglobals
+var (
+	// matches "<22>" at the start of every syslog message.
+	priRe = regexp.MustCompile(`^<(\d{1,3})>`)
+	// matches RFC 3164 messages without hostname, like the ones written to
+	// /dev/log, "Jan  2 15:04:05 smtpd[123]: message".
+	noHostLineRe = regexp.MustCompile(`^([A-Z][a-z]{2}\s+\d{1,2} \d{2}:\d{2}:\d{2}) ([^\[\s:]+)(?:\[(\d+)\])?: (.*)$`)
+)
+
+// SyslogReceiver receives RFC 3164 and RFC 5424 syslog messages and passes the
+// ones of the smtpd program as log events to the handler.
+type SyslogReceiver struct {
+	Handler EventHandler
+	Program string
+}
+
+// ListenAndServe listens on an address like "udp://:514", "tcp://:514" or
+// "unixgram:///var/run/smtpd-log.sock" and serves until an error occurs.
+func (s *SyslogReceiver) ListenAndServe(addr string) error {
+	u, err := url.Parse(addr)
+	if err != nil {
+		return fmt.Errorf("could not parse syslog address: %w", err)
+	}
+
+	switch u.Scheme {
+	case "udp", "udp4", "udp6":
+		conn, err := net.ListenPacket(u.Scheme, u.Host)
+		if err != nil {
+			return fmt.Errorf("could not listen for syslog: %w", err)
+		}
+
+		return s.ServePacket(conn)
+	case "unixgram":
+		if err := removeStaleSocket(u.Path); err != nil {
+			return err
+		}
+
+		conn, err := net.ListenPacket(u.Scheme, u.Path)
+		if err != nil {
+			return fmt.Errorf("could not listen for syslog: %w", err)
+		}
+
+		return s.ServePacket(conn)
+	case "tcp", "tcp4", "tcp6":
+		l, err := net.Listen(u.Scheme, u.Host)
+		if err != nil {
+			return fmt.Errorf("could not listen for syslog: %w", err)
+		}
+
+		return s.Serve(l)
+	default:
+		return fmt.Errorf("unsupported syslog network: %s", u.Scheme)
+	}
+}
+
+// ServePacket reads one syslog message per datagram.
+func (s *SyslogReceiver) ServePacket(conn net.PacketConn) error {
+	defer conn.Close()
+
+	buf := make([]byte, maxSyslogSize)
+
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			return fmt.Errorf("could not read syslog message: %w", err)
+		}
+
+		s.handle(buf[:n])
+	}
+}
+
+// Serve accepts stream connections and reads syslog messages framed by octet
+// counting (RFC 6587) or newlines.
+func (s *SyslogReceiver) Serve(l net.Listener) error {
+	defer l.Close()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return fmt.Errorf("could not accept syslog connection: %w", err)
+		}
+
+		go func() {
+			defer conn.Close()
+
+			err := s.readStream(bufio.NewReaderSize(conn, maxSyslogSize))
+			if err != nil && err != io.EOF {
+				log.WithFields(log.Fields{"remote": conn.RemoteAddr(), "error": err}).Error("could not read syslog stream")
+			}
+		}()
+	}
+}
+
+func (s *SyslogReceiver) readStream(r *bufio.Reader) error {
+	for {
+		first, err := r.Peek(1)
+		if err != nil {
+			return err
+		}
+
+		// octet counting starts with the length, non transparent framing with
+		// the priority
+		if first[0] < '0' || first[0] > '9' {
+			line, ok, err := readSyslogLine(r)
+
+			switch {
+			case !ok:
+				log.WithFields(log.Fields{"max": maxSyslogSize}).Debug("skipping too long syslog message")
+			case len(line) > 0:
+				s.handle(line)
+			}
+
+			if err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		size, err := r.ReadString(' ')
+		if err != nil {
+			return err
+		}
+
+		n, err := strconv.Atoi(strings.TrimSpace(size))
+		if err != nil || n > maxSyslogSize {
+			return fmt.Errorf("invalid syslog frame length: %s", size)
+		}
+
+		msg := make([]byte, n)
+		if _, err := io.ReadFull(r, msg); err != nil {
+			return err
+		}
+
+		s.handle(msg)
+	}
+}
+
+// readSyslogLine reads a newline framed message from r, which buffers
+// maxSyslogSize bytes. A longer message is read to its end and left out, ok
+// is false then.
+func readSyslogLine(r *bufio.Reader) ([]byte, bool, error) {
+	line, err := r.ReadSlice('\n')
+	if err != bufio.ErrBufferFull {
+		return line, true, err
+	}
+
+	for err == bufio.ErrBufferFull {
+		_, err = r.ReadSlice('\n')
+	}
+
+	return nil, false, err
+}
+
+// handle parses a syslog message and passes it on if it is from smtpd.
+func (s *SyslogReceiver) handle(b []byte) {
+	l, err := parseSyslogMessage(strings.TrimRight(string(b), "\r\n\x00"), time.Now())
+	if err != nil {
+		log.WithFields(log.Fields{"message": string(b), "error": err}).Debug("could not parse syslog message")
+		return
+	}
+
+	if l.Program != s.Program {
+		return
+	}
+
+	ev, err := parseLogMessage(l.Time, l.Message)
+	if err != nil {
+		if err != errNoEvent {
+			log.WithFields(log.Fields{"message": l.Message, "error": err}).Debug("could not parse message")
+		}
+
+		return
+	}
+
+	ev.Host = l.Host
+	ev.PID = l.PID
+
+	s.Handler.Handle(ev)
+}
+
+// parseSyslogMessage parses a RFC 3164 or RFC 5424 formatted message.
+func parseSyslogMessage(msg string, ref time.Time) (*SyslogLine, error) {
+	match := priRe.FindStringSubmatch(msg)
+	if match == nil {
+		return nil, fmt.Errorf("missing syslog priority: %s", msg)
+	}
+
+	msg = msg[len(match[0]):]
+
+	if strings.HasPrefix(msg, "1 ") {
+		return parseRFC5424(msg[2:], ref)
+	}
+
+	if match := noHostLineRe.FindStringSubmatch(msg); match != nil {
+		t, err := time.ParseInLocation(time.Stamp, match[1], ref.Location())
+		if err != nil {
+			return nil, fmt.Errorf("could not parse timestamp: %s", match[1])
+		}
+
+		return newSyslogLine(withYear(t, ref), append([]string{""}, match[2:]...))
+	}
+
+	return parseSyslogLine(msg, ref)
+}
+
+// parseRFC5424 parses "TIMESTAMP HOSTNAME APP-NAME PROCID MSGID SD MSG". A
+// message without timestamp gets the time it was received at.
+func parseRFC5424(msg string, ref time.Time) (*SyslogLine, error) {
+	headerFields := 5
+
+	parts := strings.SplitN(msg, " ", headerFields+1)
+	if len(parts) < headerFields {
+		return nil, fmt.Errorf("invalid rfc5424 header: %s", msg)
+	}
+
+	l := &SyslogLine{Time: ref, Host: nilValue(parts[1]), Program: nilValue(parts[2])}
+
+	if parts[0] != "-" {
+		t, err := time.Parse(time.RFC3339Nano, parts[0])
+		if err != nil {
+			return nil, fmt.Errorf("could not parse timestamp: %s", parts[0])
+		}
+
+		l.Time = t
+	}
+
+	if procID := nilValue(parts[3]); procID != "" {
+		l.PID = atoi(procID)
+	}
+
+	if len(parts) > headerFields {
+		l.Message = strings.TrimPrefix(skipStructuredData(parts[headerFields]), "\ufeff")
+	}
+
+	return l, nil
+}
+
+// skipStructuredData returns what follows the structured data element(s).
+func skipStructuredData(s string) string {
+	if strings.HasPrefix(s, "-") {
+		return strings.TrimPrefix(s[1:], " ")
+	}
+
+	var (
+		depth   int
+		escaped bool
+		quoted  bool
+	)
+
+	for i, r := range s {
+		switch {
+		case escaped:
+			escaped = false
+		case r == '\\':
+			escaped = true
+		case r == '"':
+			quoted = !quoted
+		case r == '[' && !quoted:
+			depth++
+		case r == ']' && !quoted:
+			depth--
+		case r == ' ' && depth == 0 && !quoted:
+			return s[i+1:]
+		}
+	}
+
+	return ""
+}
+
+// nilValue turns the RFC 5424 nil value "-" into an empty string.
+func nilValue(s string) string {
+	if s == "-" {
+		return ""
+	}
+
+	return s
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// eventRecorder sends every handled event to a channel.
+type eventRecorder chan *LogEvent
+
+func (r eventRecorder) Handle(ev *LogEvent) {
+	r <- ev
+}
+
+// next waits for the next event.
+func (r eventRecorder) next(t *testing.T) *LogEvent {
+	select {
+	case ev := <-r:
+		return ev
+	case <-time.After(2 * time.Second):
+		t.Fatal("timeout waiting for log event")
+	}
+
+	return nil
+}
+
+// nolint:gochecknoglobals
+var syslogMessages = []string{
+	// RFC 3164 of another program, this one gets dropped
+	`<22>Feb 28 10:00:00 mx postfix/smtpd[9]: connect from unknown[192.0.2.1]`,
+	// RFC 3164
+	`<22>Feb 28 10:00:00 mx smtpd[123]: 8e5a1b2c3d4e5f60 smtp connected address=192.0.2.1 host=mail.example.org`,
+	// RFC 3164 without hostname
+	`<22>Feb 28 10:00:01 smtpd[123]: 8e5a1b2c3d4e5f60 smtp message msgid=a1b2c3d4 size=1234 nrcpt=1 proto=ESMTP`,
+	// RFC 5424 with structured data
+	`<22>1 2020-02-28T10:00:02.000Z mx smtpd 123 - [meta sequenceId="1"] ` +
+		`8e5a1b2c3d4e5f61 mta delivery evpid=a1b2c3d4e5f60718 result="Ok" stat="250 Ok"`,
+}
+
+// assertSyslogEvents checks that the smtpd messages arrived in order.
+func assertSyslogEvents(t *testing.T, r eventRecorder) {
+	assert := assert.New(t)
+
+	ev := r.next(t)
+	assert.Equal("connected", ev.Event)
+	assert.Equal("mx", ev.Host)
+	assert.Equal(123, ev.PID)
+	assert.Equal("192.0.2.1", ev.Fields["address"])
+
+	ev = r.next(t)
+	assert.Equal("message", ev.Event)
+	assert.Equal("", ev.Host)
+	assert.Equal("a1b2c3d4", ev.Fields["msgid"])
+
+	ev = r.next(t)
+	assert.Equal("delivery", ev.Event)
+	assert.Equal("mta", ev.Subsystem)
+	assert.Equal("mx", ev.Host)
+	assert.Equal("Ok", ev.Fields["result"])
+	assert.True(time.Date(2020, time.February, 28, 10, 0, 2, 0, time.UTC).Equal(ev.Time))
+}
+
+func TestSyslogUDP(t *testing.T) {
+	r := make(eventRecorder, len(syslogMessages))
+	s := &SyslogReceiver{Handler: r, Program: "smtpd"}
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	go s.ServePacket(conn) // nolint:errcheck
+
+	client, err := net.Dial("udp", conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	for _, msg := range syslogMessages {
+		if _, err := client.Write([]byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	assertSyslogEvents(t, r)
+}
+
+func TestSyslogTCP(t *testing.T) {
+	tables := []struct {
+		name  string
+		frame func(string) string
+	}{
+		{"newline", func(msg string) string { return msg + "\n" }},
+		{"octet counting", func(msg string) string { return fmt.Sprintf("%d %s", len(msg), msg) }},
+		// the too long message gets skipped
+		{"newline after too long", func(msg string) string {
+			return "<22>" + strings.Repeat("x", maxSyslogSize) + "\n" + msg + "\n"
+		}},
+	}
+
+	for _, table := range tables {
+		t.Run(table.name, func(t *testing.T) {
+			r := make(eventRecorder, len(syslogMessages))
+			s := &SyslogReceiver{Handler: r, Program: "smtpd"}
+
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer l.Close()
+
+			go s.Serve(l) // nolint:errcheck
+
+			client, err := net.Dial("tcp", l.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer client.Close()
+
+			for _, msg := range syslogMessages {
+				if _, err := client.Write([]byte(table.frame(msg))); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			assertSyslogEvents(t, r)
+		})
+	}
+}
+
+func TestSyslogUnixgram(t *testing.T) {
+	dir, err := ioutil.TempDir("", "smtpd_exporter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "log.sock")
+	r := make(eventRecorder, len(syslogMessages))
+	s := &SyslogReceiver{Handler: r, Program: "smtpd"}
+
+	// the socket of an unclean exit
+	stale, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stale.Close()
+
+	go s.ListenAndServe("unixgram://" + path) // nolint:errcheck
+
+	var client net.Conn
+
+	// wait for the socket to show up
+	for i := 0; i < 100; i++ {
+		client, err = net.Dial("unixgram", path)
+		if err == nil {
+			break
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	for _, msg := range syslogMessages {
+		if _, err := client.Write([]byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	assertSyslogEvents(t, r)
+}
+
+func TestParseSyslogMessageNilTimestamp(t *testing.T) {
+	now := time.Date(2020, time.February, 28, 10, 0, 0, 0, time.UTC)
+
+	l, err := parseSyslogMessage(`<22>1 - mx smtpd 123 - - 8e5a1b2c3d4e5f60 smtp connected address=192.0.2.1`, now)
+	assert.Nil(t, err)
+	assert.Equal(t, now, l.Time)
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/expfmt"
+	log "github.com/sirupsen/logrus"
+)
+
+// textfilePerm lets node_exporter read the written file.
+const textfilePerm = 0o644
+
+// TextfileWriter writes metrics for the textfile collector of node_exporter.
+type TextfileWriter struct {
+	Path string
+
+	gatherer  prometheus.Gatherer
+	timestamp prometheus.Gauge
+}
+
+// NewTextfileWriter creates a writer of the metrics of g to path.
+func NewTextfileWriter(g prometheus.Gatherer, path string) *TextfileWriter {
+	timestamp := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "smtpd_exporter_textfile_timestamp_seconds",
+		Help: "Time the metrics were written as unix timestamp.",
+	})
+
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(timestamp)
+
+	return &TextfileWriter{
+		Path:      path,
+		gatherer:  prometheus.Gatherers{g, reg},
+		timestamp: timestamp,
+	}
+}
+
+// Write replaces the file with the current metrics. The go and process
+// metrics are left out, node_exporter has its own.
+func (w *TextfileWriter) Write(now time.Time) error {
+	w.timestamp.Set(float64(now.UnixNano()) / float64(time.Second))
+
+	mfs, err := w.gatherer.Gather()
+	if err != nil {
+		return fmt.Errorf("could not gather metrics: %w", err)
+	}
+
+	var buf bytes.Buffer
+
+	enc := expfmt.NewEncoder(&buf, expfmt.FmtText)
+
+	for _, mf := range mfs {
+		if strings.HasPrefix(mf.GetName(), "go_") || strings.HasPrefix(mf.GetName(), "process_") {
+			continue
+		}
+
+		if err := enc.Encode(mf); err != nil {
+			return fmt.Errorf("could not encode metrics: %w", err)
+		}
+	}
+
+	if err := writeFileAtomic(w.Path, buf.Bytes(), textfilePerm); err != nil {
+		return fmt.Errorf("could not write textfile: %w", err)
+	}
+
+	return nil
+}
+
+// Run writes the metrics every interval until ctx is done.
+func (w *TextfileWriter) Run(ctx context.Context, interval time.Duration) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			if err := w.Write(now); err != nil {
+				log.Error(err)
+			}
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
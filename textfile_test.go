@@ -0,0 +1,57 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTextfileWriter(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "smtpd_exporter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(prometheus.NewGoCollector())
+
+	c := prometheus.NewCounter(prometheus.CounterOpts{Name: "smtpd_delivery_ok", Help: "Shows how often a delivery was ok."})
+	c.Add(42)
+	reg.MustRegister(c)
+
+	path := filepath.Join(dir, "smtpd.prom")
+	w := NewTextfileWriter(reg, path)
+
+	assert.Nil(w.Write(time.Unix(1577836800, 500000000)))
+
+	b, err := ioutil.ReadFile(path)
+	assert.Nil(err)
+	assert.Equal(`# HELP smtpd_delivery_ok Shows how often a delivery was ok.
+# TYPE smtpd_delivery_ok counter
+smtpd_delivery_ok 42
+# HELP smtpd_exporter_textfile_timestamp_seconds Time the metrics were written as unix timestamp.
+# TYPE smtpd_exporter_textfile_timestamp_seconds gauge
+smtpd_exporter_textfile_timestamp_seconds 1.5778368005e+09
+`, string(b))
+
+	info, err := os.Stat(path)
+	assert.Nil(err)
+	assert.Equal(os.FileMode(textfilePerm), info.Mode().Perm())
+
+	// no temporary files are left behind
+	files, err := ioutil.ReadDir(dir)
+	assert.Nil(err)
+	assert.Len(files, 1)
+
+	// a missing directory is an error
+	w.Path = filepath.Join(dir, "missing", "smtpd.prom")
+	assert.NotNil(w.Write(time.Now()))
+}
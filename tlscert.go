@@ -0,0 +1,321 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+// nolint:gochecknoglobals
+var (
+	certNotAfterDesc = prometheus.NewDesc(
+		"smtpd_tls_cert_not_after_seconds",
+		"Expiry of the certificates of a smtpd pki entry as unix timestamp.",
+		[]string{"pki", "subject", "issuer"}, nil,
+	)
+	certNotBeforeDesc = prometheus.NewDesc(
+		"smtpd_tls_cert_not_before_seconds",
+		"Start of validity of the certificates of a smtpd pki entry as unix timestamp.",
+		[]string{"pki", "subject", "issuer"}, nil,
+	)
+	certSANDesc = prometheus.NewDesc(
+		"smtpd_tls_cert_san_info",
+		"Subject alternative names of the leaf certificate of a smtpd pki entry.",
+		[]string{"pki", "name"}, nil,
+	)
+	certKeyMismatchDesc = prometheus.NewDesc(
+		"smtpd_tls_cert_key_mismatch",
+		"Shows if the key of a smtpd pki entry does not belong to its certificate.",
+		[]string{"pki"}, nil,
+	)
+	certErrorDesc = prometheus.NewDesc(
+		"smtpd_tls_cert_error",
+		"Shows if the certificate of a smtpd pki entry could not be read.",
+		[]string{"pki"}, nil,
+	)
+)
+
+// fileState identifies a version of a file on disk.
+type fileState struct {
+	modTime time.Time
+	size    int64
+}
+
+func statFile(path string) fileState {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return fileState{}
+	}
+
+	return fileState{modTime: fi.ModTime(), size: fi.Size()}
+}
+
+// pkiState is a parsed pki entry and the file versions it was parsed from.
+type pkiState struct {
+	cert, key fileState
+	certs     []*x509.Certificate
+	mismatch  bool
+	keyErr    error
+	err       error
+}
+
+// CertCollector exports the certificates of smtpd pki entries. The files are
+// parsed again when they change on disk.
+type CertCollector struct {
+	pkis []*PKI
+
+	mux   sync.Mutex
+	state map[string]*pkiState
+}
+
+// NewCertCollector creates a collector for the pki entries.
+func NewCertCollector(pkis []*PKI) *CertCollector {
+	return &CertCollector{pkis: pkis, state: map[string]*pkiState{}}
+}
+
+// Describe implements prometheus.Collector.
+func (c *CertCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- certNotAfterDesc
+	ch <- certNotBeforeDesc
+	ch <- certSANDesc
+	ch <- certKeyMismatchDesc
+	ch <- certErrorDesc
+}
+
+// Collect implements prometheus.Collector.
+func (c *CertCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	for _, p := range c.pkis {
+		s := c.load(p)
+
+		if s.err != nil {
+			ch <- prometheus.MustNewConstMetric(certErrorDesc, prometheus.GaugeValue, 1, p.Name)
+			continue
+		}
+
+		ch <- prometheus.MustNewConstMetric(certErrorDesc, prometheus.GaugeValue, 0, p.Name)
+
+		seen := map[string]bool{}
+
+		for _, cert := range s.certs {
+			subject, issuer := cert.Subject.String(), cert.Issuer.String()
+
+			// a re-issued or cross-signed certificate in the bundle would be
+			// the same series, the first one wins like the leaf comes first
+			if seen[subject+"\x00"+issuer] {
+				continue
+			}
+
+			seen[subject+"\x00"+issuer] = true
+
+			ch <- prometheus.MustNewConstMetric(
+				certNotAfterDesc, prometheus.GaugeValue, float64(cert.NotAfter.Unix()), p.Name, subject, issuer,
+			)
+			ch <- prometheus.MustNewConstMetric(
+				certNotBeforeDesc, prometheus.GaugeValue, float64(cert.NotBefore.Unix()), p.Name, subject, issuer,
+			)
+		}
+
+		for _, name := range sans(s.certs[0]) {
+			ch <- prometheus.MustNewConstMetric(certSANDesc, prometheus.GaugeValue, 1, p.Name, name)
+		}
+
+		// without a readable key there is nothing to compare
+		if s.keyErr != nil {
+			continue
+		}
+
+		var mismatch float64
+		if s.mismatch {
+			mismatch = 1
+		}
+
+		ch <- prometheus.MustNewConstMetric(certKeyMismatchDesc, prometheus.GaugeValue, mismatch, p.Name)
+	}
+}
+
+// load returns the parsed pki entry and parses it again if a file changed.
+func (c *CertCollector) load(p *PKI) *pkiState {
+	certState, keyState := statFile(p.Cert), statFile(p.Key)
+
+	if s, ok := c.state[p.Name]; ok && s.cert == certState && s.key == keyState {
+		return s
+	}
+
+	log.WithFields(log.Fields{"pki": p.Name}).Debug("load certificates")
+
+	s := &pkiState{cert: certState, key: keyState}
+	c.state[p.Name] = s
+
+	certPEM, err := ioutil.ReadFile(p.Cert)
+	if err != nil {
+		s.err = err
+		log.WithFields(log.Fields{"pki": p.Name, "error": err}).Error("could not read certificate")
+
+		return s
+	}
+
+	s.certs, s.err = parseCerts(certPEM)
+	if s.err != nil {
+		log.WithFields(log.Fields{"pki": p.Name, "error": s.err}).Error("could not parse certificate")
+		return s
+	}
+
+	keyPEM, err := ioutil.ReadFile(p.Key)
+	if err != nil {
+		s.keyErr = err
+		log.WithFields(log.Fields{"pki": p.Name, "error": err}).Debug("could not read key")
+
+		return s
+	}
+
+	matches, err := keyMatches(s.certs[0], keyPEM)
+	if err != nil {
+		// an encrypted or broken key tells nothing about the certificate
+		s.keyErr = err
+		log.WithFields(log.Fields{"pki": p.Name, "error": err}).Error("could not parse key")
+
+		return s
+	}
+
+	if !matches {
+		log.WithFields(log.Fields{"pki": p.Name}).Debug("key does not match certificate")
+
+		s.mismatch = true
+	}
+
+	return s
+}
+
+// keyMatches tells if the PEM encoded private key belongs to cert.
+func keyMatches(cert *x509.Certificate, keyPEM []byte) (bool, error) {
+	key, err := parsePrivateKey(keyPEM)
+	if err != nil {
+		return false, err
+	}
+
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return false, errors.New("unsupported private key type")
+	}
+
+	want, err := x509.MarshalPKIXPublicKey(cert.PublicKey)
+	if err != nil {
+		return false, fmt.Errorf("unsupported certificate key: %w", err)
+	}
+
+	got, err := x509.MarshalPKIXPublicKey(signer.Public())
+	if err != nil {
+		return false, fmt.Errorf("unsupported private key: %w", err)
+	}
+
+	return bytes.Equal(want, got), nil
+}
+
+// parsePrivateKey parses the first private key of a PEM file in PKCS #8,
+// PKCS #1 or SEC 1 form.
+func parsePrivateKey(b []byte) (crypto.PrivateKey, error) {
+	for {
+		var block *pem.Block
+
+		block, b = pem.Decode(b)
+		if block == nil {
+			return nil, errors.New("no private key found")
+		}
+
+		if !strings.HasSuffix(block.Type, "PRIVATE KEY") {
+			continue
+		}
+
+		if key, err := x509.ParsePKCS8PrivateKey(block.Bytes); err == nil {
+			return key, nil
+		}
+
+		if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+			return key, nil
+		}
+
+		if key, err := x509.ParseECPrivateKey(block.Bytes); err == nil {
+			return key, nil
+		}
+
+		return nil, errors.New("could not parse private key")
+	}
+}
+
+// parseCerts parses all certificates of a PEM file, the leaf comes first.
+func parseCerts(b []byte) ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+
+	for {
+		var block *pem.Block
+
+		block, b = pem.Decode(b)
+		if block == nil {
+			break
+		}
+
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+
+		certs = append(certs, cert)
+	}
+
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("no certificate found")
+	}
+
+	return certs, nil
+}
+
+// sans returns the DNS names and IP addresses of a certificate.
+func sans(cert *x509.Certificate) []string {
+	names := append([]string{}, cert.DNSNames...)
+	for _, ip := range cert.IPAddresses {
+		names = append(names, ip.String())
+	}
+
+	return names
+}
+
+// parsePKIFlags turns "name:cert[:key]" values into pki entries.
+func parsePKIFlags(values []string) ([]*PKI, error) {
+	pkis := make([]*PKI, 0, len(values))
+
+	for _, v := range values {
+		parts := strings.Split(v, ":")
+
+		minParts, maxParts := 2, 3
+		if len(parts) < minParts || len(parts) > maxParts {
+			return nil, fmt.Errorf("invalid pki, want name:cert[:key]: %s", v)
+		}
+
+		p := &PKI{Name: parts[0], Cert: parts[1]}
+		if len(parts) == maxParts {
+			p.Key = parts[2]
+		}
+
+		pkis = append(pkis, p)
+	}
+
+	return pkis, nil
+}
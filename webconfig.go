@@ -0,0 +1,526 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/bcrypt"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// maxAuthCache limits the remembered basic auth results.
+const maxAuthCache = 100
+
+// nolint:gochecknoglobals
+var (
+	tlsVersions = map[string]uint16{
+		"TLS10": tls.VersionTLS10,
+		"TLS11": tls.VersionTLS11,
+		"TLS12": tls.VersionTLS12,
+		"TLS13": tls.VersionTLS13,
+	}
+
+	clientAuthTypes = map[string]tls.ClientAuthType{
+		"":                           tls.NoClientCert,
+		"NoClientCert":               tls.NoClientCert,
+		"RequestClientCert":          tls.RequestClientCert,
+		"RequireAnyClientCert":       tls.RequireAnyClientCert,
+		"VerifyClientCertIfGiven":    tls.VerifyClientCertIfGiven,
+		"RequireAndVerifyClientCert": tls.RequireAndVerifyClientCert,
+	}
+
+	cipherSuites = map[string]uint16{
+		"TLS_RSA_WITH_AES_128_CBC_SHA":                  tls.TLS_RSA_WITH_AES_128_CBC_SHA,
+		"TLS_RSA_WITH_AES_256_CBC_SHA":                  tls.TLS_RSA_WITH_AES_256_CBC_SHA,
+		"TLS_RSA_WITH_AES_128_GCM_SHA256":               tls.TLS_RSA_WITH_AES_128_GCM_SHA256,
+		"TLS_RSA_WITH_AES_256_GCM_SHA384":               tls.TLS_RSA_WITH_AES_256_GCM_SHA384,
+		"TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA":          tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA,
+		"TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA":          tls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA,
+		"TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA":            tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA,
+		"TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA":            tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA,
+		"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256":         tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+		"TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384":         tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+		"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256":       tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+		"TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384":       tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+		"TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256":   tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
+		"TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256": tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+	}
+
+	curves = map[string]tls.CurveID{
+		"CurveP256": tls.CurveP256,
+		"CurveP384": tls.CurveP384,
+		"CurveP521": tls.CurveP521,
+		"X25519":    tls.X25519,
+	}
+
+	// allowedHeaders are the response headers the web config may set.
+	allowedHeaders = map[string]bool{
+		"Strict-Transport-Security": true,
+		"X-Frame-Options":           true,
+		"X-Content-Type-Options":    true,
+		"X-XSS-Protection":          true,
+		"Content-Security-Policy":   true,
+	}
+)
+
+// WebConfig is a web config file in the format of the Prometheus exporter
+// toolkit.
+type WebConfig struct {
+	TLSServerConfig  TLSServerConfig   `yaml:"tls_server_config"`
+	HTTPServerConfig HTTPServerConfig  `yaml:"http_server_config"`
+	Users            map[string]string `yaml:"basic_auth_users"`
+}
+
+// TLSServerConfig configures serving over TLS.
+type TLSServerConfig struct {
+	CertFile                 string   `yaml:"cert_file"`
+	KeyFile                  string   `yaml:"key_file"`
+	ClientAuth               string   `yaml:"client_auth_type"`
+	ClientCAs                string   `yaml:"client_ca_file"`
+	CipherSuites             []string `yaml:"cipher_suites"`
+	CurvePreferences         []string `yaml:"curve_preferences"`
+	MinVersion               string   `yaml:"min_version"`
+	MaxVersion               string   `yaml:"max_version"`
+	PreferServerCipherSuites bool     `yaml:"prefer_server_cipher_suites"`
+}
+
+// HTTPServerConfig configures the http server.
+type HTTPServerConfig struct {
+	// HTTP2 is only read on start.
+	HTTP2   *bool             `yaml:"http2"`
+	Headers map[string]string `yaml:"headers"`
+}
+
+// LoadWebConfig reads and checks a web config file and returns it with its
+// TLS settings, which are nil without a certificate.
+func LoadWebConfig(path string) (*WebConfig, *tls.Config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not read web config: %w", err)
+	}
+
+	c := &WebConfig{}
+	if err := yaml.UnmarshalStrict(data, c); err != nil {
+		return nil, nil, fmt.Errorf("could not parse web config: %w", err)
+	}
+
+	t := c.TLSServerConfig
+
+	switch {
+	case (t.CertFile == "") != (t.KeyFile == ""):
+		return nil, nil, errors.New("web config needs both cert_file and key_file")
+	case t.CertFile == "" && (t.ClientCAs != "" || t.ClientAuth != ""):
+		return nil, nil, errors.New("web config needs cert_file for client auth")
+	}
+
+	for name := range c.HTTPServerConfig.Headers {
+		if !allowedHeaders[http.CanonicalHeaderKey(name)] {
+			return nil, nil, fmt.Errorf("web config can not set header %s", name)
+		}
+	}
+
+	for user, hash := range c.Users {
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			return nil, nil, fmt.Errorf("invalid bcrypt hash of user %s: %w", user, err)
+		}
+	}
+
+	tlsConfig, err := c.tlsConfig()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return c, tlsConfig, nil
+}
+
+// tlsConfig builds the tls config, reading the certificates, or returns nil
+// without TLS.
+func (c *WebConfig) tlsConfig() (*tls.Config, error) {
+	t := c.TLSServerConfig
+	if t.CertFile == "" {
+		return nil, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(t.CertFile, t.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("could not load web certificate: %w", err)
+	}
+
+	cfg := &tls.Config{
+		Certificates:             []tls.Certificate{cert},
+		MinVersion:               tls.VersionTLS12,
+		PreferServerCipherSuites: t.PreferServerCipherSuites,
+	}
+
+	auth, ok := clientAuthTypes[t.ClientAuth]
+	if !ok {
+		return nil, fmt.Errorf("invalid client_auth_type: %s", t.ClientAuth)
+	}
+
+	cfg.ClientAuth = auth
+
+	if t.ClientCAs != "" {
+		pem, err := ioutil.ReadFile(t.ClientCAs)
+		if err != nil {
+			return nil, fmt.Errorf("could not read client ca: %w", err)
+		}
+
+		cfg.ClientCAs = x509.NewCertPool()
+		if !cfg.ClientCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in client ca %s", t.ClientCAs)
+		}
+	} else if auth == tls.VerifyClientCertIfGiven || auth == tls.RequireAndVerifyClientCert {
+		return nil, errors.New("client_auth_type needs client_ca_file")
+	}
+
+	for _, v := range []struct {
+		name    string
+		version *uint16
+	}{{t.MinVersion, &cfg.MinVersion}, {t.MaxVersion, &cfg.MaxVersion}} {
+		if v.name == "" {
+			continue
+		}
+
+		version, ok := tlsVersions[v.name]
+		if !ok {
+			return nil, fmt.Errorf("unknown tls version: %s", v.name)
+		}
+
+		*v.version = version
+	}
+
+	for _, name := range t.CipherSuites {
+		suite, ok := cipherSuites[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown cipher suite: %s", name)
+		}
+
+		cfg.CipherSuites = append(cfg.CipherSuites, suite)
+	}
+
+	for _, name := range t.CurvePreferences {
+		curve, ok := curves[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown curve: %s", name)
+		}
+
+		cfg.CurvePreferences = append(cfg.CurvePreferences, curve)
+	}
+
+	return cfg, nil
+}
+
+// WebServer serves http with a web config that gets read again when the file
+// or one of the files it names changes. A broken change is logged and the
+// last good config stays.
+type WebServer struct {
+	// Path is the web config file, without it plain http gets served.
+	Path    string
+	Handler http.Handler
+
+	mux     sync.Mutex
+	cfg     *WebConfig
+	tls     *tls.Config
+	files   map[string]fileState
+	auth    map[[sha256.Size]byte]bool
+	servers []*http.Server
+	serving bool
+	withTLS bool
+	closed  bool
+}
+
+// NewWebServer creates a server of handler with the web config at path.
+func NewWebServer(path string, handler http.Handler) (*WebServer, error) {
+	s := &WebServer{Path: path, Handler: handler, cfg: &WebConfig{}}
+
+	if path != "" {
+		if err := s.Reload(); err != nil {
+			return nil, err
+		}
+	}
+
+	return s, nil
+}
+
+// webState is a loaded web config file and the versions of the files it was
+// read from.
+type webState struct {
+	cfg   *WebConfig
+	tls   *tls.Config
+	files map[string]fileState
+}
+
+// Reload reads the web config file and its certificates again.
+func (s *WebServer) Reload() error {
+	w, err := s.load()
+	if err != nil {
+		return err
+	}
+
+	s.set(w)
+
+	return nil
+}
+
+// load reads the web config file without using it yet, nil without a file.
+// Serving can not switch between http and https, a change that adds or
+// removes the certificate once serving is an error.
+func (s *WebServer) load() (*webState, error) {
+	if s.Path == "" {
+		return nil, nil
+	}
+
+	files := map[string]fileState{s.Path: statFile(s.Path)}
+
+	c, t, err := LoadWebConfig(s.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, path := range []string{c.TLSServerConfig.CertFile, c.TLSServerConfig.KeyFile, c.TLSServerConfig.ClientCAs} {
+		if path != "" {
+			files[path] = statFile(path)
+		}
+	}
+
+	s.mux.Lock()
+	serving, withTLS := s.serving, s.withTLS
+	s.mux.Unlock()
+
+	if serving && (t != nil) != withTLS {
+		return nil, errors.New("adding or removing tls_server_config needs a restart")
+	}
+
+	return &webState{cfg: c, tls: t, files: files}, nil
+}
+
+// set uses a loaded web config.
+func (s *WebServer) set(w *webState) {
+	if w == nil {
+		return
+	}
+
+	s.mux.Lock()
+	s.cfg, s.tls, s.files, s.auth = w.cfg, w.tls, w.files, map[[sha256.Size]byte]bool{}
+	s.mux.Unlock()
+
+	log.WithFields(log.Fields{"file": s.Path}).Debug("loaded web config")
+}
+
+// changed returns the versions of the files of the current web config if one
+// of them changed on disk, nil otherwise.
+func (s *WebServer) changed() map[string]fileState {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	current := make(map[string]fileState, len(s.files))
+	changed := false
+
+	for path, state := range s.files {
+		current[path] = statFile(path)
+		changed = changed || current[path] != state
+	}
+
+	if !changed {
+		return nil
+	}
+
+	return current
+}
+
+// config returns the current web config, reading it again after a change of
+// the file, the certificate or the client CAs.
+func (s *WebServer) config() *WebConfig {
+	if s.Path != "" {
+		if files := s.changed(); files != nil {
+			if err := s.Reload(); err != nil {
+				log.WithFields(log.Fields{"error": err}).Error("keeping the last web config")
+
+				s.mux.Lock()
+				s.files = files
+				s.mux.Unlock()
+			}
+		}
+	}
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	return s.cfg
+}
+
+// tlsConfig returns the TLS settings of the current web config, nil without
+// a certificate.
+func (s *WebServer) tlsConfig() *tls.Config {
+	s.config()
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	return s.tls
+}
+
+// ServeHTTP adds the headers and checks basic auth before the handler.
+func (s *WebServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	c := s.config()
+
+	for name, value := range c.HTTPServerConfig.Headers {
+		w.Header().Set(name, value)
+	}
+
+	if len(c.Users) > 0 && !s.authorized(c, r) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="smtpd_exporter"`)
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+
+		return
+	}
+
+	s.Handler.ServeHTTP(w, r)
+}
+
+// Authenticated tells if the web config has basic auth users.
+func (s *WebServer) Authenticated() bool {
+	return len(s.config().Users) > 0
+}
+
+// authorized checks the basic auth of a request. Results get cached as
+// bcrypt is slow on purpose.
+func (s *WebServer) authorized(c *WebConfig, r *http.Request) bool {
+	user, password, ok := r.BasicAuth()
+	if !ok {
+		return false
+	}
+
+	hash, known := c.Users[user]
+	key := sha256.Sum256([]byte(user + "\x00" + hash + "\x00" + password))
+
+	s.mux.Lock()
+	result, cached := s.auth[key]
+	s.mux.Unlock()
+
+	if cached {
+		return result
+	}
+
+	if !known {
+		// compare anyway to not tell which users exist by timing
+		hash = "$2a$10$ogRgXnWeOO9s5gTKHeLOgeX.UgT41fEksc3cf6xeYpRz48leQoswa"
+	}
+
+	result = bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil && known
+
+	s.mux.Lock()
+	if len(s.auth) >= maxAuthCache {
+		s.auth = map[[sha256.Size]byte]bool{}
+	}
+
+	s.auth[key] = result
+	s.mux.Unlock()
+
+	return result
+}
+
+// Serve serves on l, over TLS if the web config has a certificate. The TLS
+// settings and certificates are read again when the web config or the
+// certificate files change, renewed certificates get picked up that way.
+func (s *WebServer) Serve(l net.Listener) error {
+	c := s.config()
+	srv := &http.Server{Handler: s}
+
+	s.mux.Lock()
+	if s.closed {
+		s.mux.Unlock()
+		return http.ErrServerClosed
+	}
+
+	s.servers = append(s.servers, srv)
+	s.serving, s.withTLS = true, s.tls != nil
+	s.mux.Unlock()
+
+	protos := []string{"h2", "http/1.1"}
+
+	if c.HTTPServerConfig.HTTP2 != nil && !*c.HTTPServerConfig.HTTP2 {
+		srv.TLSNextProto = map[string]func(*http.Server, *tls.Conn, http.Handler){}
+		protos = []string{"http/1.1"}
+	}
+
+	if c.TLSServerConfig.CertFile == "" {
+		return srv.Serve(l)
+	}
+
+	var (
+		protoMux       sync.Mutex
+		loaded, served *tls.Config
+	)
+
+	getConfig := func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		cfg := s.tlsConfig()
+
+		protoMux.Lock()
+		defer protoMux.Unlock()
+
+		// the protocols stay the ones srv got started with
+		if cfg != loaded {
+			loaded, served = cfg, cfg.Clone()
+			served.NextProtos = protos
+		}
+
+		return served, nil
+	}
+
+	srv.TLSConfig = &tls.Config{
+		GetConfigForClient: getConfig,
+		// only there for ServeTLS to not load certificate files itself
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			cfg, err := getConfig(hello)
+			if err != nil {
+				return nil, err
+			}
+
+			return &cfg.Certificates[0], nil
+		},
+	}
+
+	return srv.ServeTLS(l, "", "")
+}
+
+// Shutdown stops serving after the running requests or when ctx is done.
+func (s *WebServer) Shutdown(ctx context.Context) error {
+	s.mux.Lock()
+	s.closed = true
+	servers := s.servers
+	s.mux.Unlock()
+
+	var errs []error
+
+	for _, srv := range servers {
+		if err := srv.Shutdown(ctx); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if len(errs) > 0 {
+		return errs[0]
+	}
+
+	return nil
+}
+
+// ListenAndServe serves on the tcp address addr.
+func (s *WebServer) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	return s.Serve(l)
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testHash is the bcrypt hash of "secret" with cost 4.
+const testHash = "$2a$04$Za/J2ZaqeFXl7VQnli/8DeBSsEfCWndf8AJaBfxraWboLqFFm6DzS"
+
+func writeWebConfig(t *testing.T, path, config string) {
+	if err := ioutil.WriteFile(path, []byte(config), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoadWebConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "webconfig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cert, key := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	writeCert(t, cert, key, "smtpd.example.com", time.Now().Add(time.Hour))
+
+	withTLS := "tls_server_config:\n  cert_file: " + cert + "\n  key_file: " + key + "\n"
+
+	tests := []struct {
+		name   string
+		config string
+		err    bool
+	}{
+		{"empty", "", false},
+		{"users", "basic_auth_users:\n  alice: " + testHash + "\n", false},
+		{"plain password", "basic_auth_users:\n  alice: secret\n", true},
+		{"tls", withTLS, false},
+		{"tls options", withTLS + "  min_version: TLS13\n  cipher_suites: [TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256]\n" +
+			"  curve_preferences: [X25519]\n", false},
+		{"no key", "tls_server_config:\n  cert_file: " + cert + "\n", true},
+		{"missing cert", "tls_server_config:\n  cert_file: /nonexistent\n  key_file: " + key + "\n", true},
+		{"client auth without tls", "tls_server_config:\n  client_auth_type: RequireAnyClientCert\n", true},
+		{"client auth", withTLS + "  client_auth_type: RequireAndVerifyClientCert\n  client_ca_file: " + cert + "\n", false},
+		{"client auth without ca", withTLS + "  client_auth_type: RequireAndVerifyClientCert\n", true},
+		{"unknown client auth", withTLS + "  client_auth_type: Sometimes\n", true},
+		{"unknown version", withTLS + "  min_version: SSL3\n", true},
+		{"unknown cipher", withTLS + "  cipher_suites: [TLS_NULL]\n", true},
+		{"headers", "http_server_config:\n  headers:\n    x-frame-options: deny\n", false},
+		{"forbidden header", "http_server_config:\n  headers:\n    Content-Type: text/html\n", true},
+		{"unknown field", "tls_config: {}\n", true},
+	}
+
+	path := filepath.Join(dir, "web.yml")
+
+	for _, test := range tests {
+		writeWebConfig(t, path, test.config)
+
+		_, _, err := LoadWebConfig(path)
+		assert.Equal(t, test.err, err != nil, test.name)
+	}
+}
+
+func TestWebServerAuth(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "webconfig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "web.yml")
+	writeWebConfig(t, path, "basic_auth_users:\n  alice: "+testHash+"\n"+
+		"http_server_config:\n  headers:\n    X-Frame-Options: deny\n")
+
+	s, err := NewWebServer(path, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("metrics"))
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(user, password string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/metrics", nil)
+		if user != "" {
+			r.SetBasicAuth(user, password)
+		}
+
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+
+		return w
+	}
+
+	tests := []struct {
+		user     string
+		password string
+		code     int
+	}{
+		{"", "", http.StatusUnauthorized},
+		{"alice", "wrong", http.StatusUnauthorized},
+		{"bob", "secret", http.StatusUnauthorized},
+		{"alice", "secret", http.StatusOK},
+		// cached
+		{"alice", "secret", http.StatusOK},
+		{"alice", "wrong", http.StatusUnauthorized},
+	}
+
+	for _, test := range tests {
+		w := get(test.user, test.password)
+		assert.Equal(test.code, w.Code, test.user+":"+test.password)
+		assert.Equal("deny", w.Header().Get("X-Frame-Options"))
+	}
+
+	assert.Contains(get("", "").Header().Get("WWW-Authenticate"), "Basic")
+
+	// a broken change keeps the last config
+	writeWebConfig(t, path, "basic_auth_users: [")
+	assert.Nil(os.Chtimes(path, time.Now(), time.Now().Add(time.Minute)))
+	assert.Equal(http.StatusUnauthorized, get("", "").Code)
+
+	writeWebConfig(t, path, "")
+	assert.Nil(os.Chtimes(path, time.Now(), time.Now().Add(2*time.Minute)))
+	assert.Equal(http.StatusOK, get("", "").Code)
+	assert.Equal("", get("", "").Header().Get("X-Frame-Options"))
+}
+
+func TestWebServerTLS(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "webconfig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cert, key := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	writeCert(t, cert, key, "smtpd.example.com", time.Now().Add(time.Hour))
+
+	path := filepath.Join(dir, "web.yml")
+	writeWebConfig(t, path, "tls_server_config:\n  cert_file: "+cert+"\n  key_file: "+key+"\n")
+
+	s, err := NewWebServer(path, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("metrics"))
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	go func() { _ = s.Serve(l) }()
+
+	pem, err := ioutil.ReadFile(cert)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(pem)
+
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{RootCAs: roots, ServerName: "smtpd.example.com"},
+	}}
+
+	res, err := client.Get("https://" + l.Addr().String() + "/metrics")
+	if assert.Nil(err) {
+		body, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+
+		assert.Equal("metrics", string(body))
+	}
+
+	serverName := func() string {
+		conn, err := tls.Dial("tcp", l.Addr().String(), &tls.Config{ // nolint:gosec
+			InsecureSkipVerify: true, NextProtos: []string{"h2"},
+		})
+		if !assert.Nil(err) {
+			return ""
+		}
+		defer conn.Close()
+
+		assert.Equal("h2", conn.ConnectionState().NegotiatedProtocol)
+
+		return conn.ConnectionState().PeerCertificates[0].Subject.CommonName
+	}
+
+	assert.Equal("smtpd.example.com", serverName())
+
+	// a renewed certificate is used without touching the web config
+	writeCert(t, cert, key, "smtpd.example.org", time.Now().Add(time.Hour))
+
+	for _, f := range []string{cert, key} {
+		assert.Nil(os.Chtimes(f, time.Now(), time.Now().Add(time.Minute)))
+	}
+
+	assert.Equal("smtpd.example.org", serverName())
+
+	// serving can not switch to plain http
+	writeWebConfig(t, path, "")
+	assert.NotNil(s.Reload())
+	assert.Equal("smtpd.example.org", serverName())
+}
+
+func TestWebServerAddTLS(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "webconfig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cert, key := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	writeCert(t, cert, key, "smtpd.example.com", time.Now().Add(time.Hour))
+
+	path := filepath.Join(dir, "web.yml")
+	writeWebConfig(t, path, "")
+
+	s, err := NewWebServer(path, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	go func() { _ = s.Serve(l) }()
+
+	assert.True(waitFor(func() bool {
+		res, err := http.Get("http://" + l.Addr().String() + "/")
+		if err != nil {
+			return false
+		}
+
+		res.Body.Close()
+
+		return true
+	}))
+
+	// the listener keeps serving plain http until a restart
+	writeWebConfig(t, path, "tls_server_config:\n  cert_file: "+cert+"\n  key_file: "+key+"\n")
+
+	err = s.Reload()
+	if assert.NotNil(err) {
+		assert.Contains(err.Error(), "needs a restart")
+	}
+}
@@ -0,0 +1,426 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// zabbixTimeout limits reading a request and writing its answer.
+	zabbixTimeout = 10 * time.Second
+	// maxZabbixRequest limits the size of an item key.
+	maxZabbixRequest = 64 * 1024
+	zabbixHeaderSize = 13
+	// zabbixQueueTTL limits how often the queue items run smtpctl.
+	zabbixQueueTTL = 5 * time.Second
+)
+
+// zabbixHeader starts the messages of the Zabbix protocol.
+// nolint:gochecknoglobals
+var zabbixHeader = []byte("ZBXD\x01")
+
+// ZabbixAgent answers the items of a Zabbix server in passive checks.
+type ZabbixAgent struct {
+	// API holds the stats of the last collection.
+	API *StatsAPI
+	// Queue prints `smtpctl show queue` output.
+	Queue Stat
+	// Config holds the listeners and domains for discovery, if known.
+	Config   *SmtpdConfig
+	Gatherer prometheus.Gatherer
+	// AllowedServers are the networks passive checks may come from, like
+	// Server= of the zabbix agent. Without any no peer is answered.
+	AllowedServers []*net.IPNet
+
+	mux       sync.Mutex
+	queue     string
+	queueTime time.Time
+}
+
+// parseZabbixServers parses a comma separated list of addresses and networks
+// like "127.0.0.1,::1,192.0.2.0/24".
+func parseZabbixServers(s string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+
+	for _, v := range strings.Split(s, ",") {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+
+		if !strings.Contains(v, "/") {
+			ip := net.ParseIP(v)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid zabbix server: %s", v)
+			}
+
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+
+			continue
+		}
+
+		_, n, err := net.ParseCIDR(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid zabbix server: %w", err)
+		}
+
+		nets = append(nets, n)
+	}
+
+	return nets, nil
+}
+
+// ListenAndServe answers the Zabbix server on addr, like :10050, until ctx
+// is done.
+func (z *ZabbixAgent) ListenAndServe(ctx context.Context, addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("could not listen for zabbix: %w", err)
+	}
+	defer l.Close()
+
+	stop := make(chan struct{})
+	defer close(stop)
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			l.Close()
+		case <-stop:
+		}
+	}()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+
+			return fmt.Errorf("could not accept zabbix connection: %w", err)
+		}
+
+		go z.serve(conn)
+	}
+}
+
+func (z *ZabbixAgent) serve(conn net.Conn) {
+	defer conn.Close()
+
+	if !z.allowed(conn.RemoteAddr()) {
+		log.WithFields(log.Fields{"remote": conn.RemoteAddr()}).Warn("dropping zabbix connection of a server not allowed")
+		return
+	}
+
+	if err := conn.SetDeadline(time.Now().Add(zabbixTimeout)); err != nil {
+		return
+	}
+
+	key, err := readZabbixRequest(conn)
+	if err != nil {
+		log.WithFields(log.Fields{"error": err, "remote": conn.RemoteAddr()}).Debug("could not read zabbix request")
+		return
+	}
+
+	value, err := z.Value(key)
+	if err != nil {
+		log.WithFields(log.Fields{"error": err, "key": key}).Debug("zabbix item not supported")
+		value = "ZBX_NOTSUPPORTED\x00" + err.Error()
+	}
+
+	if _, err := conn.Write(zabbixMessage(value)); err != nil {
+		log.WithFields(log.Fields{"error": err, "remote": conn.RemoteAddr()}).Debug("could not answer zabbix")
+	}
+}
+
+// allowed checks if the peer is one of the allowed servers.
+func (z *ZabbixAgent) allowed(addr net.Addr) bool {
+	tcp, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+
+	for _, n := range z.AllowedServers {
+		if n.Contains(tcp.IP) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// readZabbixRequest reads an item key with header, or a plain line as older
+// servers and zabbix_get send it.
+func readZabbixRequest(r io.Reader) (string, error) {
+	br := bufio.NewReader(io.LimitReader(r, maxZabbixRequest+zabbixHeaderSize))
+
+	head, err := br.Peek(len(zabbixHeader))
+	if err != nil || !bytes.Equal(head, zabbixHeader) {
+		line, err := br.ReadString('\n')
+		if err != nil && !errors.Is(err, io.EOF) {
+			return "", err
+		}
+
+		return strings.TrimSpace(line), nil
+	}
+
+	h := make([]byte, zabbixHeaderSize)
+	if _, err := io.ReadFull(br, h); err != nil {
+		return "", err
+	}
+
+	n := binary.LittleEndian.Uint32(h[5:])
+	if n > maxZabbixRequest {
+		return "", fmt.Errorf("zabbix request of %d bytes too large", n)
+	}
+
+	data := make([]byte, n)
+	if _, err := io.ReadFull(br, data); err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(string(data)), nil
+}
+
+// zabbixMessage adds the header to a value.
+func zabbixMessage(value string) []byte {
+	b := make([]byte, zabbixHeaderSize, zabbixHeaderSize+len(value))
+	copy(b, zabbixHeader)
+	binary.LittleEndian.PutUint32(b[5:], uint32(len(value)))
+
+	return append(b, value...)
+}
+
+// Value returns the value of an item key.
+func (z *ZabbixAgent) Value(key string) (string, error) {
+	name, params, err := parseZabbixKey(key)
+	if err != nil {
+		return "", err
+	}
+
+	param := func(i int) string {
+		if i < len(params) {
+			return params[i]
+		}
+
+		return ""
+	}
+
+	switch name {
+	case "agent.ping":
+		return "1", nil
+	case "agent.version":
+		return Version, nil
+	case "smtpd.stat":
+		stats, ok := z.API.Last(param(1))
+		if !ok {
+			return "", errors.New("no stats collected yet")
+		}
+
+		v, ok := stats[param(0)]
+		if !ok {
+			return "", fmt.Errorf("unknown stat: %s", param(0))
+		}
+
+		return fmt.Sprint(v), nil
+	case "smtpd.queue":
+		stats, ok := z.API.Last(param(1))
+		if !ok {
+			return "", errors.New("no stats collected yet")
+		}
+
+		q := queueSummary(stats)
+		values := map[string]int64{
+			"size": q.Envelopes, "incoming": q.Incoming, "inflight": q.Inflight,
+			"expired": q.Expired, "messages": q.Messages,
+		}
+
+		v, ok := values[param(0)]
+		if !ok {
+			return "", fmt.Errorf("unknown queue value: %s", param(0))
+		}
+
+		return strconv.FormatInt(v, 10), nil
+	case "smtpd.listener.discovery":
+		return z.discovery(func() []map[string]string {
+			var data []map[string]string
+			for _, l := range z.Config.Listeners {
+				data = append(data, map[string]string{"{#LISTENER}": l.Name(), "{#ADDRESS}": l.Address()})
+			}
+
+			return data
+		})
+	case "smtpd.listener.messages":
+		return z.listenerMessages(param(0))
+	case "smtpd.domain.discovery":
+		return z.discovery(func() []map[string]string {
+			var data []map[string]string
+			for _, d := range z.Config.Domains() {
+				data = append(data, map[string]string{"{#DOMAIN}": d})
+			}
+
+			return data
+		})
+	case "smtpd.domain.queue":
+		return z.domainQueue(param(0))
+	}
+
+	return "", fmt.Errorf("unsupported item key: %s", name)
+}
+
+// discovery formats low-level discovery data, empty without smtpd config.
+func (z *ZabbixAgent) discovery(data func() []map[string]string) (string, error) {
+	d := []map[string]string{}
+
+	if z.Config != nil {
+		if found := data(); found != nil {
+			d = found
+		}
+	}
+
+	b, err := json.Marshal(map[string]interface{}{"data": d})
+
+	return string(b), err
+}
+
+// listenerMessages counts the messages accepted on a listener that got
+// delivered.
+func (z *ZabbixAgent) listenerMessages(listener string) (string, error) {
+	mfs, err := z.Gatherer.Gather()
+	if err != nil {
+		return "", fmt.Errorf("could not gather metrics: %w", err)
+	}
+
+	var count uint64
+
+	for _, mf := range mfs {
+		if mf.GetName() != "smtpd_message_end_to_end_seconds" {
+			continue
+		}
+
+		for _, m := range mf.GetMetric() {
+			for _, l := range m.GetLabel() {
+				if l.GetName() == "listener" && l.GetValue() == listener {
+					count += m.GetHistogram().GetSampleCount()
+				}
+			}
+		}
+	}
+
+	return strconv.FormatUint(count, 10), nil
+}
+
+// domainQueue counts the envelopes in the queue for a domain, a domain like
+// *.example.org counts its subdomains.
+func (z *ZabbixAgent) domainQueue(d string) (string, error) {
+	out, err := z.queueNow()
+	if err != nil {
+		return "", fmt.Errorf("could not get queue: %w", err)
+	}
+
+	d = strings.ToLower(d)
+
+	var count int
+
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Split(line, "|")
+		if len(fields) < 8 { // nolint:gomnd
+			continue
+		}
+
+		rcpt := domain(fields[5])
+		if rcpt == d || (strings.HasPrefix(d, "*.") && strings.HasSuffix(rcpt, d[1:])) {
+			count++
+		}
+	}
+
+	return strconv.Itoa(count), nil
+}
+
+// queueNow returns the queue, reading it again when it is older than
+// zabbixQueueTTL. A server checking many domains at once only runs smtpctl
+// once.
+func (z *ZabbixAgent) queueNow() (string, error) {
+	z.mux.Lock()
+	defer z.mux.Unlock()
+
+	if !z.queueTime.IsZero() && time.Since(z.queueTime) < zabbixQueueTTL {
+		return z.queue, nil
+	}
+
+	out, err := z.Queue.Now()
+	if err != nil {
+		return "", err
+	}
+
+	z.queue, z.queueTime = out, time.Now()
+
+	return out, nil
+}
+
+// parseZabbixKey splits an item key like smtpd.stat[scheduler.delivery.ok,mx]
+// into its name and parameters, which may be quoted.
+func parseZabbixKey(key string) (string, []string, error) {
+	i := strings.Index(key, "[")
+	if i < 0 {
+		return key, nil, nil
+	}
+
+	if !strings.HasSuffix(key, "]") {
+		return "", nil, fmt.Errorf("invalid item key: %s", key)
+	}
+
+	var (
+		params []string
+		cur    strings.Builder
+		quoted bool
+	)
+
+	s := key[i+1 : len(key)-1]
+
+	for j := 0; j < len(s); j++ {
+		c := s[j]
+
+		switch {
+		case quoted && c == '\\' && j+1 < len(s) && s[j+1] == '"':
+			cur.WriteByte('"')
+			j++
+		case c == '"' && (quoted || strings.TrimSpace(cur.String()) == ""):
+			if !quoted {
+				cur.Reset()
+			}
+
+			quoted = !quoted
+		case c == ',' && !quoted:
+			params = append(params, strings.TrimSpace(cur.String()))
+			cur.Reset()
+		default:
+			cur.WriteByte(c)
+		}
+	}
+
+	if quoted {
+		return "", nil, fmt.Errorf("invalid item key: %s", key)
+	}
+
+	return key[:i], append(params, strings.TrimSpace(cur.String())), nil
+}
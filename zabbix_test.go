@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseZabbixKey(t *testing.T) {
+	tests := []struct {
+		key    string
+		name   string
+		params []string
+		err    bool
+	}{
+		{"agent.ping", "agent.ping", nil, false},
+		{"smtpd.stat[scheduler.delivery.ok]", "smtpd.stat", []string{"scheduler.delivery.ok"}, false},
+		{"smtpd.queue[size, mx]", "smtpd.queue", []string{"size", "mx"}, false},
+		{`smtpd.stat["a,b","say \"hi\""]`, "smtpd.stat", []string{"a,b", `say "hi"`}, false},
+		{"smtpd.stat[ok", "", nil, true},
+		{`smtpd.stat["ok]`, "", nil, true},
+	}
+
+	for _, test := range tests {
+		name, params, err := parseZabbixKey(test.key)
+		assert.Equal(t, test.err, err != nil, test.key)
+		assert.Equal(t, test.name, name, test.key)
+		assert.Equal(t, test.params, params, test.key)
+	}
+}
+
+func TestZabbixAgent(t *testing.T) {
+	api := NewStatsAPI()
+	_, err := api.Stat("", "exec", fixedStat("scheduler.delivery.ok=42\nscheduler.envelope=2\n")).Now()
+	assert.Nil(t, err)
+
+	reg := prometheus.NewRegistry()
+	c := NewCorrelator(reg, 10, 0)
+	c.endToEnd.WithLabelValues("MX", "local_mail").Observe(1)
+	c.endToEnd.WithLabelValues("MX", "outbound").Observe(1)
+
+	z := &ZabbixAgent{
+		API:      api,
+		Queue:    fixedStat(testQueue),
+		Config:   loadTestConfig(t),
+		Gatherer: reg,
+	}
+
+	tests := []struct {
+		key   string
+		value string
+		err   bool
+	}{
+		{"agent.ping", "1", false},
+		{"smtpd.stat[scheduler.delivery.ok]", "42", false},
+		{"smtpd.stat[scheduler.delivery.ok,mx]", "", true},
+		{"smtpd.stat[uptime]", "", true},
+		{"smtpd.queue[size]", "2", false},
+		{"smtpd.queue[age]", "", true},
+		{"smtpd.listener.discovery", `{"data":[{"{#ADDRESS}":"192.0.2.10:25","{#LISTENER}":"MX"},` +
+			`{"{#ADDRESS}":"192.0.2.10:587","{#LISTENER}":"SUBMISSION"},` +
+			`{"{#ADDRESS}":"socket","{#LISTENER}":"socket"}]}`, false},
+		{"smtpd.listener.messages[MX]", "2", false},
+		{"smtpd.listener.messages[SUBMISSION]", "0", false},
+		{"smtpd.domain.discovery", `{"data":[{"{#DOMAIN}":"example.net"},{"{#DOMAIN}":"example.org"}]}`, false},
+		{"smtpd.domain.queue[example.com]", "1", false},
+		{"smtpd.domain.queue[*.example.org]", "0", false},
+		{"system.cpu.load", "", true},
+	}
+
+	for _, test := range tests {
+		v, err := z.Value(test.key)
+		assert.Equal(t, test.err, err != nil, test.key)
+		assert.Equal(t, test.value, v, test.key)
+	}
+
+	z.Config = nil
+	v, err := z.Value("smtpd.domain.discovery")
+	assert.Nil(t, err)
+	assert.Equal(t, `{"data":[]}`, v)
+}
+
+func TestZabbixProtocol(t *testing.T) {
+	assert := assert.New(t)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	servers, err := parseZabbixServers("127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	z := &ZabbixAgent{API: NewStatsAPI(), AllowedServers: servers}
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			go z.serve(conn)
+		}
+	}()
+	defer l.Close()
+
+	ask := func(req []byte) []byte {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		if _, err := conn.Write(req); err != nil {
+			t.Fatal(err)
+		}
+
+		res, err := ioutil.ReadAll(conn)
+		assert.Nil(err)
+
+		return res
+	}
+
+	assert.Equal(zabbixMessage("1"), ask(zabbixMessage("agent.ping")))
+	// zabbix_get of old versions sends the plain key
+	assert.Equal(zabbixMessage("1"), ask([]byte("agent.ping\n")))
+
+	res := ask(zabbixMessage("smtpd.queue[size]"))
+	assert.True(bytes.HasPrefix(res[zabbixHeaderSize:], []byte("ZBX_NOTSUPPORTED\x00no stats collected yet")))
+}
+
+func TestZabbixQueueCache(t *testing.T) {
+	assert := assert.New(t)
+
+	queue := new(MockStat)
+	queue.On("Now").Return(testQueue, nil).Once()
+
+	z := &ZabbixAgent{Queue: queue}
+
+	// checking many domains at once reads the queue once
+	for _, d := range []string{"example.com", "example.net", "*.example.org"} {
+		_, err := z.Value("smtpd.domain.queue[" + d + "]")
+		assert.Nil(err, d)
+	}
+
+	queue.AssertExpectations(t)
+}
+
+func TestZabbixListenAndServeStops(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+
+	go func() {
+		done <- (&ZabbixAgent{}).ListenAndServe(ctx, "127.0.0.1:0")
+	}()
+
+	cancel()
+
+	select {
+	case err := <-done:
+		assert.Nil(t, err)
+	case <-time.After(time.Second):
+		t.Error("zabbix listener did not close")
+	}
+}
+
+func TestZabbixAllowedServers(t *testing.T) {
+	assert := assert.New(t)
+
+	servers, err := parseZabbixServers("127.0.0.1, ::1,192.0.2.0/24")
+	assert.Nil(err)
+
+	z := &ZabbixAgent{AllowedServers: servers}
+
+	tests := []struct {
+		ip      string
+		allowed bool
+	}{
+		{"127.0.0.1", true},
+		{"::1", true},
+		{"::ffff:127.0.0.1", true},
+		{"192.0.2.77", true},
+		{"127.0.0.2", false},
+		{"198.51.100.1", false},
+		{"2001:db8::1", false},
+	}
+
+	for _, test := range tests {
+		assert.Equal(test.allowed, z.allowed(&net.TCPAddr{IP: net.ParseIP(test.ip)}), test.ip)
+	}
+
+	// without servers no one is answered
+	assert.False((&ZabbixAgent{}).allowed(&net.TCPAddr{IP: net.ParseIP("127.0.0.1")}))
+
+	for _, s := range []string{"zabbix.example.org", "192.0.2.0/33"} {
+		_, err := parseZabbixServers(s)
+		assert.NotNil(err, s)
+	}
+}